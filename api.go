@@ -59,6 +59,7 @@ type ApiService struct {
 	requester        Requester
 	signer           Signer
 	apiKeyVersion    string
+	orderValidator   *OrderValidator
 }
 
 // ProductionApiBaseURI is api base uri for production.
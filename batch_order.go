@@ -0,0 +1,297 @@
+package kucoin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxMultiOrders is the max number of the orders of a request of CreateMultiOrder() and HfPlaceMultiOrders().
+const MaxMultiOrders = 5
+
+// All defaults of BatchOpts.
+const (
+	defaultBatchConcurrency = 4
+	defaultBatchRateLimit   = 10
+	defaultBatchRateWindow  = time.Second
+)
+
+// BatchOpts contains the options of the batch helpers.
+type BatchOpts struct {
+	// ChunkSize is the max number of the orders of a request, MaxMultiOrders by default.
+	ChunkSize int
+	// Concurrency is the max number of the requests in flight, 4 by default.
+	Concurrency int
+	// RateLimit is the max number of the requests sent within RateWindow, 10 by default.
+	// It is not limited if it is negative.
+	RateLimit int
+	// RateWindow is the sliding window of RateLimit, 1s by default.
+	RateWindow time.Duration
+}
+
+// withDefaults returns the options with the defaults.
+func (o BatchOpts) withDefaults() BatchOpts {
+	if o.ChunkSize <= 0 || o.ChunkSize > MaxMultiOrders {
+		o.ChunkSize = MaxMultiOrders
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultBatchConcurrency
+	}
+	if o.RateLimit == 0 {
+		o.RateLimit = defaultBatchRateLimit
+	}
+	if o.RateWindow <= 0 {
+		o.RateWindow = defaultBatchRateWindow
+	}
+	return o
+}
+
+// A BatchResult is the result of an order of a batch, at the index of the order in the input.
+type BatchResult struct {
+	ClientOid string `json:"clientOid"`
+	OrderId   string `json:"orderId"`
+	// Err is a *BatchEntryError if the order was rejected by the server,
+	// or the error of the request if the request of its chunk failed.
+	Err error `json:"-"`
+}
+
+// A BatchEntryError represents an order of a batch rejected by the server while the others may succeed.
+type BatchEntryError struct {
+	ClientOid string `json:"clientOid"`
+	OrderId   string `json:"orderId"`
+	Message   string `json:"message"`
+}
+
+// Error implements error.
+func (e *BatchEntryError) Error() string {
+	id := e.ClientOid
+	if id == "" {
+		id = e.OrderId
+	}
+	return fmt.Sprintf("Order %s of the batch failed, %s", id, e.Message)
+}
+
+// A BatchError is returned by the batch helpers if some of the orders failed,
+// the errors of the orders are in their results.
+type BatchError struct {
+	Failed int `json:"failed"`
+	Total  int `json:"total"`
+}
+
+// Error implements error.
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d orders of the batch failed", e.Failed, e.Total)
+}
+
+// batchError returns a *BatchError if some of the results failed.
+func batchError(results []*BatchResult) error {
+	n := 0
+	for _, r := range results {
+		if r.Err != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return &BatchError{Failed: n, Total: len(results)}
+}
+
+// chunkBySymbol splits the indexes of the orders into the chunks of the same symbol,
+// in the order of the first orders of the symbols.
+func chunkBySymbol(n, size int, symbol func(i int) string) [][]int {
+	var symbols []string
+	groups := make(map[string][]int)
+	for i := 0; i < n; i++ {
+		s := symbol(i)
+		if _, ok := groups[s]; !ok {
+			symbols = append(symbols, s)
+		}
+		groups[s] = append(groups[s], i)
+	}
+	var chunks [][]int
+	for _, s := range symbols {
+		g := groups[s]
+		for len(g) > size {
+			chunks = append(chunks, g[:size])
+			g = g[size:]
+		}
+		chunks = append(chunks, g)
+	}
+	return chunks
+}
+
+// runBatch calls do for the tasks concurrently within the limits of the options.
+// The tasks not started before ctx is done are passed to fail with the error of ctx.
+func runBatch(ctx context.Context, tasks int, opts BatchOpts, do func(i int), fail func(i int, err error)) {
+	var limiter *rateLimiter
+	if opts.RateLimit > 0 {
+		limiter = &rateLimiter{limit: opts.RateLimit, window: opts.RateWindow}
+	}
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < tasks; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			fail(i, ctx.Err())
+			continue
+		}
+		if ctx.Err() != nil || limiter != nil && !limiter.wait(ctx.Done()) {
+			<-sem
+			fail(i, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			do(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// A multiOrderEntry is an entry of the result of CreateMultiOrder().
+type multiOrderEntry struct {
+	Id        string `json:"id"`
+	ClientOid string `json:"clientOid"`
+	Status    string `json:"status"`
+	FailMsg   string `json:"failMsg"`
+}
+
+// CreateMultiOrderBatch places any number of orders with CreateMultiOrder().
+// The orders are split into the chunks of the same symbol, which are sent concurrently.
+// The results are aligned with the orders, a *BatchError is returned if some of them failed.
+func (as *ApiService) CreateMultiOrderBatch(ctx context.Context, orders []*CreateOrderModel, opts BatchOpts) ([]*BatchResult, error) {
+	opts = opts.withDefaults()
+	results := make([]*BatchResult, len(orders))
+	for i, o := range orders {
+		results[i] = &BatchResult{ClientOid: o.ClientOid}
+	}
+	chunks := chunkBySymbol(len(orders), opts.ChunkSize, func(i int) string { return orders[i].Symbol })
+
+	runBatch(ctx, len(chunks), opts, func(c int) {
+		chunk := chunks[c]
+		l := make([]*CreateOrderModel, len(chunk))
+		for j, i := range chunk {
+			l[j] = orders[i]
+		}
+		entries := struct {
+			Data []*multiOrderEntry `json:"data"`
+		}{}
+		rsp, err := as.CreateMultiOrder(ctx, l[0].Symbol, l)
+		if err == nil {
+			err = readBatch(rsp, &entries, len(chunk), func() int { return len(entries.Data) })
+		}
+		for j, i := range chunk {
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			e := entries.Data[j]
+			results[i].OrderId = e.Id
+			if e.Status != "success" {
+				results[i].Err = &BatchEntryError{ClientOid: results[i].ClientOid, OrderId: e.Id, Message: e.FailMsg}
+			}
+		}
+	}, func(c int, err error) {
+		for _, i := range chunks[c] {
+			results[i].Err = err
+		}
+	})
+	return results, batchError(results)
+}
+
+// HfPlaceMultiOrdersBatch places any number of HF orders with HfPlaceMultiOrders().
+// The orders are split into the chunks of the same symbol, which are sent concurrently.
+// The results are aligned with the orders, a *BatchError is returned if some of them failed.
+func (as *ApiService) HfPlaceMultiOrdersBatch(ctx context.Context, orders []*HFCreateMultiOrderModel, opts BatchOpts) ([]*BatchResult, error) {
+	opts = opts.withDefaults()
+	results := make([]*BatchResult, len(orders))
+	for i, o := range orders {
+		results[i] = &BatchResult{ClientOid: o.ClientOid}
+	}
+	chunks := chunkBySymbol(len(orders), opts.ChunkSize, func(i int) string { return orders[i].Symbol })
+
+	runBatch(ctx, len(chunks), opts, func(c int) {
+		chunk := chunks[c]
+		l := make([]*HFCreateMultiOrderModel, len(chunk))
+		for j, i := range chunk {
+			l[j] = orders[i]
+		}
+		entries := HfPlaceMultiOrdersRes{}
+		rsp, err := as.HfPlaceMultiOrders(ctx, l)
+		if err == nil {
+			err = readBatch(rsp, &entries, len(chunk), func() int { return len(entries) })
+		}
+		for j, i := range chunk {
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			e := entries[j]
+			results[i].OrderId = e.OrderId
+			if !e.Success {
+				results[i].Err = &BatchEntryError{ClientOid: results[i].ClientOid, OrderId: e.OrderId, Message: e.FailMsg}
+			}
+		}
+	}, func(c int, err error) {
+		for _, i := range chunks[c] {
+			results[i].Err = err
+		}
+	})
+	return results, batchError(results)
+}
+
+// readBatch reads the entries of the result of a chunk, and checks there is an entry per order.
+func readBatch(rsp *ApiResponse, v interface{}, n int, entries func() int) error {
+	if err := rsp.ReadData(v); err != nil {
+		return err
+	}
+	if entries() != n {
+		return errors.Errorf("Batch failed, %d entries returned for %d orders", entries(), n)
+	}
+	return nil
+}
+
+// A BatchCancelRequest is an order to cancel by CancelOrdersBatch(), by its order id or client oid.
+type BatchCancelRequest struct {
+	Account AccountKind `json:"account"`
+	// Symbol is required by the HF endpoints.
+	Symbol    string `json:"symbol"`
+	OrderId   string `json:"orderId,omitempty"`
+	ClientOid string `json:"clientOid,omitempty"`
+}
+
+// CancelOrdersBatch cancels any number of orders of any symbols and accounts concurrently.
+// The order id is used if it is not empty, the client oid otherwise.
+// The results are aligned with the requests, a *BatchError is returned if some of them failed.
+func (s *UnifiedOrderService) CancelOrdersBatch(ctx context.Context, reqs []*BatchCancelRequest, opts BatchOpts) ([]*BatchResult, error) {
+	opts = opts.withDefaults()
+	results := make([]*BatchResult, len(reqs))
+	for i, r := range reqs {
+		results[i] = &BatchResult{ClientOid: r.ClientOid, OrderId: r.OrderId}
+	}
+
+	runBatch(ctx, len(reqs), opts, func(i int) {
+		r := reqs[i]
+		rsp, err := s.cancel(ctx, r.Account, r.Symbol, r.OrderId, r.ClientOid)
+		if err != nil {
+			results[i].Err = err
+			return
+		}
+		if err := rsp.ReadData(nil); err != nil {
+			results[i].Err = err
+			if rsp.HttpSuccessful() && !rsp.ApiSuccessful() {
+				results[i].Err = &BatchEntryError{ClientOid: r.ClientOid, OrderId: r.OrderId, Message: rsp.Message}
+			}
+		}
+	}, func(i int, err error) {
+		results[i].Err = err
+	})
+	return results, batchError(results)
+}
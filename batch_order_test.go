@@ -0,0 +1,143 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestApiService_HfPlaceMultiOrdersBatch(t *testing.T) {
+	rr := newRouteRequester()
+	var mu sync.Mutex
+	sizes := make(map[string][]int)
+	rr.handle(http.MethodPost, "/api/v1/hf/orders/multi", func(r *Request) interface{} {
+		p := struct {
+			OrderList []*HFCreateMultiOrderModel `json:"orderList"`
+		}{}
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		mu.Lock()
+		sizes[p.OrderList[0].Symbol] = append(sizes[p.OrderList[0].Symbol], len(p.OrderList))
+		mu.Unlock()
+		res := HfPlaceMultiOrdersRes{}
+		for _, o := range p.OrderList {
+			if o.ClientOid == "c3" {
+				res = append(res, &HfPlaceOrderRes{Success: false, FailMsg: "Balance insufficient"})
+				continue
+			}
+			res = append(res, &HfPlaceOrderRes{OrderId: "o-" + o.ClientOid, ClientOid: o.ClientOid, Success: true})
+		}
+		return res
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+
+	var orders []*HFCreateMultiOrderModel
+	for i := 0; i < 12; i++ {
+		s := "KCS-USDT"
+		if i%2 == 1 && i < 10 {
+			s = "KCS-BTC"
+		}
+		orders = append(orders, &HFCreateMultiOrderModel{ClientOid: fmt.Sprintf("c%d", i), Symbol: s})
+	}
+	results, err := as.HfPlaceMultiOrdersBatch(context.Background(), orders, BatchOpts{RateLimit: -1})
+	if e, ok := err.(*BatchError); !ok || e.Failed != 1 || e.Total != 12 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, r := range results {
+		if i == 3 {
+			if e, ok := r.Err.(*BatchEntryError); !ok || e.ClientOid != "c3" || e.Message != "Balance insufficient" {
+				t.Errorf("Unexpected error of c3: %v", r.Err)
+			}
+			continue
+		}
+		if r.Err != nil || r.OrderId != "o-"+orders[i].ClientOid {
+			t.Errorf("Unexpected result %d: %s with error %v", i, ToJsonString(r), r.Err)
+		}
+	}
+	if fmt.Sprint(sizes["KCS-USDT"]) != "[5 2]" && fmt.Sprint(sizes["KCS-USDT"]) != "[2 5]" || fmt.Sprint(sizes["KCS-BTC"]) != "[5]" {
+		t.Errorf("Unexpected chunks: %v", sizes)
+	}
+}
+
+func TestApiService_CreateMultiOrderBatch(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/orders/multi", func(r *Request) interface{} {
+		p := struct {
+			Symbol    string              `json:"symbol"`
+			OrderList []*CreateOrderModel `json:"orderList"`
+		}{}
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		if p.Symbol == "KCS-BTC" {
+			return errors.New("i/o timeout")
+		}
+		res := []*multiOrderEntry{}
+		for _, o := range p.OrderList {
+			res = append(res, &multiOrderEntry{Id: "o-" + o.ClientOid, ClientOid: o.ClientOid, Status: "success"})
+		}
+		return map[string]interface{}{"data": res}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+
+	orders := []*CreateOrderModel{
+		{ClientOid: "c1", Symbol: "KCS-USDT"},
+		{ClientOid: "c2", Symbol: "KCS-BTC"},
+		{ClientOid: "c3", Symbol: "KCS-USDT"},
+	}
+	results, err := as.CreateMultiOrderBatch(context.Background(), orders, BatchOpts{ChunkSize: 1})
+	if e, ok := err.(*BatchError); !ok || e.Failed != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if results[0].OrderId != "o-c1" || results[2].OrderId != "o-c3" || results[1].Err == nil || results[1].OrderId != "" {
+		t.Errorf("Unexpected results: %s", ToJsonString(results))
+	}
+	if n := rr.count(http.MethodPost, "/api/v1/orders/multi"); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+
+	// The chunks not sent before ctx is done fail with its error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, _ = as.CreateMultiOrderBatch(ctx, orders, BatchOpts{})
+	for _, r := range results {
+		if r.Err != context.Canceled {
+			t.Errorf("Expected the error of ctx, got %v", r.Err)
+		}
+	}
+}
+
+func TestUnifiedOrderService_CancelOrdersBatch(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodDelete, "/api/v1/orders/o1", func(r *Request) interface{} {
+		return &CancelOrderResultModel{CancelledOrderIds: []string{"o1"}}
+	})
+	rr.handle(http.MethodDelete, "/api/v1/hf/orders/client-order/c2", func(r *Request) interface{} {
+		return &routeFailure{code: "400100", message: "order not exist."}
+	})
+	rr.handle(http.MethodDelete, "/api/v3/hf/margin/orders/o3?symbol=KCS-BTC", func(r *Request) interface{} {
+		return map[string]string{"orderId": "o3"}
+	})
+	s := NewApiService(ApiRequesterOption(rr)).NewUnifiedOrderService(UnifiedOrderOpts{})
+
+	results, err := s.CancelOrdersBatch(context.Background(), []*BatchCancelRequest{
+		{Account: AccountSpot, OrderId: "o1"},
+		{Account: AccountSpotHf, Symbol: "KCS-USDT", ClientOid: "c2"},
+		{Account: AccountIsolatedMargin, Symbol: "KCS-BTC", OrderId: "o3"},
+	}, BatchOpts{Concurrency: 1})
+	if e, ok := err.(*BatchError); !ok || e.Failed != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("Unexpected results: %v %v", results[0].Err, results[2].Err)
+	}
+	if e, ok := results[1].Err.(*BatchEntryError); !ok || e.ClientOid != "c2" || e.Message != "order not exist." {
+		t.Errorf("Unexpected error of c2: %v", results[1].Err)
+	}
+}
@@ -0,0 +1,400 @@
+package kucoin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// A BracketState is the state of a BracketOrder.
+type BracketState string
+
+// The states of a BracketOrder.
+const (
+	// BracketEntry waits for the entry order to be filled, the fills are protected by the exit order meanwhile.
+	BracketEntry BracketState = "entry"
+	// BracketProtected has the entry order done, and the filled size protected by the exit order.
+	BracketProtected BracketState = "protected"
+	// BracketClosed has the entry order done, and the filled size closed by the exit orders.
+	BracketClosed BracketState = "closed"
+	// BracketCancelled has the entry order done without a fill, or has been cancelled by Cancel().
+	BracketCancelled BracketState = "cancelled"
+	// BracketFailed failed to protect the filled size, see Err.
+	BracketFailed BracketState = "failed"
+)
+
+// All defaults of BracketOpts.
+const (
+	defaultBracketCheckInterval = 200 * time.Millisecond
+	defaultBracketCancelTimeout = 5 * time.Second
+)
+
+// A BracketOrderRequest is the input parameter of PlaceBracketOrder().
+type BracketOrderRequest struct {
+	// ClientOid is the client oid of the entry order, it is generated if it is empty.
+	ClientOid string `json:"clientOid"`
+	Symbol    string `json:"symbol"`
+	// Side is the side of the entry order, the exit order has the opposite one.
+	Side string `json:"side"`
+	// Type is the type of the entry order, limit or market.
+	Type   string `json:"type"`
+	Price  string `json:"price,omitempty"`
+	Size   string `json:"size"`
+	Remark string `json:"remark,omitempty"`
+
+	// TakeProfitPrice is the price of the limit order of the OCO exit.
+	TakeProfitPrice string `json:"takeProfitPrice"`
+	// StopPrice triggers the stop-loss order of the OCO exit.
+	StopPrice string `json:"stopPrice"`
+	// StopLimitPrice is the price of the stop-loss order once triggered.
+	StopLimitPrice string `json:"stopLimitPrice"`
+}
+
+// BracketOpts contains the options of a BracketOrder.
+type BracketOpts struct {
+	// Tracker tracks the entry order, it should receive the private orderChange events
+	// unless PollInterval is set. A new OrderTracker fed by Apply() by default.
+	Tracker *OrderTracker
+	// PollInterval is the interval of querying the entry order with Order(), it is not queried if it is 0.
+	PollInterval time.Duration
+	// CheckInterval is the interval of checking the fills of the entry order, 200ms by default.
+	CheckInterval time.Duration
+	// SizeIncrement rounds down the size of the exit order, e.g. the BaseIncrement of the symbol.
+	SizeIncrement string
+	// MinExitSize is the min size of the exit order and of its increments while the entry order is open,
+	// e.g. the BaseMinSize of the symbol.
+	MinExitSize string
+	// CancelTimeout bounds the cancellations on shutdown, 5s by default.
+	CancelTimeout time.Duration
+	// Generator generates the client oids, NewClientOidGenerator("") by default.
+	Generator ClientOidGenerator
+}
+
+// A BracketStatus is a snapshot of a BracketOrder.
+type BracketStatus struct {
+	State        BracketState `json:"state"`
+	EntryOid     string       `json:"entryOid"`
+	EntryOrderId string       `json:"entryOrderId"`
+	EntryState   OrderState   `json:"entryState"`
+	Filled       string       `json:"filled"`
+	ExitOrderId  string       `json:"exitOrderId,omitempty"`
+	ExitSize     string       `json:"exitSize"`
+	Exited       string       `json:"exited"`
+	Err          string       `json:"err,omitempty"`
+}
+
+// A BracketOrder is an entry order protected by an OCO take-profit and stop-loss exit order.
+// The exit order is sized to the filled size of the entry order: it is placed on the first fills,
+// and replaced as the entry order fills further, less the size executed by the exit orders meanwhile.
+type BracketOrder struct {
+	as   *ApiService
+	opts BracketOpts
+	req  BracketOrderRequest
+
+	mu       sync.Mutex
+	state    BracketState
+	exitId   string
+	exitSize string
+	exited   string
+	err      error
+}
+
+// PlaceBracketOrder places the entry order of a bracket order, and returns the BracketOrder protecting it.
+// Run() must be called to place the exit order.
+func (as *ApiService) PlaceBracketOrder(ctx context.Context, req BracketOrderRequest, opts BracketOpts) (*BracketOrder, error) {
+	if req.Symbol == "" || (req.Side != "buy" && req.Side != "sell") || decimalCmp(req.Size, "0") <= 0 {
+		return nil, errors.Errorf("Invalid bracket order of %s %s %s", req.Side, req.Size, req.Symbol)
+	}
+	if req.TakeProfitPrice == "" || req.StopPrice == "" || req.StopLimitPrice == "" {
+		return nil, errors.New("Invalid bracket order without the exit prices")
+	}
+	// The take-profit is above the stop for a long position, below it for a short one
+	if c := decimalCmp(req.TakeProfitPrice, req.StopPrice); req.Side == "buy" && c <= 0 || req.Side == "sell" && c >= 0 {
+		return nil, errors.Errorf("Invalid bracket order of take-profit %s and stop %s", req.TakeProfitPrice, req.StopPrice)
+	}
+	if req.Type == "" {
+		req.Type = "limit"
+	}
+	if opts.Tracker == nil {
+		opts.Tracker = as.NewOrderTracker()
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = defaultBracketCheckInterval
+	}
+	if opts.CancelTimeout <= 0 {
+		opts.CancelTimeout = defaultBracketCancelTimeout
+	}
+	if opts.Generator == nil {
+		g, err := NewClientOidGenerator("")
+		if err != nil {
+			return nil, err
+		}
+		opts.Generator = g
+	}
+	if req.ClientOid == "" {
+		req.ClientOid = opts.Generator.NewClientOid()
+	}
+
+	_, err := opts.Tracker.CreateOrder(ctx, &CreateOrderModel{
+		ClientOid: req.ClientOid,
+		Symbol:    req.Symbol,
+		Side:      req.Side,
+		Type:      req.Type,
+		Price:     req.Price,
+		Size:      req.Size,
+		Remark:    req.Remark,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BracketOrder{as: as, opts: opts, req: req, state: BracketEntry, exitSize: "0", exited: "0"}, nil
+}
+
+// Apply applies a private orderChange message to the entry order, other messages are ignored.
+func (b *BracketOrder) Apply(m *WebSocketDownstreamMessage) error {
+	return b.opts.Tracker.Apply(m)
+}
+
+// Status returns a snapshot of the bracket order.
+func (b *BracketOrder) Status() *BracketStatus {
+	o := b.opts.Tracker.Order(b.req.ClientOid)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &BracketStatus{
+		State:       b.state,
+		EntryOid:    b.req.ClientOid,
+		ExitOrderId: b.exitId,
+		ExitSize:    b.exitSize,
+		Exited:      b.exited,
+	}
+	if o != nil {
+		s.EntryOrderId, s.EntryState, s.Filled = o.OrderId, o.State, o.FilledSize
+	}
+	if b.err != nil {
+		s.Err = b.err.Error()
+	}
+	return s
+}
+
+// Run watches the entry order and keeps the exit order sized to its fills, until the entry order is done.
+// When ctx is done, the rest of the entry order is cancelled and the exit order is sized to the final fills,
+// so that the filled size stays protected; Run returns the error of ctx then.
+// A failure to place or replace the exit order moves the bracket order to BracketFailed with the error in
+// Status().Err, and is retried on the next check.
+func (b *BracketOrder) Run(ctx context.Context) error {
+	check := time.NewTicker(b.opts.CheckInterval)
+	defer check.Stop()
+	var poll <-chan time.Time
+	if b.opts.PollInterval > 0 {
+		t := time.NewTicker(b.opts.PollInterval)
+		defer t.Stop()
+		poll = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			sc, cancel := context.WithTimeout(context.Background(), b.opts.CancelTimeout)
+			defer cancel()
+			if err := b.shutdown(sc); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-poll:
+			if err := b.poll(ctx); err != nil && DebugMode {
+				logrus.Debugf("Query the entry order %s failed, %s", b.req.ClientOid, err.Error())
+			}
+		case <-check.C:
+		}
+		done, err := b.sync(ctx, false)
+		if err != nil && DebugMode {
+			logrus.Debugf("Protect the entry order %s failed, %s", b.req.ClientOid, err.Error())
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// poll queries the entry order.
+func (b *BracketOrder) poll(ctx context.Context) error {
+	rsp, err := b.as.OrderByClient(ctx, b.req.ClientOid)
+	if err != nil {
+		return err
+	}
+	o := &OrderModel{}
+	if err := rsp.ReadData(o); err != nil {
+		return err
+	}
+	b.opts.Tracker.ApplyOrder(o)
+	return nil
+}
+
+// sync sizes the exit order to the fills of the entry order, and reports whether the entry order is done.
+// Below MinExitSize, the fills are not protected until the entry order is done or final is set.
+func (b *BracketOrder) sync(ctx context.Context, final bool) (bool, error) {
+	o := b.opts.Tracker.Order(b.req.ClientOid)
+	if o == nil {
+		return false, errors.Errorf("Unknown entry order %s", b.req.ClientOid)
+	}
+	done := o.State.Terminal()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BracketEntry && b.state != BracketFailed {
+		return true, nil
+	}
+
+	size := decimalRound(decimalSub(o.FilledSize, b.exited), b.opts.SizeIncrement, -1)
+	if decimalCmp(size, b.exitSize) > 0 && decimalCmp(size, b.opts.MinExitSize) >= 0 &&
+		(done || final || decimalCmp(decimalSub(size, b.exitSize), b.opts.MinExitSize) >= 0) {
+		if err := b.replaceExit(ctx, o.FilledSize); err != nil {
+			b.state, b.err = BracketFailed, err
+			return false, err
+		}
+		b.state, b.err = BracketEntry, nil
+	}
+	if !done {
+		return false, nil
+	}
+	switch {
+	case decimalCmp(b.exitSize, "0") > 0:
+		b.state = BracketProtected
+	case decimalCmp(b.exited, "0") > 0:
+		b.state = BracketClosed
+	default:
+		b.state = BracketCancelled
+	}
+	return true, nil
+}
+
+// replaceExit deletes the exit order and places a new one protecting the filled size
+// less the size executed by the exit orders, the caller must hold the lock.
+func (b *BracketOrder) replaceExit(ctx context.Context, filled string) error {
+	if err := b.closeExit(ctx); err != nil {
+		return err
+	}
+	size := decimalRound(decimalSub(filled, b.exited), b.opts.SizeIncrement, -1)
+	if decimalCmp(size, "0") <= 0 || decimalCmp(size, b.opts.MinExitSize) < 0 {
+		return nil
+	}
+
+	side := "sell"
+	if b.req.Side == "sell" {
+		side = "buy"
+	}
+	rsp, err := b.as.CreateOcoOrder(ctx, &CreateOcoOrderModel{
+		Side:       side,
+		Symbol:     b.req.Symbol,
+		Price:      b.req.TakeProfitPrice,
+		Size:       size,
+		StopPrice:  b.req.StopPrice,
+		LimitPrice: b.req.StopLimitPrice,
+		TradeType:  "TRADE",
+		ClientOid:  b.opts.Generator.NewClientOid(),
+		Remark:     b.req.Remark,
+	})
+	r := &CreateOrderResultModel{}
+	if err == nil {
+		err = rsp.ReadData(r)
+	}
+	if err != nil {
+		return errors.Errorf("Place the exit order of %s failed, %s", size, err.Error())
+	}
+	b.exitId, b.exitSize = r.OrderId, size
+	return nil
+}
+
+// closeExit deletes the exit order and adds the size executed by its orders to the exited size,
+// an exit order already done is not an error. The caller must hold the lock.
+func (b *BracketOrder) closeExit(ctx context.Context) error {
+	if b.exitId == "" {
+		return nil
+	}
+	rsp, derr := b.as.DeleteOcoOrder(ctx, b.exitId)
+	if derr == nil {
+		derr = rsp.ReadData(nil)
+	}
+	done, executed, err := b.exitStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if derr != nil && !done {
+		return errors.Errorf("Delete the exit order %s failed, %s", b.exitId, derr.Error())
+	}
+	b.exited = decimalAdd(b.exited, executed)
+	b.exitId, b.exitSize = "", "0"
+	return nil
+}
+
+// exitStatus queries the exit order, and returns whether it is done and the size executed by its orders.
+func (b *BracketOrder) exitStatus(ctx context.Context) (bool, string, error) {
+	rsp, err := b.as.OcoOrderDetail(ctx, b.exitId)
+	d := &OrderDetailModel{}
+	if err == nil {
+		err = rsp.ReadData(d)
+	}
+	if err != nil {
+		return false, "", errors.Errorf("Query the exit order %s failed, %s", b.exitId, err.Error())
+	}
+	done, executed := d.Status != "NEW", "0"
+	for _, so := range d.Orders {
+		rsp, err := b.as.Order(ctx, so.Id)
+		o := &OrderModel{}
+		if err == nil {
+			err = rsp.ReadData(o)
+		}
+		if err != nil {
+			// The stop order does not exist until it is triggered
+			if unknownPlaceFailure(rsp, err) {
+				return false, "", errors.Errorf("Query the order %s of the exit order failed, %s", so.Id, err.Error())
+			}
+			continue
+		}
+		executed = decimalAdd(executed, o.DealSize)
+		if o.IsActive {
+			done = false
+		}
+	}
+	return done, executed, nil
+}
+
+// cancelEntry cancels the rest of the entry order if it is not done, and queries its final fills.
+func (b *BracketOrder) cancelEntry(ctx context.Context) error {
+	o := b.opts.Tracker.Order(b.req.ClientOid)
+	if o == nil || o.State.Terminal() {
+		return nil
+	}
+	rsp, err := b.as.CancelOrderByClient(ctx, b.req.ClientOid)
+	if err == nil {
+		err = rsp.ReadData(nil)
+	}
+	if err != nil {
+		return errors.Errorf("Cancel the entry order %s failed, %s", b.req.ClientOid, err.Error())
+	}
+	return b.poll(ctx)
+}
+
+// shutdown cancels the rest of the entry order and protects its final fills.
+func (b *BracketOrder) shutdown(ctx context.Context) error {
+	if err := b.cancelEntry(ctx); err != nil {
+		return err
+	}
+	_, err := b.sync(ctx, true)
+	return err
+}
+
+// Cancel cancels the rest of the entry order and deletes the exit order, the filled size is not protected any more.
+func (b *BracketOrder) Cancel(ctx context.Context) error {
+	if err := b.cancelEntry(ctx); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.closeExit(ctx); err != nil {
+		return err
+	}
+	b.state = BracketCancelled
+	return nil
+}
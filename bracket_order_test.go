@@ -0,0 +1,273 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBracketRoutes routes the entry order and the OCO exit orders, and records the sizes of the exit orders.
+func newTestBracketRoutes(rr *routeRequester, mu *sync.Mutex, exits *[]string) {
+	rr.handle(http.MethodPost, "/api/v1/orders", func(r *Request) interface{} {
+		return &CreateOrderResultModel{OrderId: "e1"}
+	})
+	rr.handle(http.MethodPost, "/api/v3/oco/order", func(r *Request) interface{} {
+		p := make(map[string]string)
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if p["side"] != "sell" || p["price"] != "12" || p["stopPrice"] != "9" || p["limitPrice"] != "8.9" {
+			return &routeFailure{code: "400100", message: "unexpected exit order"}
+		}
+		*exits = append(*exits, p["size"])
+		return &CreateOrderResultModel{OrderId: "x" + IntToString(int64(len(*exits)))}
+	})
+	for _, id := range []string{"x1", "x2", "x3"} {
+		rr.handle(http.MethodDelete, "/api/v3/oco/order/"+id, func(r *Request) interface{} {
+			return &CancelledOcoOrderResModel{}
+		})
+		rr.handle(http.MethodGet, "/api/v3/oco/order/details/"+id, func(r *Request) interface{} {
+			return &OrderDetailModel{Status: "CANCELLED"}
+		})
+	}
+}
+
+func TestBracketOrder_PartialFills(t *testing.T) {
+	rr := newRouteRequester()
+	var mu sync.Mutex
+	var exits []string
+	newTestBracketRoutes(rr, &mu, &exits)
+	as := NewApiService(ApiRequesterOption(rr))
+	b, err := as.PlaceBracketOrder(context.Background(), BracketOrderRequest{
+		ClientOid: "c1", Symbol: "KCS-USDT", Side: "buy", Price: "10", Size: "1",
+		TakeProfitPrice: "12", StopPrice: "9", StopLimitPrice: "8.9",
+	}, BracketOpts{CheckInterval: 10 * time.Millisecond, SizeIncrement: "0.1", MinExitSize: "0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.Run(context.Background()) }()
+	wait := func(n int) {
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			l := len(exits)
+			mu.Unlock()
+			if l >= n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d exit orders", n)
+	}
+	// The fills below MinExitSize are protected together with the next ones
+	for _, f := range []string{"0.15", "0.45"} {
+		if err := b.Apply(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "KCS-USDT", ClientOid: "c1", OrderId: "e1",
+			Type: "match", TradeId: "t" + f, MatchPrice: "10", MatchSize: "0.15", FilledSize: f, Status: "match"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait(1)
+	if s := b.Status(); s.State != BracketEntry || s.ExitOrderId != "x1" || s.ExitSize != "0.4" {
+		t.Errorf("Unexpected status: %s", ToJsonString(s))
+	}
+	if err := b.Apply(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "KCS-USDT", ClientOid: "c1", OrderId: "e1",
+		Type: "filled", TradeId: "t1", MatchPrice: "10", MatchSize: "0.55", FilledSize: "1", Status: "done"})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return")
+	}
+
+	if s := b.Status(); s.State != BracketProtected || s.ExitOrderId != "x2" || s.ExitSize != "1" || s.Filled != "1" {
+		t.Errorf("Unexpected status: %s", ToJsonString(s))
+	}
+	if strings.Join(exits, ",") != "0.4,1" || rr.count(http.MethodDelete, "/api/v3/oco/order/x1") != 1 {
+		t.Errorf("Unexpected exit orders: %v", exits)
+	}
+}
+
+func TestBracketOrder_RetryExit(t *testing.T) {
+	rr := newRouteRequester()
+	var mu sync.Mutex
+	var exits []string
+	newTestBracketRoutes(rr, &mu, &exits)
+	var failed bool
+	rr.handle(http.MethodPost, "/api/v3/oco/order", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		// The first exit order fails, it is placed again on the next check
+		if !failed {
+			failed = true
+			return &routeFailure{code: "500000", message: "Internal error"}
+		}
+		return &CreateOrderResultModel{OrderId: "x1"}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	b, err := as.PlaceBracketOrder(context.Background(), BracketOrderRequest{
+		ClientOid: "c1", Symbol: "KCS-USDT", Side: "buy", Price: "10", Size: "1",
+		TakeProfitPrice: "12", StopPrice: "9", StopLimitPrice: "8.9",
+	}, BracketOpts{CheckInterval: 10 * time.Millisecond, MinExitSize: "0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Apply(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "KCS-USDT", ClientOid: "c1", OrderId: "e1",
+		Type: "filled", TradeId: "t1", MatchPrice: "10", MatchSize: "1", FilledSize: "1", Status: "done"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Status(); s.State != BracketProtected || s.ExitOrderId != "x1" || s.Err != "" {
+		t.Errorf("Unexpected status: %s", ToJsonString(s))
+	}
+	if n := rr.count(http.MethodPost, "/api/v3/oco/order"); n != 2 {
+		t.Errorf("Expected the exit order placed twice, got %d", n)
+	}
+}
+
+func TestBracketOrder_Shutdown(t *testing.T) {
+	rr := newRouteRequester()
+	var mu sync.Mutex
+	var exits []string
+	newTestBracketRoutes(rr, &mu, &exits)
+	var cancelled bool
+	rr.handle(http.MethodGet, "/api/v1/order/client-order/c1", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		// The entry order is filled further before it is cancelled
+		if cancelled {
+			return &OrderModel{Id: "e1", ClientOid: "c1", Symbol: "KCS-USDT", Size: "1", DealSize: "0.3", CancelExist: true}
+		}
+		return &OrderModel{Id: "e1", ClientOid: "c1", Symbol: "KCS-USDT", Size: "1", DealSize: "0.1", IsActive: true}
+	})
+	rr.handle(http.MethodDelete, "/api/v1/order/client-order/c1", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		cancelled = true
+		return &CancelOrderByClientResultModel{CancelledOrderId: "e1", ClientOid: "c1"}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	b, err := as.PlaceBracketOrder(context.Background(), BracketOrderRequest{
+		ClientOid: "c1", Symbol: "KCS-USDT", Side: "buy", Price: "10", Size: "1",
+		TakeProfitPrice: "12", StopPrice: "9", StopLimitPrice: "8.9",
+	}, BracketOpts{PollInterval: 10 * time.Millisecond, CheckInterval: 10 * time.Millisecond, MinExitSize: "0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the error of ctx, got %v", err)
+	}
+	// The rest of the entry order is cancelled, and the final fills are protected
+	if s := b.Status(); s.State != BracketProtected || s.EntryState != OrderStateCancelled || s.ExitSize != "0.3" {
+		t.Errorf("Unexpected status: %s", ToJsonString(s))
+	}
+	if strings.Join(exits, ",") != "0.3" || rr.count(http.MethodDelete, "/api/v1/order/client-order/c1") != 1 {
+		t.Errorf("Unexpected exit orders: %v", exits)
+	}
+}
+
+func TestBracketOrder_ExitFills(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// The size executed by the take-profit order of x1, x1 is done and cannot be deleted if it is the whole exit
+		executed string
+		exits    string
+	}{
+		{"partial", "0.1", "0.4,0.9"},
+		{"done", "0.4", "0.4,0.6"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			rr := newRouteRequester()
+			var mu sync.Mutex
+			var exits []string
+			newTestBracketRoutes(rr, &mu, &exits)
+			done := c.executed == "0.4"
+			var deleted bool
+			if done {
+				rr.handle(http.MethodDelete, "/api/v3/oco/order/x1", func(r *Request) interface{} {
+					return &routeFailure{code: "400100", message: "the oco order is done"}
+				})
+			} else {
+				rr.handle(http.MethodDelete, "/api/v3/oco/order/x1", func(r *Request) interface{} {
+					mu.Lock()
+					defer mu.Unlock()
+					deleted = true
+					return &CancelledOcoOrderResModel{CancelledOrderIds: []string{"tp1", "sl1"}}
+				})
+			}
+			rr.handle(http.MethodGet, "/api/v3/oco/order/details/x1", func(r *Request) interface{} {
+				mu.Lock()
+				defer mu.Unlock()
+				d := &OrderDetailModel{OrderId: "x1", Symbol: "KCS-USDT", Status: "NEW",
+					Orders: []*OcoSubOrderModel{{Id: "tp1", Side: "sell", Size: "0.4"}, {Id: "sl1", Side: "sell", Size: "0.4"}}}
+				if done {
+					d.Status = "DONE"
+				} else if deleted {
+					d.Status = "CANCELLED"
+				}
+				return d
+			})
+			// The stop-loss order is not triggered, so it is not found
+			rr.handle(http.MethodGet, "/api/v1/orders/tp1", func(r *Request) interface{} {
+				mu.Lock()
+				defer mu.Unlock()
+				return &OrderModel{Id: "tp1", Symbol: "KCS-USDT", Side: "sell", Size: "0.4", DealSize: c.executed, IsActive: !done && !deleted}
+			})
+			as := NewApiService(ApiRequesterOption(rr))
+			b, err := as.PlaceBracketOrder(context.Background(), BracketOrderRequest{
+				ClientOid: "c1", Symbol: "KCS-USDT", Side: "buy", Price: "10", Size: "1",
+				TakeProfitPrice: "12", StopPrice: "9", StopLimitPrice: "8.9",
+			}, BracketOpts{SizeIncrement: "0.1", MinExitSize: "0.2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The exit order x1 is executed before the entry order fills further
+			for _, f := range []string{"0.4", "1"} {
+				typ, status := "match", "match"
+				if f == "1" {
+					typ, status = "filled", "done"
+				}
+				if err := b.Apply(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "KCS-USDT", ClientOid: "c1", OrderId: "e1",
+					Type: typ, TradeId: "t" + f, MatchPrice: "10", MatchSize: "0.4", FilledSize: f, Status: status})); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := b.sync(context.Background(), false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if s := b.Status(); s.State != BracketProtected || s.ExitOrderId != "x2" || s.Exited != c.executed {
+				t.Errorf("Unexpected status: %s", ToJsonString(s))
+			}
+			if strings.Join(exits, ",") != c.exits {
+				t.Errorf("Unexpected exit orders: %v", exits)
+			}
+		})
+	}
+}
+
+func TestApiService_PlaceBracketOrder(t *testing.T) {
+	as := NewApiService(ApiRequesterOption(newRouteRequester()))
+	// The take-profit of a long position must be above its stop
+	_, err := as.PlaceBracketOrder(context.Background(), BracketOrderRequest{
+		Symbol: "KCS-USDT", Side: "buy", Price: "10", Size: "1", TakeProfitPrice: "9", StopPrice: "12", StopLimitPrice: "11.9",
+	}, BracketOpts{})
+	if err == nil {
+		t.Error("Expected an error of the exit prices")
+	}
+}
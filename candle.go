@@ -0,0 +1,578 @@
+package kucoin
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The topics of the trade and candle messages consumed by a CandleBuilder.
+const (
+	MatchTopicPrefix  = "/market/match:"
+	CandleTopicPrefix = "/market/candles:"
+)
+
+// All candlestick types of KLines.
+var nativeCandleTypes = []struct {
+	typo string
+	d    time.Duration
+}{
+	{"1min", time.Minute},
+	{"3min", 3 * time.Minute},
+	{"5min", 5 * time.Minute},
+	{"15min", 15 * time.Minute},
+	{"30min", 30 * time.Minute},
+	{"1hour", time.Hour},
+	{"2hour", 2 * time.Hour},
+	{"4hour", 4 * time.Hour},
+	{"6hour", 6 * time.Hour},
+	{"8hour", 8 * time.Hour},
+	{"12hour", 12 * time.Hour},
+	{"1day", 24 * time.Hour},
+	{"1week", 7 * 24 * time.Hour},
+	{"1month", 0},
+}
+
+// The weeks of KLines start on Monday, the first one after the Unix epoch is 1970-01-05.
+const weekOffset = 4 * 24 * time.Hour
+
+// A CandleInterval represents the interval of candles, aligned to the same boundaries as KLines.
+type CandleInterval struct {
+	name  string
+	typo  string
+	d     time.Duration
+	month bool
+}
+
+// ParseCandleInterval parses the type of KLines, e.g. "1min" or "1week",
+// or any duration parsed by time.ParseDuration, e.g. "3s" or "10m".
+func ParseCandleInterval(s string) (CandleInterval, error) {
+	for _, t := range nativeCandleTypes {
+		if t.typo == s {
+			return CandleInterval{name: s, typo: s, d: t.d, month: t.d == 0}, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return CandleInterval{}, errors.Errorf("Invalid candle interval %s", s)
+	}
+	ci := CandleInterval{name: s, d: d}
+	for _, t := range nativeCandleTypes {
+		if t.d == d {
+			ci.typo = t.typo
+		}
+	}
+	return ci, nil
+}
+
+// String returns the interval as parsed.
+func (ci CandleInterval) String() string {
+	return ci.name
+}
+
+// Type returns the type of KLines with the same interval, or an empty string if there is none.
+func (ci CandleInterval) Type() string {
+	return ci.typo
+}
+
+// Start returns the start of the candle containing t.
+// The intervals are aligned to the Unix epoch in UTC, the weeks start on Monday and the months are calendar months.
+func (ci CandleInterval) Start(t time.Time) time.Time {
+	t = t.UTC()
+	if ci.month {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	var offset time.Duration
+	if ci.typo == "1week" {
+		offset = weekOffset
+	}
+	ns := t.UnixNano() - int64(offset)
+	r := ns % int64(ci.d)
+	if r < 0 {
+		r += int64(ci.d)
+	}
+	return time.Unix(0, ns-r+int64(offset)).UTC()
+}
+
+// End returns the end of the candle starting at start, i.e. the start of the next candle.
+func (ci CandleInterval) End(start time.Time) time.Time {
+	if ci.month {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.Add(ci.d)
+}
+
+// nests reports whether every candle of the sub interval lies in a single candle of the interval.
+func (ci CandleInterval) nests(sub CandleInterval) bool {
+	if sub.month {
+		return ci.month
+	}
+	if ci.month {
+		return 24*time.Hour%sub.d == 0 && sub.typo != "1week"
+	}
+	if sub.typo == "1week" {
+		return ci.typo == "1week"
+	}
+	if ci.typo == "1week" {
+		return 24*time.Hour%sub.d == 0
+	}
+	return ci.d%sub.d == 0
+}
+
+// A Candle represents an OHLCV bar.
+type Candle struct {
+	Symbol   string    `json:"symbol"`
+	Interval string    `json:"interval"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Open     string    `json:"open"`
+	Close    string    `json:"close"`
+	High     string    `json:"high"`
+	Low      string    `json:"low"`
+	Volume   string    `json:"volume"`
+	Turnover string    `json:"turnover"`
+	// Closed is true once the interval has ended, a closed candle is emitted again if a late trade changes it.
+	Closed bool `json:"closed"`
+}
+
+// merge adds the later candle c to the aggregate a.
+func (a *Candle) merge(c *Candle) {
+	if a.Open == "" {
+		a.Open, a.High, a.Low = c.Open, c.High, c.Low
+	}
+	a.Close = c.Close
+	if decimalCmp(c.High, a.High) > 0 {
+		a.High = c.High
+	}
+	if decimalCmp(c.Low, a.Low) < 0 {
+		a.Low = c.Low
+	}
+	a.Volume = decimalAdd(a.Volume, c.Volume)
+	a.Turnover = decimalAdd(a.Turnover, c.Turnover)
+}
+
+// A candleTrades aggregates the trades of a candle, in any arrival order.
+type candleTrades struct {
+	Candle
+	first, last time.Time
+}
+
+func (ct *candleTrades) add(price, size string, t time.Time) {
+	if ct.Open == "" || t.Before(ct.first) {
+		ct.Open, ct.first = price, t
+	}
+	if ct.Close == "" || !t.Before(ct.last) {
+		ct.Close, ct.last = price, t
+	}
+	if ct.High == "" || decimalCmp(price, ct.High) > 0 {
+		ct.High = price
+	}
+	if ct.Low == "" || decimalCmp(price, ct.Low) < 0 {
+		ct.Low = price
+	}
+	ct.Volume = decimalAdd(ct.Volume, size)
+	ct.Turnover = decimalAdd(ct.Turnover, decimalMul(price, size))
+}
+
+// A candleBar is a candle built from the candles of a smaller interval, followed by trades.
+type candleBar struct {
+	start, end time.Time
+	parts      map[int64]*Candle
+	trades     *candleTrades
+	closed     bool
+}
+
+func (b *candleBar) candle(symbol, interval string) *Candle {
+	c := &Candle{Symbol: symbol, Interval: interval, Start: b.start, End: b.end, Closed: b.closed}
+	keys := make([]int64, 0, len(b.parts))
+	for k := range b.parts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		c.merge(b.parts[k])
+	}
+	if b.trades != nil {
+		c.merge(&b.trades.Candle)
+	}
+	return c
+}
+
+// A candleSeries keeps the bars of an interval in ascending order.
+type candleSeries struct {
+	interval CandleInterval
+	bars     []*candleBar
+}
+
+// bar returns the bar containing t, creating it if it is missing.
+// It returns nil for t older than the history.
+func (cs *candleSeries) bar(t time.Time, history int) *candleBar {
+	start := cs.interval.Start(t)
+	i := sort.Search(len(cs.bars), func(i int) bool { return !cs.bars[i].start.Before(start) })
+	if i < len(cs.bars) && cs.bars[i].start.Equal(start) {
+		return cs.bars[i]
+	}
+	b := &candleBar{start: start, end: cs.interval.End(start), parts: make(map[int64]*Candle)}
+	cs.bars = append(cs.bars, nil)
+	copy(cs.bars[i+1:], cs.bars[i:])
+	cs.bars[i] = b
+	if over := len(cs.bars) - history - 1; over > 0 {
+		cs.bars = cs.bars[over:]
+		if i < over {
+			return nil
+		}
+	}
+	return b
+}
+
+// All defaults of CandleBuilderOpts.
+const defaultCandleHistory = 500
+
+// CandleBuilderOpts contains the options of a CandleBuilder.
+type CandleBuilderOpts struct {
+	// Symbol is the symbol of the candles, it is required. The messages of other symbols are ignored.
+	Symbol string
+	// Intervals are the intervals of the candles, see ParseCandleInterval.
+	Intervals []string
+	// History is the number of closed candles kept per interval, 500 by default.
+	// A late trade older than the history is dropped.
+	History int
+	// Clock is the server clock which closes the candles in Run, the local clock by default.
+	Clock *ServerClock
+}
+
+// A CandleBuilder builds the candles of arbitrary intervals from the trades of /market/match
+// or the candles of /market/candles, and emits the candles in progress and the closed ones.
+// The candles have the same boundaries as KLines, an interval without any trade has no candle.
+type CandleBuilder struct {
+	as      *ApiService
+	symbol  string
+	history int
+	clock   *ServerClock
+
+	mu     sync.Mutex
+	series []*candleSeries
+	// The trades before cutoff are included in the backfilled candles
+	cutoff time.Time
+	// fed is set by the first trade or candle added
+	fed bool
+}
+
+// NewCandleBuilder creates an instance of CandleBuilder.
+func (as *ApiService) NewCandleBuilder(opts CandleBuilderOpts) (*CandleBuilder, error) {
+	if opts.Symbol == "" {
+		return nil, errors.New("Invalid candle builder without a symbol")
+	}
+	if opts.History <= 0 {
+		opts.History = defaultCandleHistory
+	}
+	if opts.Clock == nil {
+		opts.Clock = &ServerClock{}
+	}
+	cb := &CandleBuilder{as: as, symbol: opts.Symbol, history: opts.History, clock: opts.Clock}
+	for _, s := range opts.Intervals {
+		ci, err := ParseCandleInterval(s)
+		if err != nil {
+			return nil, err
+		}
+		cb.series = append(cb.series, &candleSeries{interval: ci})
+	}
+	return cb, nil
+}
+
+// Backfill loads the candles since the time from KLines, using the largest type nested in every interval.
+// The intervals shorter than a minute are not backfilled. The trades before the backfill are ignored then.
+// It must be called before the first trade or candle is added, otherwise the trades would be counted twice:
+// the messages received meanwhile should be added once it returns.
+func (cb *CandleBuilder) Backfill(ctx context.Context, since time.Time) error {
+	now := cb.clock.Now()
+	cb.mu.Lock()
+	if cb.fed {
+		cb.mu.Unlock()
+		return errors.New("Backfill the candles after adding the trades")
+	}
+	cb.cutoff = now
+	cb.mu.Unlock()
+
+	// The series to backfill by the type of KLines
+	types := make(map[string][]*candleSeries)
+	for _, cs := range cb.series {
+		for i := len(nativeCandleTypes) - 1; i >= 0; i-- {
+			sub, _ := ParseCandleInterval(nativeCandleTypes[i].typo)
+			if cs.interval.nests(sub) {
+				types[sub.typo] = append(types[sub.typo], cs)
+				break
+			}
+		}
+	}
+
+	for typo, series := range types {
+		candles, err := cb.klines(ctx, typo, since, now)
+		if err != nil {
+			return err
+		}
+		cb.mu.Lock()
+		for _, c := range candles {
+			for _, cs := range series {
+				cb.addPart(cs, c, now)
+			}
+		}
+		cb.mu.Unlock()
+	}
+	return nil
+}
+
+// klines loads the candles of the type between the times in ascending order.
+func (cb *CandleBuilder) klines(ctx context.Context, typo string, since, until time.Time) ([]*Candle, error) {
+	ci, _ := ParseCandleInterval(typo)
+	var candles []*Candle
+	endAt := until.Unix()
+	for endAt >= since.Unix() {
+		rsp, err := cb.as.KLines(ctx, cb.symbol, typo, since.Unix(), endAt)
+		if err != nil {
+			return nil, err
+		}
+		ks := KLinesModel{}
+		if err := rsp.ReadData(&ks); err != nil {
+			return nil, err
+		}
+		if len(ks) == 0 {
+			break
+		}
+		// The k lines are returned in descending order
+		earliest := endAt
+		for _, k := range ks {
+			c, err := parseKLine(*k, ci)
+			if err != nil {
+				return nil, err
+			}
+			candles = append(candles, c)
+			if c.Start.Unix() < earliest {
+				earliest = c.Start.Unix()
+			}
+		}
+		if earliest >= endAt {
+			break
+		}
+		endAt = earliest - 1
+	}
+	sort.Slice(candles, func(i, j int) bool { return candles[i].Start.Before(candles[j].Start) })
+	return candles, nil
+}
+
+// parseKLine parses a k line of [time, open, close, high, low, volume, turnover].
+func parseKLine(k KLineModel, ci CandleInterval) (*Candle, error) {
+	if len(k) < 7 {
+		return nil, errors.Errorf("Invalid k line %v", k)
+	}
+	sec, err := strconv.ParseInt(k[0], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("Invalid k line %v", k)
+	}
+	start := time.Unix(sec, 0).UTC()
+	return &Candle{
+		Interval: ci.typo,
+		Start:    start,
+		End:      ci.End(start),
+		Open:     k[1],
+		Close:    k[2],
+		High:     k[3],
+		Low:      k[4],
+		Volume:   k[5],
+		Turnover: k[6],
+	}, nil
+}
+
+// addPart replaces the part of the series with the candle of a smaller interval, the caller must hold the lock.
+func (cb *CandleBuilder) addPart(cs *candleSeries, c *Candle, now time.Time) *Candle {
+	b := cs.bar(c.Start, cb.history)
+	if b == nil {
+		return nil
+	}
+	b.parts[c.Start.UnixNano()] = c
+	b.closed = !now.Before(b.end)
+	return b.candle(cb.symbol, cs.interval.name)
+}
+
+// Add consumes a message of /market/match or /market/candles, and returns the changed candles.
+// The messages of other symbols are ignored.
+func (cb *CandleBuilder) Add(m *WebSocketDownstreamMessage) ([]*Candle, error) {
+	switch {
+	case strings.HasPrefix(m.Topic, MatchTopicPrefix):
+		v := &struct {
+			Symbol string `json:"symbol"`
+			Price  string `json:"price"`
+			Size   string `json:"size"`
+			Time   string `json:"time"`
+		}{}
+		if err := m.ReadData(v); err != nil {
+			return nil, err
+		}
+		if !cb.owns(strings.TrimPrefix(m.Topic, MatchTopicPrefix), v.Symbol) {
+			return nil, nil
+		}
+		ns, err := strconv.ParseInt(v.Time, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("Invalid time of the trade %s", v.Time)
+		}
+		return cb.AddTrade(v.Price, v.Size, time.Unix(0, ns)), nil
+	case strings.HasPrefix(m.Topic, CandleTopicPrefix):
+		v := &struct {
+			Symbol  string     `json:"symbol"`
+			Candles KLineModel `json:"candles"`
+		}{}
+		if err := m.ReadData(v); err != nil {
+			return nil, err
+		}
+		i := strings.LastIndex(m.Topic, "_")
+		if i < len(CandleTopicPrefix) {
+			return nil, errors.Errorf("Invalid candle topic %s", m.Topic)
+		}
+		if !cb.owns(m.Topic[len(CandleTopicPrefix):i], v.Symbol) {
+			return nil, nil
+		}
+		ci, err := ParseCandleInterval(m.Topic[i+1:])
+		if err != nil || ci.typo == "" {
+			return nil, errors.Errorf("Invalid candle topic %s", m.Topic)
+		}
+		c, err := parseKLine(v.Candles, ci)
+		if err != nil {
+			return nil, err
+		}
+		return cb.AddCandle(c), nil
+	}
+	return nil, nil
+}
+
+// owns reports whether the symbols of the topic and of the data, if any, are the symbol of the builder.
+func (cb *CandleBuilder) owns(topicSymbol, dataSymbol string) bool {
+	return topicSymbol == cb.symbol && (dataSymbol == "" || dataSymbol == cb.symbol)
+}
+
+// AddTrade adds a trade at the time, and returns the changed candles.
+func (cb *CandleBuilder) AddTrade(price, size string, t time.Time) []*Candle {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.fed = true
+	if t.Before(cb.cutoff) {
+		return nil
+	}
+	var changed []*Candle
+	for _, cs := range cb.series {
+		b := cs.bar(t, cb.history)
+		if b == nil {
+			continue
+		}
+		if b.trades == nil {
+			b.trades = &candleTrades{}
+		}
+		b.trades.add(price, size, t)
+		changed = append(changed, b.candle(cb.symbol, cs.interval.name))
+	}
+	return changed
+}
+
+// AddCandle adds a candle of a type of KLines, and returns the changed candles of the intervals it nests in.
+func (cb *CandleBuilder) AddCandle(c *Candle) []*Candle {
+	ci, err := ParseCandleInterval(c.Interval)
+	if err != nil {
+		return nil
+	}
+	now := cb.clock.Now()
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.fed = true
+	var changed []*Candle
+	for _, cs := range cb.series {
+		if !cs.interval.nests(ci) {
+			continue
+		}
+		if u := cb.addPart(cs, c, now); u != nil {
+			changed = append(changed, u)
+		}
+	}
+	return changed
+}
+
+// Advance closes the candles ended at the time, and returns them.
+func (cb *CandleBuilder) Advance(now time.Time) []*Candle {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	var closed []*Candle
+	for _, cs := range cb.series {
+		for _, b := range cs.bars {
+			if !b.closed && !now.Before(b.end) {
+				b.closed = true
+				closed = append(closed, b.candle(cb.symbol, cs.interval.name))
+			}
+		}
+	}
+	return closed
+}
+
+// Candles returns the kept candles of the interval in ascending order, the last one may be in progress.
+func (cb *CandleBuilder) Candles(interval string) []*Candle {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for _, cs := range cb.series {
+		if cs.interval.name == interval {
+			candles := make([]*Candle, 0, len(cs.bars))
+			for _, b := range cs.bars {
+				candles = append(candles, b.candle(cb.symbol, interval))
+			}
+			return candles
+		}
+	}
+	return nil
+}
+
+// Run consumes the messages and emits the changed candles, and closes the candles on time by the clock.
+// The returned channel is closed once messages is closed or ctx is done.
+func (cb *CandleBuilder) Run(ctx context.Context, messages <-chan *WebSocketDownstreamMessage) <-chan *Candle {
+	out := make(chan *Candle)
+	tick := time.Second
+	for _, cs := range cb.series {
+		if !cs.interval.month && cs.interval.d < tick {
+			tick = cs.interval.d
+		}
+	}
+	go func() {
+		defer close(out)
+		t := time.NewTicker(tick)
+		defer t.Stop()
+		emit := func(candles []*Candle) bool {
+			for _, c := range candles {
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}
+		for {
+			var candles []*Candle
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+				// The malformed messages are skipped
+				candles, _ = cb.Add(m)
+			case <-t.C:
+				candles = cb.Advance(cb.clock.Now())
+			case <-ctx.Done():
+				return
+			}
+			if !emit(candles) {
+				return
+			}
+		}
+	}()
+	return out
+}
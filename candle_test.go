@@ -0,0 +1,184 @@
+package kucoin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCandleInterval_Start(t *testing.T) {
+	at := time.Date(2023, 11, 15, 10, 17, 42, 500, time.UTC)
+	for s, want := range map[string]time.Time{
+		"3s":     time.Date(2023, 11, 15, 10, 17, 42, 0, time.UTC),
+		"10m":    time.Date(2023, 11, 15, 10, 10, 0, 0, time.UTC),
+		"1min":   time.Date(2023, 11, 15, 10, 17, 0, 0, time.UTC),
+		"4hour":  time.Date(2023, 11, 15, 8, 0, 0, 0, time.UTC),
+		"1day":   time.Date(2023, 11, 15, 0, 0, 0, 0, time.UTC),
+		"1week":  time.Date(2023, 11, 13, 0, 0, 0, 0, time.UTC),
+		"1month": time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		ci, err := ParseCandleInterval(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ci.Start(at); !got.Equal(want) {
+			t.Errorf("Unexpected start of %s: %v", s, got)
+		}
+	}
+	if ci, _ := ParseCandleInterval("1m"); ci.Type() != "1min" {
+		t.Errorf("Unexpected type %s", ci.Type())
+	}
+	if _, err := ParseCandleInterval("1fortnight"); err == nil {
+		t.Error("Expected an invalid interval")
+	}
+}
+
+func TestCandleBuilder_Trades(t *testing.T) {
+	cb, err := NewApiService().NewCandleBuilder(CandleBuilderOpts{Symbol: "BTC-USDT", Intervals: []string{"3s", "1min"}, History: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, time.UTC)
+	trade := func(price, size string, offset time.Duration) *WebSocketDownstreamMessage {
+		m := newTestDownstreamMessage(MatchTopicPrefix+"BTC-USDT", "trade.l3match", 0)
+		m.RawData = []byte(fmt.Sprintf(`{"price":"%s","size":"%s","time":"%d"}`, price, size, base.Add(offset).UnixNano()))
+		return m
+	}
+
+	for _, m := range []*WebSocketDownstreamMessage{
+		trade("10", "1", 100*time.Millisecond),
+		trade("12", "1", time.Second),
+		trade("9", "2", 2*time.Second),
+		trade("11", "1", 4*time.Second),
+	} {
+		if _, err := cb.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closed := cb.Advance(base.Add(3 * time.Second))
+	if len(closed) != 1 || !closed[0].Closed || closed[0].Open != "10" || closed[0].Close != "9" || closed[0].High != "12" ||
+		closed[0].Low != "9" || closed[0].Volume != "4" || closed[0].Turnover != "40" {
+		t.Fatalf("Unexpected closed candles: %s", ToJsonString(closed))
+	}
+
+	// A late trade revises the closed candle
+	changed, _ := cb.Add(trade("8", "1", 0))
+	if len(changed) != 2 || !changed[0].Closed || changed[0].Open != "8" || changed[0].Low != "8" || changed[0].Close != "9" {
+		t.Fatalf("Unexpected changed candles: %s", ToJsonString(changed))
+	}
+	if m := changed[1]; m.Closed || m.Open != "8" || m.Close != "11" || m.Volume != "6" {
+		t.Errorf("Unexpected candle in progress: %s", ToJsonString(m))
+	}
+
+	// The history keeps 2 closed candles and the one in progress
+	cb.Add(trade("11", "1", 7*time.Second))
+	cb.Add(trade("11", "1", 10*time.Second))
+	if cs := cb.Candles("3s"); len(cs) != 3 || !cs[0].Start.Equal(base.Add(3*time.Second)) {
+		t.Errorf("Unexpected candles: %s", ToJsonString(cs))
+	}
+	if changed, _ := cb.Add(trade("1", "1", 0)); len(changed) != 1 || changed[0].Interval != "1min" {
+		t.Errorf("Expected the trade older than the history dropped: %s", ToJsonString(changed))
+	}
+}
+
+func TestCandleBuilder_Symbols(t *testing.T) {
+	cb, _ := NewApiService().NewCandleBuilder(CandleBuilderOpts{Symbol: "BTC-USDT", Intervals: []string{"1min"}})
+	at := time.Date(2023, 11, 15, 10, 0, 0, 0, time.UTC)
+	// The subscription of both symbols delivers the messages of both
+	for _, c := range []struct {
+		topic, data string
+	}{
+		{MatchTopicPrefix + "BTC-USDT", `{"symbol":"BTC-USDT","price":"10","size":"1","time":"%d"}`},
+		{MatchTopicPrefix + "ETH-USDT", `{"symbol":"ETH-USDT","price":"1","size":"5","time":"%d"}`},
+		{MatchTopicPrefix + "BTC-USDT", `{"symbol":"ETH-USDT","price":"1","size":"5","time":"%d"}`},
+		{CandleTopicPrefix + "ETH-USDT_1min", `{"symbol":"ETH-USDT","candles":["%d","1","1","1","1","5","5"]}`},
+	} {
+		m := newTestDownstreamMessage(c.topic, "trade.l3match", 0)
+		ts := at.UnixNano()
+		if strings.HasPrefix(c.topic, CandleTopicPrefix) {
+			ts = at.Unix()
+		}
+		m.RawData = []byte(fmt.Sprintf(c.data, ts))
+		if _, err := cb.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cs := cb.Candles("1min"); len(cs) != 1 || cs[0].Symbol != "BTC-USDT" || cs[0].Volume != "1" || cs[0].Low != "10" {
+		t.Errorf("Unexpected candles: %s", ToJsonString(cs))
+	}
+}
+
+func TestCandleBuilder_Candles(t *testing.T) {
+	cb, _ := NewApiService().NewCandleBuilder(CandleBuilderOpts{Symbol: "BTC-USDT", Intervals: []string{"5min", "30s"}})
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, time.UTC)
+	candle := func(offset time.Duration, open, close, high, low, volume string) *WebSocketDownstreamMessage {
+		m := newTestDownstreamMessage(CandleTopicPrefix+"BTC-USDT_1min", "trade.candles.update", 0)
+		m.RawData = []byte(ToJsonString(map[string]interface{}{
+			"candles": []string{strconv.FormatInt(base.Add(offset).Unix(), 10), open, close, high, low, volume, volume},
+		}))
+		return m
+	}
+	cb.Add(candle(0, "10", "11", "12", "9", "1"))
+	cb.Add(candle(time.Minute, "11", "12", "12", "11", "1"))
+	// The update replaces the candle of the same minute
+	changed, err := cb.Add(candle(time.Minute, "11", "13", "14", "8", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 {
+		t.Fatalf("Expected the 30s interval skipped: %s", ToJsonString(changed))
+	}
+	if c := changed[0]; c.Open != "10" || c.Close != "13" || c.High != "14" || c.Low != "8" || c.Volume != "3" {
+		t.Errorf("Unexpected candle: %s", ToJsonString(c))
+	}
+}
+
+func TestCandleBuilder_Backfill(t *testing.T) {
+	rr := newRouteRequester()
+	base := time.Date(2023, 11, 15, 10, 0, 0, 0, time.UTC)
+	rr.handle(http.MethodGet, "/api/v1/market/candles", func(r *Request) interface{} {
+		ci, _ := ParseCandleInterval(r.Query.Get("type"))
+		startAt, _ := strconv.ParseInt(r.Query.Get("startAt"), 10, 64)
+		endAt, _ := strconv.ParseInt(r.Query.Get("endAt"), 10, 64)
+		// 3 k lines per page in descending order
+		var ks KLinesModel
+		for s := ci.Start(time.Unix(endAt, 0)); len(ks) < 3 && s.Unix() >= startAt; s = s.Add(-ci.d) {
+			p := strconv.Itoa(s.UTC().Minute())
+			ks = append(ks, &KLineModel{strconv.FormatInt(s.Unix(), 10), p, p, p, p, "1", p})
+		}
+		return ks
+	})
+
+	// The server time is 10:19:30
+	clock := &ServerClock{}
+	clock.SetOffset(time.Until(base.Add(19*time.Minute + 30*time.Second)))
+	cb, _ := NewApiService(ApiRequesterOption(rr)).NewCandleBuilder(CandleBuilderOpts{Symbol: "BTC-USDT", Intervals: []string{"10m", "3s"}, Clock: clock})
+	if err := cb.Backfill(context.Background(), base); err != nil {
+		t.Fatal(err)
+	}
+	if r := rr.count(http.MethodGet, "/api/v1/market/candles"); r < 2 {
+		t.Errorf("Expected the k lines paginated, got %d requests", r)
+	}
+	var got []string
+	for _, c := range cb.Candles("10m") {
+		got = append(got, c.Start.Format("15:04")+":"+c.Open+":"+c.Close+":"+c.Volume+":"+strconv.FormatBool(c.Closed))
+	}
+	if s := strings.Join(got, ","); s != "10:00:0:5:2:true,10:10:10:15:2:false" {
+		t.Errorf("Unexpected candles %s", s)
+	}
+	if cs := cb.Candles("3s"); len(cs) != 0 {
+		t.Errorf("Expected 3s not backfilled: %d", len(cs))
+	}
+	// The trades before the backfill are included already
+	if changed := cb.AddTrade("1", "1", base.Add(time.Minute)); len(changed) != 0 {
+		t.Errorf("Unexpected changed candles: %s", ToJsonString(changed))
+	}
+	// The trades added already would be counted twice
+	if err := cb.Backfill(context.Background(), base); err == nil {
+		t.Error("Expected an error of the backfill after the trades")
+	}
+}
@@ -0,0 +1,246 @@
+package kucoin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxClientOidLength is the max length of a client oid accepted by KuCoin.
+const MaxClientOidLength = 40
+
+// MaxClientOidPrefixLength is the max length of the prefix of a PrefixClientOidGenerator.
+const MaxClientOidPrefixLength = 16
+
+// clientOidPrefixPattern matches the valid prefixes, a client oid consists of letters, digits, '_' and '-'.
+var clientOidPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// A ClientOidGenerator generates the client oids of the orders.
+type ClientOidGenerator interface {
+	NewClientOid() string
+}
+
+// A ClientOidFunc is a function implementing ClientOidGenerator.
+type ClientOidFunc func() string
+
+// NewClientOid calls f.
+func (f ClientOidFunc) NewClientOid() string {
+	return f()
+}
+
+// lastClientOidSequence is the sequence shared by the generators of the process.
+var lastClientOidSequence uint64
+
+// A PrefixClientOidGenerator generates the client oids tagged by a prefix, e.g. the name of a strategy.
+// A client oid is the prefix, the start time of the generator, a random instance id and a sequence,
+// which keeps it unique in the process and across restarts.
+type PrefixClientOidGenerator struct {
+	prefix string
+}
+
+// NewClientOidGenerator creates an instance of PrefixClientOidGenerator.
+// The prefix has at most 16 letters, digits or '_'.
+func NewClientOidGenerator(prefix string) (*PrefixClientOidGenerator, error) {
+	if len(prefix) > MaxClientOidPrefixLength || !clientOidPrefixPattern.MatchString(prefix) {
+		return nil, errors.Errorf("Invalid clientOid prefix %s", prefix)
+	}
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	g := &PrefixClientOidGenerator{}
+	if prefix != "" {
+		g.prefix = prefix + "-"
+	}
+	g.prefix += strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36) + hex.EncodeToString(b)
+	return g, nil
+}
+
+// NewClientOid returns a new client oid.
+func (g *PrefixClientOidGenerator) NewClientOid() string {
+	return g.prefix + strconv.FormatUint(atomic.AddUint64(&lastClientOidSequence, 1), 36)
+}
+
+// All defaults of IdempotentPlaceOpts.
+const (
+	defaultIdempotentAttempts     = 3
+	defaultIdempotentResolveDelay = 500 * time.Millisecond
+)
+
+// IdempotentPlaceOpts contains the options of the idempotent placement.
+type IdempotentPlaceOpts struct {
+	// Generator generates the client oid of an order without one, a PrefixClientOidGenerator without a prefix by default.
+	Generator ClientOidGenerator
+	// Attempts is the max number of the placing requests, 3 by default.
+	Attempts int
+	// Timeout bounds every placing request, the deadline of ctx only by default.
+	Timeout time.Duration
+	// ResolveDelay is the delay before resolving the status of an order after an unknown failure, 500ms by default.
+	ResolveDelay time.Duration
+}
+
+// An IdempotentPlaceResult represents the result of an idempotent placement.
+type IdempotentPlaceResult struct {
+	ClientOid string `json:"clientOid"`
+	OrderId   string `json:"orderId"`
+	// Sent is the number of the placing requests sent.
+	Sent int `json:"sent"`
+	// Resolved reports whether the order was found by its client oid after an unknown failure.
+	Resolved bool `json:"resolved"`
+}
+
+// unknownPlaceFailure reports whether the order may have been placed despite the failure,
+// i.e. the request failed without a reply, the reply is not parsed or the server failed.
+func unknownPlaceFailure(rsp *ApiResponse, err error) bool {
+	if _, ok := err.(*OrderValidationError); ok {
+		return false
+	}
+	if rsp == nil || rsp.response == nil {
+		return err != nil
+	}
+	if rsp.HttpSuccessful() {
+		return rsp.Code == ""
+	}
+	return rsp.response.StatusCode >= http.StatusInternalServerError
+}
+
+// CreateOrderIdempotent places an order, a client oid is generated if it is empty.
+// On a timeout or an unknown failure, the order is queried by its client oid before being sent again,
+// so that it is never placed twice.
+func (as *ApiService) CreateOrderIdempotent(ctx context.Context, o *CreateOrderModel, opts IdempotentPlaceOpts) (*IdempotentPlaceResult, error) {
+	oid, err := idempotentClientOid(o.ClientOid, opts)
+	if err != nil {
+		return nil, err
+	}
+	o.ClientOid = oid
+	return as.placeIdempotent(ctx, oid, opts,
+		func(ctx context.Context) (*ApiResponse, string, error) {
+			rsp, err := as.CreateOrder(ctx, o)
+			if err != nil {
+				return rsp, "", err
+			}
+			r := &CreateOrderResultModel{}
+			err = rsp.ReadData(r)
+			return rsp, r.OrderId, err
+		},
+		func(ctx context.Context) (*ApiResponse, string, error) {
+			rsp, err := as.OrderByClient(ctx, oid)
+			if err != nil {
+				return rsp, "", err
+			}
+			r := &OrderModel{}
+			err = rsp.ReadData(r)
+			return rsp, r.Id, err
+		},
+	)
+}
+
+// HfPlaceOrderIdempotent places a HF order, a clientOid parameter is generated if it is empty.
+// On a timeout or an unknown failure, the order is queried by its client oid before being sent again,
+// so that it is never placed twice.
+func (as *ApiService) HfPlaceOrderIdempotent(ctx context.Context, params map[string]string, opts IdempotentPlaceOpts) (*IdempotentPlaceResult, error) {
+	oid, err := idempotentClientOid(params["clientOid"], opts)
+	if err != nil {
+		return nil, err
+	}
+	params["clientOid"] = oid
+	return as.placeIdempotent(ctx, oid, opts,
+		func(ctx context.Context) (*ApiResponse, string, error) {
+			rsp, err := as.HfPlaceOrder(ctx, params)
+			if err != nil {
+				return rsp, "", err
+			}
+			r := &HfPlaceOrderRes{}
+			err = rsp.ReadData(r)
+			return rsp, r.OrderId, err
+		},
+		func(ctx context.Context) (*ApiResponse, string, error) {
+			rsp, err := as.HfOrderDetailByClientOid(ctx, oid, params["symbol"])
+			if err != nil {
+				return rsp, "", err
+			}
+			r := &HfOrderModel{}
+			err = rsp.ReadData(r)
+			return rsp, r.Id, err
+		},
+	)
+}
+
+// idempotentClientOid returns the client oid, or a new one if it is empty.
+func idempotentClientOid(oid string, opts IdempotentPlaceOpts) (string, error) {
+	if oid != "" {
+		return oid, nil
+	}
+	g := opts.Generator
+	if g == nil {
+		pg, err := NewClientOidGenerator("")
+		if err != nil {
+			return "", err
+		}
+		g = pg
+	}
+	oid = g.NewClientOid()
+	if oid == "" || len(oid) > MaxClientOidLength {
+		return "", errors.Errorf("Invalid generated clientOid %s", oid)
+	}
+	return oid, nil
+}
+
+// placeIdempotent sends the order with place until it is placed or rejected.
+// After an unknown failure, resolve queries the order by the client oid:
+// the order is sent again only if the query replies that it does not exist.
+func (as *ApiService) placeIdempotent(ctx context.Context, clientOid string, opts IdempotentPlaceOpts,
+	place, resolve func(ctx context.Context) (*ApiResponse, string, error)) (*IdempotentPlaceResult, error) {
+	if opts.Attempts <= 0 {
+		opts.Attempts = defaultIdempotentAttempts
+	}
+	if opts.ResolveDelay <= 0 {
+		opts.ResolveDelay = defaultIdempotentResolveDelay
+	}
+
+	r := &IdempotentPlaceResult{ClientOid: clientOid}
+	var err error
+	for r.Sent < opts.Attempts {
+		r.Sent++
+		pctx := ctx
+		var cancel context.CancelFunc
+		if opts.Timeout > 0 {
+			pctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		var rsp *ApiResponse
+		rsp, r.OrderId, err = place(pctx)
+		if cancel != nil {
+			cancel()
+		}
+		if err == nil {
+			return r, nil
+		}
+		if !unknownPlaceFailure(rsp, err) {
+			return r, err
+		}
+
+		select {
+		case <-time.After(opts.ResolveDelay):
+		case <-ctx.Done():
+			return r, errors.Errorf("Resolve order %s failed, %s, the order may have been placed after %s", clientOid, ctx.Err(), err)
+		}
+		rsp, orderId, rerr := resolve(ctx)
+		if rerr == nil && orderId != "" {
+			r.OrderId = orderId
+			r.Resolved = true
+			return r, nil
+		}
+		// The order does not exist only if the API replies so
+		if rerr != nil && unknownPlaceFailure(rsp, rerr) {
+			return r, errors.Errorf("Resolve order %s failed, %s, the order may have been placed after %s", clientOid, rerr, err)
+		}
+	}
+	return r, errors.Errorf("Place order %s failed after %d attempts, %s", clientOid, r.Sent, err)
+}
@@ -0,0 +1,123 @@
+package kucoin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestPrefixClientOidGenerator(t *testing.T) {
+	if _, err := NewClientOidGenerator("grid-1"); err == nil {
+		t.Error("Expected an error of the invalid prefix")
+	}
+	if _, err := NewClientOidGenerator(strings.Repeat("a", MaxClientOidPrefixLength+1)); err == nil {
+		t.Error("Expected an error of the long prefix")
+	}
+
+	g1, err := NewClientOidGenerator(strings.Repeat("a", MaxClientOidPrefixLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g2, err := NewClientOidGenerator(strings.Repeat("a", MaxClientOidPrefixLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, g := range []ClientOidGenerator{g1, g2, g1, g2} {
+		wg.Add(1)
+		go func(g ClientOidGenerator) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				oid := g.NewClientOid()
+				mu.Lock()
+				if seen[oid] || len(oid) > MaxClientOidLength || !strings.HasPrefix(oid, "aaaaaaaaaaaaaaaa-") {
+					t.Errorf("Invalid clientOid %s", oid)
+				}
+				seen[oid] = true
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestApiService_HfPlaceOrderIdempotent(t *testing.T) {
+	rr := newRouteRequester()
+	placed := false
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		if !placed {
+			placed = true
+			return errors.New("i/o timeout")
+		}
+		return &HfPlaceOrderRes{OrderId: "o1", Success: true}
+	})
+	resolve := "/api/v1/hf/orders/client-order/s1-1"
+	rr.handle(http.MethodGet, resolve, func(r *Request) interface{} {
+		return &routeFailure{code: "400100", message: "order not exist."}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	opts := IdempotentPlaceOpts{Generator: ClientOidFunc(func() string { return "s1-1" }), ResolveDelay: time.Millisecond}
+
+	// The order does not exist after the timeout, it is sent again
+	p := map[string]string{"symbol": "KCS-USDT", "side": "buy", "size": "1"}
+	r, err := as.HfPlaceOrderIdempotent(context.Background(), p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ClientOid != "s1-1" || r.OrderId != "o1" || r.Sent != 2 || r.Resolved || p["clientOid"] != "s1-1" {
+		t.Errorf("Unexpected result: %s", ToJsonString(r))
+	}
+	if rr.count(http.MethodGet, resolve) != 1 {
+		t.Errorf("Expected 1 resolving request, got %d", rr.count(http.MethodGet, resolve))
+	}
+
+	// The status of the order stays unknown, it is not sent again
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		return errors.New("i/o timeout")
+	})
+	rr.handle(http.MethodGet, resolve, func(r *Request) interface{} {
+		return errors.New("connection reset")
+	})
+	r, err = as.HfPlaceOrderIdempotent(context.Background(), map[string]string{"clientOid": "s1-1", "symbol": "KCS-USDT"}, opts)
+	if err == nil || !strings.Contains(err.Error(), "may have been placed") || r.Sent != 1 {
+		t.Errorf("Unexpected result %s with error %v", ToJsonString(r), err)
+	}
+}
+
+func TestApiService_CreateOrderIdempotent(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/orders", func(r *Request) interface{} {
+		return errors.New("i/o timeout")
+	})
+	rr.handle(http.MethodGet, "/api/v1/order/client-order/c1", func(r *Request) interface{} {
+		return &OrderModel{Id: "o1", ClientOid: "c1"}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	opts := IdempotentPlaceOpts{ResolveDelay: time.Millisecond}
+
+	// The order has been placed despite the timeout
+	r, err := as.CreateOrderIdempotent(context.Background(), &CreateOrderModel{ClientOid: "c1", Symbol: "KCS-USDT"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OrderId != "o1" || r.Sent != 1 || !r.Resolved {
+		t.Errorf("Unexpected result: %s", ToJsonString(r))
+	}
+
+	// A rejected order is neither resolved nor sent again
+	rr.handle(http.MethodPost, "/api/v1/orders", func(r *Request) interface{} {
+		return &routeFailure{code: "200004", message: "Balance insufficient"}
+	})
+	o := &CreateOrderModel{Symbol: "KCS-USDT"}
+	r, err = as.CreateOrderIdempotent(context.Background(), o, opts)
+	if err == nil || r.Sent != 1 || o.ClientOid == "" || rr.count(http.MethodGet, "/api/v1/order/client-order/"+o.ClientOid) != 0 {
+		t.Errorf("Unexpected result %s with error %v", ToJsonString(r), err)
+	}
+}
@@ -95,27 +95,29 @@ func (as *ApiService) Prices(ctx context.Context, base, currencies string) (*Api
 type CurrenciesV3Model []*CurrencyV3Model
 
 type CurrencyV3Model struct {
-	Currency        string `json:"currency"`
-	Name            string `json:"name"`
-	FullName        string `json:"fullName"`
-	Precision       int32  `json:"precision"`
-	Confirms        int32  `json:"confirms"`
-	ContractAddress string `json:"contractAddress"`
-	IsMarginEnabled bool   `json:"isMarginEnabled"`
-	IsDebitEnabled  bool   `json:"isDebitEnabled"`
-	Chains          []struct {
-		ChainName         string      `json:"chainName"`
-		WithdrawalMinFee  json.Number `json:"withdrawalMinFee"`
-		WithdrawalMinSize json.Number `json:"withdrawalMinSize"`
-		WithdrawFeeRate   json.Number `json:"withdrawFeeRate"`
-		DepositMinSize    json.Number `json:"depositMinSize"`
-		IsWithdrawEnabled bool        `json:"isWithdrawEnabled"`
-		IsDepositEnabled  bool        `json:"isDepositEnabled"`
-		PreConfirms       int32       `json:"preConfirms"`
-		ContractAddress   string      `json:"contractAddress"`
-		ChainId           string      `json:"chainId"`
-		Confirms          int32       `json:"confirms"`
-	} `json:"chains"`
+	Currency        string                 `json:"currency"`
+	Name            string                 `json:"name"`
+	FullName        string                 `json:"fullName"`
+	Precision       int32                  `json:"precision"`
+	Confirms        int32                  `json:"confirms"`
+	ContractAddress string                 `json:"contractAddress"`
+	IsMarginEnabled bool                   `json:"isMarginEnabled"`
+	IsDebitEnabled  bool                   `json:"isDebitEnabled"`
+	Chains          []CurrencyChainV3Model `json:"chains"`
+}
+
+type CurrencyChainV3Model struct {
+	ChainName         string      `json:"chainName"`
+	WithdrawalMinFee  json.Number `json:"withdrawalMinFee"`
+	WithdrawalMinSize json.Number `json:"withdrawalMinSize"`
+	WithdrawFeeRate   json.Number `json:"withdrawFeeRate"`
+	DepositMinSize    json.Number `json:"depositMinSize"`
+	IsWithdrawEnabled bool        `json:"isWithdrawEnabled"`
+	IsDepositEnabled  bool        `json:"isDepositEnabled"`
+	PreConfirms       int32       `json:"preConfirms"`
+	ContractAddress   string      `json:"contractAddress"`
+	ChainId           string      `json:"chainId"`
+	Confirms          int32       `json:"confirms"`
 }
 
 func (as *ApiService) CurrenciesV3(ctx context.Context) (*ApiResponse, error) {
@@ -0,0 +1,226 @@
+package kucoin
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The bounds of the timeout of HfAutoCancelSetting().
+const (
+	MinDeadManSwitchTimeout = 5 * time.Second
+	MaxDeadManSwitchTimeout = 86400 * time.Second
+)
+
+// All defaults of DeadManSwitchOpts.
+const (
+	defaultDeadManSwitchTimeout    = time.Minute
+	defaultDeadManSwitchRetryDelay = time.Second
+	defaultDeadManSwitchDisarm     = 5 * time.Second
+)
+
+// DeadManSwitchOpts contains the options of a DeadManSwitch.
+type DeadManSwitchOpts struct {
+	// Symbols are the symbols whose HF orders are cancelled on expiry, all symbols if empty.
+	Symbols []string
+	// Timeout is the time the orders are cancelled after the last refresh, 1m by default,
+	// and rounded down to seconds between MinDeadManSwitchTimeout and MaxDeadManSwitchTimeout.
+	Timeout time.Duration
+	// RefreshInterval is the interval of the refreshes, a third of Timeout by default.
+	RefreshInterval time.Duration
+	// RetryDelay is the delay before retrying a failed refresh, 1s by default.
+	RetryDelay time.Duration
+	// DisarmTimeout bounds the disarming on shutdown, 5s by default.
+	DisarmTimeout time.Duration
+}
+
+// A DeadManSwitch keeps HfAutoCancelSetting armed while the process is alive,
+// so that the server cancels the HF orders of the symbols if the process crashes or hangs.
+type DeadManSwitch struct {
+	as      *ApiService
+	opts    DeadManSwitchOpts
+	symbols string
+	errors  chan error
+
+	mu      sync.Mutex
+	armed   bool
+	expires time.Time
+}
+
+// NewDeadManSwitch creates an instance of DeadManSwitch, which is not armed until Arm() or Run() is called.
+func (as *ApiService) NewDeadManSwitch(opts DeadManSwitchOpts) (*DeadManSwitch, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultDeadManSwitchTimeout
+	}
+	opts.Timeout = opts.Timeout.Truncate(time.Second)
+	if opts.Timeout < MinDeadManSwitchTimeout || opts.Timeout > MaxDeadManSwitchTimeout {
+		return nil, errors.Errorf("Invalid dead man switch timeout %s", opts.Timeout)
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = opts.Timeout / 3
+	}
+	if opts.RefreshInterval >= opts.Timeout {
+		return nil, errors.Errorf("The refresh interval %s of the dead man switch is not shorter than its timeout %s", opts.RefreshInterval, opts.Timeout)
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultDeadManSwitchRetryDelay
+	}
+	if opts.DisarmTimeout <= 0 {
+		opts.DisarmTimeout = defaultDeadManSwitchDisarm
+	}
+	return &DeadManSwitch{
+		as:      as,
+		opts:    opts,
+		symbols: strings.Join(opts.Symbols, ","),
+		errors:  make(chan error, 16),
+	}, nil
+}
+
+// Errors returns the channel of the failures of the refreshes, they are dropped if it is full.
+func (d *DeadManSwitch) Errors() <-chan error {
+	return d.errors
+}
+
+// Armed reports whether the switch is armed.
+func (d *DeadManSwitch) Armed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.armed
+}
+
+// Expires returns the time the orders are cancelled at without a refresh, by the local clock.
+func (d *DeadManSwitch) Expires() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expires
+}
+
+// Arm arms the switch, and verifies the setting with HfQueryAutoCancelSetting().
+func (d *DeadManSwitch) Arm(ctx context.Context) error {
+	if err := d.refresh(ctx); err != nil {
+		return err
+	}
+	rsp, err := d.as.HfQueryAutoCancelSetting(ctx)
+	if err != nil {
+		return err
+	}
+	v := &AUtoCancelSettingModel{}
+	if err := rsp.ReadData(v); err != nil {
+		return err
+	}
+	if v.Timeout != int64(d.opts.Timeout/time.Second) || !sameSymbols(v.Symbols, d.symbols) {
+		return errors.Errorf("Verify dead man switch failed, expected timeout %d of [%s], got %d of [%s]",
+			int64(d.opts.Timeout/time.Second), d.symbols, v.Timeout, v.Symbols)
+	}
+	return nil
+}
+
+// refresh sets the timeout again.
+func (d *DeadManSwitch) refresh(ctx context.Context) error {
+	start := time.Now()
+	rsp, err := d.as.HfAutoCancelSetting(ctx, int64(d.opts.Timeout/time.Second), d.symbols)
+	if err != nil {
+		return err
+	}
+	v := &HfAutoCancelSettingRes{}
+	if err := rsp.ReadData(v); err != nil {
+		return err
+	}
+	current, _ := v.CurrentTime.Int64()
+	trigger, _ := v.TriggerTime.Int64()
+	if trigger <= current {
+		return errors.Errorf("Refresh dead man switch failed, trigger time %d is not after %d", trigger, current)
+	}
+	d.mu.Lock()
+	d.armed = true
+	d.expires = start.Add(d.opts.Timeout)
+	d.mu.Unlock()
+	return nil
+}
+
+// Disarm cancels the setting, the orders are not cancelled any more.
+func (d *DeadManSwitch) Disarm(ctx context.Context) error {
+	rsp, err := d.as.HfAutoCancelSetting(ctx, -1, d.symbols)
+	if err != nil {
+		return err
+	}
+	if err := rsp.ReadData(nil); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.armed = false
+	d.expires = time.Time{}
+	d.mu.Unlock()
+	return nil
+}
+
+// Run arms the switch and refreshes it every RefreshInterval until ctx is done, then disarms it.
+// A failed refresh is sent to Errors() and retried after RetryDelay.
+// Run returns the error of arming or disarming, or an error if the switch expired
+// because the refreshes kept failing, in which case the orders have been cancelled by the server.
+// A switch set but failing the verification is disarmed before Run returns.
+func (d *DeadManSwitch) Run(ctx context.Context) error {
+	if err := d.Arm(ctx); err != nil {
+		if !d.Armed() {
+			return err
+		}
+		dc, cancel := context.WithTimeout(context.Background(), d.opts.DisarmTimeout)
+		defer cancel()
+		if derr := d.Disarm(dc); derr != nil {
+			return errors.Errorf("%s, and disarm dead man switch failed, %s", err.Error(), derr.Error())
+		}
+		return err
+	}
+	t := time.NewTimer(d.opts.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := d.refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					continue
+				}
+				if DebugMode {
+					logrus.Debugf("Refresh dead man switch failed, %s", err.Error())
+				}
+				select {
+				case d.errors <- err:
+				default:
+				}
+				if !time.Now().Before(d.Expires()) {
+					d.mu.Lock()
+					d.armed = false
+					d.mu.Unlock()
+					return errors.Errorf("Dead man switch expired, %s", err.Error())
+				}
+				t.Reset(d.opts.RetryDelay)
+				continue
+			}
+			t.Reset(d.opts.RefreshInterval)
+		case <-ctx.Done():
+			dc, cancel := context.WithTimeout(context.Background(), d.opts.DisarmTimeout)
+			defer cancel()
+			return d.Disarm(dc)
+		}
+	}
+}
+
+// sameSymbols reports whether the comma separated lists contain the same symbols.
+func sameSymbols(a, b string) bool {
+	split := func(s string) []string {
+		var l []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				l = append(l, v)
+			}
+		}
+		sort.Strings(l)
+		return l
+	}
+	return strings.Join(split(a), ",") == strings.Join(split(b), ",")
+}
@@ -0,0 +1,176 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDeadManSwitchRequester routes the dead man switch endpoints to a fake setting,
+// the refreshes fail while failing is not zero.
+func newTestDeadManSwitchRequester(failing *int32) (*routeRequester, func() *AUtoCancelSettingModel) {
+	var mu sync.Mutex
+	var setting *AUtoCancelSettingModel
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/hf/orders/dead-cancel-all", func(r *Request) interface{} {
+		if atomic.LoadInt32(failing) != 0 {
+			return &routeFailure{code: "500000", message: "Internal error"}
+		}
+		p := struct {
+			Timeout int64  `json:"timeout"`
+			Symbols string `json:"symbols"`
+		}{}
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Timeout < 0 {
+			setting = nil
+			return nil
+		}
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		setting = &AUtoCancelSettingModel{Timeout: p.Timeout, Symbols: p.Symbols}
+		return &HfAutoCancelSettingRes{
+			CurrentTime: json.Number(strconv.FormatInt(now, 10)),
+			TriggerTime: json.Number(strconv.FormatInt(now+p.Timeout*1000, 10)),
+		}
+	})
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/dead-cancel-all/query", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if setting == nil {
+			return nil
+		}
+		s := *setting
+		// The server may return the symbols in another order
+		l := strings.Split(s.Symbols, ",")
+		for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+			l[i], l[j] = l[j], l[i]
+		}
+		s.Symbols = strings.Join(l, ",")
+		return &s
+	})
+	return rr, func() *AUtoCancelSettingModel {
+		mu.Lock()
+		defer mu.Unlock()
+		return setting
+	}
+}
+
+func TestDeadManSwitch_Run(t *testing.T) {
+	var failing int32
+	rr, setting := newTestDeadManSwitchRequester(&failing)
+	as := NewApiService(ApiRequesterOption(rr))
+	if _, err := as.NewDeadManSwitch(DeadManSwitchOpts{Timeout: time.Second}); err == nil {
+		t.Error("Expected an error of the short timeout")
+	}
+	d, err := as.NewDeadManSwitch(DeadManSwitchOpts{
+		Symbols:         []string{"KCS-USDT", "KCS-BTC"},
+		Timeout:         10 * time.Second,
+		RefreshInterval: 20 * time.Millisecond,
+		RetryDelay:      10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rr.count(http.MethodPost, "/api/v1/hf/orders/dead-cancel-all") < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := setting(); s == nil || s.Timeout != 10 || s.Symbols != "KCS-USDT,KCS-BTC" || !d.Armed() {
+		t.Fatalf("Unexpected setting: %s", ToJsonString(s))
+	}
+
+	// A failed refresh is surfaced and retried
+	atomic.StoreInt32(&failing, 1)
+	select {
+	case err := <-d.Errors():
+		if !strings.Contains(err.Error(), "Internal error") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an error of the refresh")
+	}
+	if !d.Armed() {
+		t.Error("Expected the switch armed before the expiry")
+	}
+	atomic.StoreInt32(&failing, 0)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return")
+	}
+	if setting() != nil || d.Armed() {
+		t.Error("Expected the switch disarmed")
+	}
+}
+
+func TestDeadManSwitch_Expired(t *testing.T) {
+	failing := int32(0)
+	rr, _ := newTestDeadManSwitchRequester(&failing)
+	d, err := NewApiService(ApiRequesterOption(rr)).NewDeadManSwitch(DeadManSwitchOpts{
+		Timeout:         5 * time.Second,
+		RefreshInterval: 10 * time.Millisecond,
+		RetryDelay:      10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for !d.Armed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The refreshes fail until the expiry
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(30 * time.Millisecond)
+	d.mu.Lock()
+	d.expires = time.Now().Add(50 * time.Millisecond)
+	d.mu.Unlock()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "expired") || d.Armed() {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the switch expired")
+	}
+}
+
+func TestDeadManSwitch_VerifyFailed(t *testing.T) {
+	failing := int32(0)
+	rr, setting := newTestDeadManSwitchRequester(&failing)
+	// The verification finds another timeout
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/dead-cancel-all/query", func(r *Request) interface{} {
+		return &AUtoCancelSettingModel{Timeout: 1}
+	})
+	d, err := NewApiService(ApiRequesterOption(rr)).NewDeadManSwitch(DeadManSwitchOpts{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "Verify") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if d.Armed() || setting() != nil || rr.count(http.MethodPost, "/api/v1/hf/orders/dead-cancel-all") != 2 {
+		t.Error("Expected the switch disarmed")
+	}
+}
@@ -0,0 +1,624 @@
+package kucoin
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// An ExecutionState is the state of an ExecutionAlgo.
+type ExecutionState string
+
+// The states of an ExecutionAlgo.
+const (
+	ExecutionPending   ExecutionState = "pending"
+	ExecutionRunning   ExecutionState = "running"
+	ExecutionPaused    ExecutionState = "paused"
+	ExecutionCancelled ExecutionState = "cancelled"
+	ExecutionCompleted ExecutionState = "completed"
+	ExecutionFailed    ExecutionState = "failed"
+)
+
+// All defaults of ExecutionAlgoOpts and VWAPOpts.
+const (
+	defaultExecutionSlices       = 10
+	defaultExecutionTimeInForce  = "GTC"
+	defaultExecutionCancelWait   = 5 * time.Second
+	defaultExecutionPollInterval = time.Second
+	executionFillsPageSize       = 100
+	defaultVWAPLookbackDays      = 5
+	defaultVWAPKLineType         = "1min"
+	executionProfileLookbackSpan = 24 * time.Hour
+)
+
+// ExecutionAlgoOpts contains the options of an ExecutionAlgo.
+type ExecutionAlgoOpts struct {
+	Symbol string
+	Side   string
+	// Size is the parent quantity in the base currency.
+	Size string
+	// Horizon is the time the parent quantity is executed over.
+	Horizon time.Duration
+	// Slices is the number of the child orders, 10 by default.
+	Slices int
+	// Start is the start of the horizon, the time Run() is called by default.
+	Start time.Time
+
+	// Price returns the price of the next child order, e.g. the best bid or ask.
+	// LimitPrice is used if it is nil.
+	Price func(ctx context.Context) (string, error)
+	// LimitPrice guards the child orders: a buy is never priced above it, a sell never below it.
+	LimitPrice string
+	// MaxParticipation caps the executed quantity to a ratio of the market volume observed by Apply()
+	// since Run() is called, e.g. "0.1". It is not capped if it is empty.
+	MaxParticipation string
+	// SizeIncrement rounds down the sizes of the child orders, e.g. the BaseIncrement of the symbol.
+	SizeIncrement string
+	// TimeInForce is the time in force of the child orders, GTC by default.
+	// A child order still open at the end of its slice is cancelled.
+	TimeInForce string
+	// Generator generates the client oids of the child orders, NewClientOidGenerator("") by default.
+	Generator ClientOidGenerator
+	// Events reports whether the private orderChange events are applied by Apply(),
+	// the child orders are polled and their fills are queried with HfTransactionDetails() otherwise.
+	Events bool
+	// PollInterval is the interval of querying the open child order without Events, 1s by default.
+	PollInterval time.Duration
+}
+
+// VWAPOpts contains the options of the volume profile of a VWAP.
+type VWAPOpts struct {
+	// LookbackDays is the number of the previous days the profile is averaged over, 5 by default.
+	LookbackDays int
+	// KLineType is the type of the KLines the profile is built from, 1min by default.
+	KLineType string
+}
+
+// An ExecutionProgress is a snapshot of the progress of an ExecutionAlgo.
+type ExecutionProgress struct {
+	State     ExecutionState `json:"state"`
+	Slice     int            `json:"slice"`
+	Slices    int            `json:"slices"`
+	Size      string         `json:"size"`
+	Filled    string         `json:"filled"`
+	Remaining string         `json:"remaining"`
+	// AvgPrice is the average price of the fills, empty without a fill.
+	AvgPrice string       `json:"avgPrice"`
+	Children []string     `json:"children"`
+	Fills    []*OrderFill `json:"fills"`
+	Err      string       `json:"err,omitempty"`
+}
+
+// An ExecutionAlgo executes a parent quantity with HF child orders following a schedule:
+// evenly over the horizon for a TWAP, or following a volume profile for a VWAP.
+// The quantity not executed in a slice is carried over to the next ones.
+type ExecutionAlgo struct {
+	as      *ApiService
+	opts    ExecutionAlgoOpts
+	shares  []string
+	tracker *OrderTracker
+
+	mu        sync.Mutex
+	state     ExecutionState
+	slice     int
+	children  []string
+	restFills map[string][]*OrderFill
+	volume    string
+	err       error
+	resumed   chan struct{}
+	cancelled chan struct{}
+}
+
+// NewTWAP creates an instance of ExecutionAlgo slicing the quantity evenly over the horizon.
+func (as *ApiService) NewTWAP(opts ExecutionAlgoOpts) (*ExecutionAlgo, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	shares := make([]string, opts.Slices)
+	for i := range shares {
+		shares[i] = decimalQuo(strconv.Itoa(i+1), strconv.Itoa(opts.Slices))
+	}
+	return as.newExecutionAlgo(opts, shares), nil
+}
+
+// NewVWAP creates an instance of ExecutionAlgo slicing the quantity by the volume profile
+// of the same time of the previous days, built from KLines.
+// The quantity is sliced evenly if no volume has been traded.
+func (as *ApiService) NewVWAP(ctx context.Context, opts ExecutionAlgoOpts, vo VWAPOpts) (*ExecutionAlgo, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if vo.LookbackDays <= 0 {
+		vo.LookbackDays = defaultVWAPLookbackDays
+	}
+	if vo.KLineType == "" {
+		vo.KLineType = defaultVWAPKLineType
+	}
+	ci, err := ParseCandleInterval(vo.KLineType)
+	if err != nil || ci.typo == "" {
+		return nil, errors.Errorf("Invalid KLine type %s", vo.KLineType)
+	}
+	if opts.Start.IsZero() {
+		opts.Start = time.Now()
+	}
+
+	volumes := make([]string, opts.Slices)
+	interval := opts.Horizon / time.Duration(opts.Slices)
+	for d := 1; d <= vo.LookbackDays; d++ {
+		start := opts.Start.Add(-time.Duration(d) * executionProfileLookbackSpan)
+		rsp, err := as.KLines(ctx, opts.Symbol, ci.typo, start.Unix(), start.Add(opts.Horizon).Unix())
+		if err != nil {
+			return nil, err
+		}
+		ks := KLinesModel{}
+		if err := rsp.ReadData(&ks); err != nil {
+			return nil, err
+		}
+		for _, k := range ks {
+			c, err := parseKLine(*k, ci)
+			if err != nil {
+				return nil, err
+			}
+			if c.Start.Before(start) {
+				continue
+			}
+			if i := int(c.Start.Sub(start) / interval); i < opts.Slices {
+				volumes[i] = decimalAdd(volumes[i], c.Volume)
+			}
+		}
+	}
+
+	total := "0"
+	for _, v := range volumes {
+		total = decimalAdd(total, v)
+	}
+	if decimalCmp(total, "0") <= 0 {
+		return as.NewTWAP(opts)
+	}
+	shares := make([]string, opts.Slices)
+	cum := "0"
+	for i, v := range volumes {
+		cum = decimalAdd(cum, v)
+		shares[i] = decimalQuo(cum, total)
+	}
+	return as.newExecutionAlgo(opts, shares), nil
+}
+
+// withDefaults checks the options and returns them with the defaults.
+func (o ExecutionAlgoOpts) withDefaults() (ExecutionAlgoOpts, error) {
+	if o.Symbol == "" || (o.Side != "buy" && o.Side != "sell") {
+		return o, errors.Errorf("Invalid execution of %s %s", o.Side, o.Symbol)
+	}
+	if decimalCmp(o.Size, "0") <= 0 || o.Horizon <= 0 {
+		return o, errors.Errorf("Invalid execution of %s over %s", o.Size, o.Horizon)
+	}
+	if o.Price == nil && o.LimitPrice == "" {
+		return o, errors.New("Invalid execution without a price")
+	}
+	if o.Slices <= 0 {
+		o.Slices = defaultExecutionSlices
+	}
+	if o.TimeInForce == "" {
+		o.TimeInForce = defaultExecutionTimeInForce
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultExecutionPollInterval
+	}
+	if o.Generator == nil {
+		g, err := NewClientOidGenerator("")
+		if err != nil {
+			return o, err
+		}
+		o.Generator = g
+	}
+	return o, nil
+}
+
+// newExecutionAlgo creates an instance of ExecutionAlgo with the cumulative shares of the slices.
+func (as *ApiService) newExecutionAlgo(opts ExecutionAlgoOpts, shares []string) *ExecutionAlgo {
+	return &ExecutionAlgo{
+		as:        as,
+		opts:      opts,
+		shares:    shares,
+		tracker:   as.NewOrderTracker(),
+		state:     ExecutionPending,
+		restFills: make(map[string][]*OrderFill),
+		resumed:   make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+}
+
+// Apply applies a message of /market/match of the symbol to the participation cap,
+// and a private orderChange message to the child orders. The other messages are ignored.
+func (a *ExecutionAlgo) Apply(m *WebSocketDownstreamMessage) error {
+	if m.Topic == MatchTopicPrefix+a.opts.Symbol {
+		v := &struct {
+			Size string `json:"size"`
+		}{}
+		if err := m.ReadData(v); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		a.volume = decimalAdd(a.volume, v.Size)
+		a.mu.Unlock()
+		return nil
+	}
+	return a.tracker.Apply(m)
+}
+
+// Pause stops placing the child orders from the next slice until Resume() is called.
+func (a *ExecutionAlgo) Pause() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state == ExecutionRunning || a.state == ExecutionPending {
+		a.state = ExecutionPaused
+		a.resumed = make(chan struct{})
+	}
+}
+
+// Resume resumes placing the child orders, the quantity of the slices missed is carried over.
+func (a *ExecutionAlgo) Resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state == ExecutionPaused {
+		a.state = ExecutionRunning
+		close(a.resumed)
+	}
+}
+
+// Cancel stops the execution, the open child order is cancelled.
+func (a *ExecutionAlgo) Cancel() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.cancelled:
+	default:
+		close(a.cancelled)
+	}
+}
+
+// Progress returns a snapshot of the progress.
+func (a *ExecutionAlgo) Progress() *ExecutionProgress {
+	a.mu.Lock()
+	p := &ExecutionProgress{
+		State:    a.state,
+		Slice:    a.slice,
+		Slices:   len(a.shares),
+		Size:     a.opts.Size,
+		Children: append([]string(nil), a.children...),
+	}
+	if a.err != nil {
+		p.Err = a.err.Error()
+	}
+	a.mu.Unlock()
+
+	filled, funds := "0", "0"
+	for _, c := range p.Children {
+		for _, f := range a.fills(c) {
+			p.Fills = append(p.Fills, f)
+			filled = decimalAdd(filled, f.Size)
+			funds = decimalAdd(funds, decimalMul(f.Price, f.Size))
+		}
+	}
+	p.Filled = filled
+	p.Remaining = decimalSub(a.opts.Size, filled)
+	if decimalCmp(p.Remaining, "0") < 0 {
+		p.Remaining = "0"
+	}
+	if decimalCmp(filled, "0") > 0 {
+		p.AvgPrice = decimalQuo(funds, filled)
+	}
+	return p
+}
+
+// fills returns the fills of a child order.
+func (a *ExecutionAlgo) fills(clientOid string) []*OrderFill {
+	if a.opts.Events {
+		return a.tracker.Fills(clientOid)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.restFills[clientOid]
+}
+
+// setState sets the state unless the execution has been paused meanwhile.
+func (a *ExecutionAlgo) setState(s ExecutionState, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s == ExecutionRunning && a.state == ExecutionPaused {
+		return
+	}
+	a.state, a.err = s, err
+}
+
+// Run executes the schedule until the last slice ends, the execution is cancelled or ctx is done.
+// It returns the error of ctx, or the error failing the execution.
+// A rejected child order does not fail the execution, its quantity is carried over.
+func (a *ExecutionAlgo) Run(ctx context.Context) error {
+	start := a.opts.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	a.mu.Lock()
+	a.volume = "0"
+	a.mu.Unlock()
+	a.setState(ExecutionRunning, nil)
+	interval := a.opts.Horizon / time.Duration(len(a.shares))
+	for i := range a.shares {
+		end := start.Add(interval * time.Duration(i+1))
+		if err := a.wait(ctx, start.Add(interval*time.Duration(i))); err != nil {
+			return a.stop(err)
+		}
+		if !time.Now().Before(end) {
+			// The slice was missed while paused
+			continue
+		}
+		a.mu.Lock()
+		a.slice = i
+		a.mu.Unlock()
+		if err := a.execute(ctx, i, end); err != nil {
+			return a.stop(err)
+		}
+		if decimalCmp(a.Progress().Remaining, "0") <= 0 {
+			break
+		}
+	}
+	a.setState(ExecutionCompleted, nil)
+	return nil
+}
+
+// stop sets the final state of an execution stopped by the error.
+func (a *ExecutionAlgo) stop(err error) error {
+	select {
+	case <-a.cancelled:
+		a.setState(ExecutionCancelled, nil)
+		return nil
+	default:
+	}
+	a.setState(ExecutionFailed, err)
+	return err
+}
+
+// wait waits until the time while the execution is paused.
+func (a *ExecutionAlgo) wait(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	for {
+		a.mu.Lock()
+		paused, resumed := a.state == ExecutionPaused, a.resumed
+		a.mu.Unlock()
+		if !paused {
+			select {
+			case <-timer.C:
+				return nil
+			case <-a.cancelled:
+				return errors.New("Execution cancelled")
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-resumed:
+		case <-a.cancelled:
+			return errors.New("Execution cancelled")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// quantity returns the size of the child order of the slice.
+func (a *ExecutionAlgo) quantity(i int) string {
+	filled := a.Progress().Filled
+	q := decimalSub(decimalMul(a.opts.Size, a.shares[i]), filled)
+	if a.opts.MaxParticipation != "" {
+		a.mu.Lock()
+		limit := decimalSub(decimalMul(a.opts.MaxParticipation, a.volume), filled)
+		a.mu.Unlock()
+		if decimalCmp(limit, q) < 0 {
+			q = limit
+		}
+	}
+	if rest := decimalSub(a.opts.Size, filled); decimalCmp(rest, q) < 0 {
+		q = rest
+	}
+	q = decimalRound(q, a.opts.SizeIncrement, -1)
+	if decimalCmp(q, "0") <= 0 {
+		return ""
+	}
+	return q
+}
+
+// price returns the price of the child order guarded by LimitPrice.
+func (a *ExecutionAlgo) price(ctx context.Context) (string, error) {
+	if a.opts.Price == nil {
+		return a.opts.LimitPrice, nil
+	}
+	p, err := a.opts.Price(ctx)
+	if err != nil || a.opts.LimitPrice == "" {
+		return p, err
+	}
+	if c := decimalCmp(p, a.opts.LimitPrice); a.opts.Side == "buy" && c > 0 || a.opts.Side == "sell" && c < 0 {
+		return a.opts.LimitPrice, nil
+	}
+	return p, nil
+}
+
+// execute places the child order of the slice, waits until the end of the slice,
+// then cancels the child order if it is still open and collects its fills.
+func (a *ExecutionAlgo) execute(ctx context.Context, i int, end time.Time) error {
+	size := a.quantity(i)
+	if size == "" {
+		return nil
+	}
+	price, err := a.price(ctx)
+	if err != nil {
+		return err
+	}
+	clientOid := a.opts.Generator.NewClientOid()
+	a.mu.Lock()
+	a.children = append(a.children, clientOid)
+	a.mu.Unlock()
+	_, err = a.tracker.HfPlaceOrder(ctx, map[string]string{
+		"clientOid":   clientOid,
+		"symbol":      a.opts.Symbol,
+		"side":        a.opts.Side,
+		"type":        "limit",
+		"price":       price,
+		"size":        size,
+		"timeInForce": a.opts.TimeInForce,
+	})
+	if err != nil {
+		if o := a.tracker.Order(clientOid); o != nil && o.State == OrderStateRejected {
+			if DebugMode {
+				logrus.Debugf("Child order %s of slice %d rejected, %s", clientOid, i, err.Error())
+			}
+			return nil
+		}
+		// The child order may have been placed despite the failure
+		placed, rerr := a.resolve(clientOid)
+		if rerr != nil {
+			return errors.Errorf("Place child order %s failed, %s, and resolving it failed, %s", clientOid, err.Error(), rerr.Error())
+		}
+		if !placed {
+			return err
+		}
+	}
+
+	wc, cancel := context.WithDeadline(ctx, end)
+	defer cancel()
+	go func() {
+		select {
+		case <-a.cancelled:
+			cancel()
+		case <-wc.Done():
+		}
+	}()
+	if a.opts.Events {
+		_, _ = a.tracker.Wait(wc, clientOid)
+	} else {
+		a.poll(wc, clientOid)
+	}
+
+	// The child order is cancelled and collected even if the execution stops
+	cc, ccancel := context.WithTimeout(context.Background(), defaultExecutionCancelWait)
+	defer ccancel()
+	o := a.tracker.Order(clientOid)
+	if !o.State.Terminal() {
+		rsp, err := a.as.HfCancelOrderByClientId(cc, clientOid, a.opts.Symbol)
+		if err == nil {
+			err = rsp.ReadData(nil)
+		}
+		if err != nil && DebugMode {
+			logrus.Debugf("Cancel child order %s failed, %s", clientOid, err.Error())
+		}
+	}
+	if !a.opts.Events {
+		if err := a.queryFills(cc, o.OrderId, clientOid); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	select {
+	case <-a.cancelled:
+		return errors.New("Execution cancelled")
+	default:
+	}
+	return nil
+}
+
+// resolve queries the child order after an unknown failure of its placement, and reports whether it has been placed.
+// A child order which cannot be resolved is cancelled, as it may be open.
+func (a *ExecutionAlgo) resolve(clientOid string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultExecutionCancelWait)
+	defer cancel()
+	rsp, err := a.as.HfOrderDetailByClientOid(ctx, clientOid, a.opts.Symbol)
+	o := &HfOrderModel{}
+	if err == nil {
+		err = rsp.ReadData(o)
+	}
+	if err == nil && o.Id != "" {
+		a.tracker.ApplyHfOrder(o)
+		return true, nil
+	}
+	// The order does not exist only if the API replies so
+	if err == nil || !unknownPlaceFailure(rsp, err) {
+		return false, nil
+	}
+	crsp, cerr := a.as.HfCancelOrderByClientId(ctx, clientOid, a.opts.Symbol)
+	if cerr == nil {
+		cerr = crsp.ReadData(nil)
+	}
+	if cerr != nil && DebugMode {
+		logrus.Debugf("Cancel child order %s failed, %s", clientOid, cerr.Error())
+	}
+	return false, err
+}
+
+// poll queries the child order with HfOrderDetailByClientOid() until it is done or ctx is done.
+func (a *ExecutionAlgo) poll(ctx context.Context, clientOid string) {
+	t := time.NewTicker(a.opts.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		rsp, err := a.as.HfOrderDetailByClientOid(ctx, clientOid, a.opts.Symbol)
+		o := &HfOrderModel{}
+		if err == nil {
+			err = rsp.ReadData(o)
+		}
+		if err != nil {
+			if DebugMode {
+				logrus.Debugf("Query child order %s failed, %s", clientOid, err.Error())
+			}
+			continue
+		}
+		a.tracker.ApplyHfOrder(o)
+		if a.tracker.Order(clientOid).State.Terminal() {
+			return
+		}
+	}
+}
+
+// queryFills queries all pages of the fills of a child order with HfTransactionDetails().
+func (a *ExecutionAlgo) queryFills(ctx context.Context, orderId, clientOid string) error {
+	var fills []*OrderFill
+	p := map[string]string{"symbol": a.opts.Symbol, "orderId": orderId, "limit": strconv.Itoa(executionFillsPageSize)}
+	for {
+		rsp, err := a.as.HfTransactionDetails(ctx, p)
+		if err != nil {
+			return err
+		}
+		v := &HfTransactionDetailsModel{}
+		if err := rsp.ReadData(v); err != nil {
+			return err
+		}
+		for _, f := range v.Items {
+			if f.OrderId != orderId {
+				continue
+			}
+			ts, _ := f.CreatedAt.Int64()
+			fills = append(fills, &OrderFill{TradeId: f.TradeId.String(), Price: f.Price, Size: f.Size, Liquidity: f.Liquidity, Ts: ts})
+		}
+		last := v.LastId.String()
+		if len(v.Items) < executionFillsPageSize || last == "" || last == "0" || last == p["lastId"] {
+			break
+		}
+		p["lastId"] = last
+	}
+	a.mu.Lock()
+	a.restFills[clientOid] = fills
+	a.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,240 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestExecutionAlgo_TWAP(t *testing.T) {
+	rr := newRouteRequester()
+	var mu sync.Mutex
+	var sizes, prices []string
+	orders := make(map[string]string)
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		p := make(map[string]string)
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, p["size"])
+		prices = append(prices, p["price"])
+		orders["o-"+p["clientOid"]] = p["size"]
+		return &HfPlaceOrderRes{OrderId: "o-" + p["clientOid"], ClientOid: p["clientOid"], Success: true}
+	})
+	for i := 1; i <= 4; i++ {
+		oid := fmt.Sprintf("c%d", i)
+		// The first child order is half filled and stays open, the others are filled
+		rr.handle(http.MethodGet, "/api/v1/hf/orders/client-order/"+oid, func(r *Request) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			size := orders["o-"+oid]
+			if oid == "c1" {
+				return &HfOrderModel{Id: "o-" + oid, ClientOid: oid, Size: size, DealSize: decimalMul(size, "0.5"), Active: true}
+			}
+			return &HfOrderModel{Id: "o-" + oid, ClientOid: oid, Size: size, DealSize: size}
+		})
+		rr.handle(http.MethodDelete, "/api/v1/hf/orders/client-order/"+oid, func(r *Request) interface{} {
+			return &CancelOrderByClientResultModel{ClientOid: oid}
+		})
+	}
+	rr.handle(http.MethodGet, "/api/v1/hf/fills", func(r *Request) interface{} {
+		id := r.Query.Get("orderId")
+		mu.Lock()
+		defer mu.Unlock()
+		size := orders[id]
+		if id == "o-c1" {
+			size = decimalMul(size, "0.5")
+		}
+		// The fills are replied in 2 full pages
+		page, lastId := 0, ""
+		if r.Query.Get("lastId") != "" {
+			page, lastId = 1, "0"
+		} else {
+			lastId = "1"
+		}
+		items := make([]*HfTransactionDetailModel, executionFillsPageSize)
+		for i := range items {
+			items[i] = &HfTransactionDetailModel{TradeId: json.Number(fmt.Sprint(len(sizes)*1000 + page*executionFillsPageSize + i)),
+				OrderId: id, Price: "11", Size: decimalQuo(size, IntToString(2*executionFillsPageSize))}
+		}
+		return &HfTransactionDetailsModel{LastId: json.Number(lastId), Items: items}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	n := 0
+	a, err := as.NewTWAP(ExecutionAlgoOpts{
+		Symbol:       "KCS-USDT",
+		Side:         "buy",
+		Size:         "8",
+		Horizon:      400 * time.Millisecond,
+		Slices:       4,
+		Price:        func(ctx context.Context) (string, error) { return "12", nil },
+		LimitPrice:   "11",
+		Generator:    ClientOidFunc(func() string { n++; return fmt.Sprintf("c%d", n) }),
+		PollInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := a.Progress()
+	if p.State != ExecutionCompleted || p.Filled != "8" || p.Remaining != "0" || p.AvgPrice != "11" || len(p.Fills) != 4*2*executionFillsPageSize {
+		t.Errorf("Unexpected progress: %s", ToJsonString(p))
+	}
+	// The quantity not filled in the first slice is carried over
+	if strings.Join(sizes, ",") != "2,3,2,2" || strings.Join(prices, ",") != "11,11,11,11" {
+		t.Errorf("Unexpected child orders of %v at %v", sizes, prices)
+	}
+	// Only the open child order is cancelled
+	for i := 1; i <= 4; i++ {
+		want := 0
+		if i == 1 {
+			want = 1
+		}
+		if c := rr.count(http.MethodDelete, fmt.Sprintf("/api/v1/hf/orders/client-order/c%d", i)); c != want {
+			t.Errorf("Expected %d cancellations of c%d, got %d", want, i, c)
+		}
+	}
+}
+
+func TestExecutionAlgo_UnknownPlaceFailure(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		return errors.New("i/o timeout")
+	})
+	// The child order cannot be resolved either
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/client-order/c1", func(r *Request) interface{} {
+		return errors.New("i/o timeout")
+	})
+	rr.handle(http.MethodDelete, "/api/v1/hf/orders/client-order/c1", func(r *Request) interface{} {
+		return &CancelOrderByClientResultModel{ClientOid: "c1"}
+	})
+	a, err := NewApiService(ApiRequesterOption(rr)).NewTWAP(ExecutionAlgoOpts{
+		Symbol:     "KCS-USDT",
+		Side:       "buy",
+		Size:       "1",
+		Horizon:    100 * time.Millisecond,
+		Slices:     1,
+		LimitPrice: "11",
+		Generator:  ClientOidFunc(func() string { return "c1" }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Run(context.Background()); err == nil {
+		t.Fatal("Expected an error of the child order")
+	}
+	// The child order which may be open is cancelled
+	if p := a.Progress(); p.State != ExecutionFailed || rr.count(http.MethodDelete, "/api/v1/hf/orders/client-order/c1") != 1 {
+		t.Errorf("Unexpected progress: %s", ToJsonString(p))
+	}
+}
+
+func TestExecutionAlgo_PauseCancel(t *testing.T) {
+	rr := newRouteRequester()
+	var a *ExecutionAlgo
+	var sizes []string
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		p := make(map[string]string)
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		sizes = append(sizes, p["size"])
+		// The events of the child order arrive while it is placed
+		a.Apply(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "KCS-USDT", ClientOid: p["clientOid"], OrderId: "o1",
+			Type: "filled", TradeId: "t1", MatchPrice: "10", MatchSize: p["size"], FilledSize: p["size"]}))
+		a.Pause()
+		return &HfPlaceOrderRes{OrderId: "o1", ClientOid: p["clientOid"], Success: true}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	var err error
+	a, err = as.NewTWAP(ExecutionAlgoOpts{
+		Symbol:           "KCS-USDT",
+		Side:             "sell",
+		Size:             "4",
+		Horizon:          100 * time.Millisecond,
+		Slices:           2,
+		Start:            time.Now().Add(50 * time.Millisecond),
+		LimitPrice:       "10",
+		MaxParticipation: "0.5",
+		Events:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := func(size string) {
+		m := newTestDownstreamMessage(MatchTopicPrefix+"KCS-USDT", "trade.l3match", 1)
+		m.RawData = []byte(`{"size":"` + size + `"}`)
+		if err := a.Apply(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The volume is counted from Run
+	match("100")
+
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	match("2")
+	time.Sleep(130 * time.Millisecond)
+	if p := a.Progress(); p.State != ExecutionPaused || p.Filled != "1" || len(p.Children) != 1 {
+		t.Errorf("Unexpected progress: %s", ToJsonString(p))
+	}
+	a.Cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return")
+	}
+	// The participation is capped to half of the market volume
+	if p := a.Progress(); p.State != ExecutionCancelled || strings.Join(sizes, ",") != "1" {
+		t.Errorf("Unexpected progress %s of %v", ToJsonString(p), sizes)
+	}
+}
+
+func TestApiService_NewVWAP(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	rr := newRouteRequester()
+	rr.handle(http.MethodGet, "/api/v1/market/candles", func(r *Request) interface{} {
+		s := start.Add(-24 * time.Hour).Unix()
+		if r.Query.Get("startAt") != IntToString(s) {
+			return KLinesModel{}
+		}
+		return KLinesModel{
+			{IntToString(s + 60), "1", "1", "1", "1", "3", "3"},
+			{IntToString(s), "1", "1", "1", "1", "1", "1"},
+		}
+	})
+	a, err := NewApiService(ApiRequesterOption(rr)).NewVWAP(context.Background(), ExecutionAlgoOpts{
+		Symbol:     "KCS-USDT",
+		Side:       "buy",
+		Size:       "8",
+		Horizon:    2 * time.Minute,
+		Slices:     2,
+		Start:      start,
+		LimitPrice: "10",
+	}, VWAPOpts{LookbackDays: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(a.shares, ",") != "0.25,1" || a.quantity(0) != "2" {
+		t.Errorf("Unexpected profile: %v", a.shares)
+	}
+	if n := rr.count(http.MethodGet, "/api/v1/market/candles"); n != 2 {
+		t.Errorf("Expected 2 requests of KLines, got %d", n)
+	}
+}
@@ -2,7 +2,11 @@ package kucoin
 
 import (
 	"encoding/json"
+	"math/big"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // IntToString converts int64 to string.
@@ -18,3 +22,100 @@ func ToJsonString(v interface{}) string {
 	}
 	return string(b)
 }
+
+// decimalAdd returns a + b of the decimal strings, an empty string is taken as 0.
+func decimalAdd(a, b string) string {
+	return formatDecimal(new(big.Rat).Add(parseDecimal(a), parseDecimal(b)))
+}
+
+// decimalSub returns a - b of the decimal strings, an empty string is taken as 0.
+func decimalSub(a, b string) string {
+	return formatDecimal(new(big.Rat).Sub(parseDecimal(a), parseDecimal(b)))
+}
+
+// decimalMul returns a * b of the decimal strings, an empty string is taken as 0.
+func decimalMul(a, b string) string {
+	return formatDecimal(new(big.Rat).Mul(parseDecimal(a), parseDecimal(b)))
+}
+
+// decimalQuo returns a / b of the decimal strings, or 0 if b is 0.
+func decimalQuo(a, b string) string {
+	d := parseDecimal(b)
+	if d.Sign() == 0 {
+		return "0"
+	}
+	return formatDecimal(new(big.Rat).Quo(parseDecimal(a), d))
+}
+
+// decimalCmp compares the decimal strings, an empty string is taken as 0.
+func decimalCmp(a, b string) int {
+	return parseDecimal(a).Cmp(parseDecimal(b))
+}
+
+func parseDecimal(s string) *big.Rat {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+}
+
+func formatDecimal(r *big.Rat) string {
+	s := r.FloatString(18)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// decimalRound rounds the decimal string to a multiple of the increment, up or down by the sign of the direction,
+// or to the nearest one if direction is 0. The value is returned as is if the increment is not positive.
+func decimalRound(v, increment string, direction int) string {
+	inc := parseDecimal(increment)
+	if inc.Sign() <= 0 {
+		return v
+	}
+	q := new(big.Rat).Quo(parseDecimal(v), inc)
+	n := new(big.Int).Quo(q.Num(), q.Denom())
+	frac := new(big.Rat).Sub(q, new(big.Rat).SetInt(n))
+	switch {
+	case frac.Sign() == 0:
+	case direction > 0 && frac.Sign() > 0:
+		n.Add(n, big.NewInt(1))
+	case direction < 0 && frac.Sign() < 0:
+		n.Sub(n, big.NewInt(1))
+	case direction == 0 && new(big.Rat).Abs(frac).Cmp(big.NewRat(1, 2)) >= 0:
+		n.Add(n, big.NewInt(int64(frac.Sign())))
+	}
+	return formatDecimal(new(big.Rat).Mul(new(big.Rat).SetInt(n), inc))
+}
+
+// A rateLimiter limits the number of events within a sliding window, e.g. the requests to the server.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events []time.Time
+}
+
+// wait blocks until an event is allowed, it returns false if done is closed.
+func (l *rateLimiter) wait(done <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		for len(l.events) > 0 && now.Sub(l.events[0]) >= l.window {
+			l.events = l.events[1:]
+		}
+		if len(l.events) < l.limit {
+			l.events = append(l.events, now)
+			l.mu.Unlock()
+			return true
+		}
+		d := l.window - now.Sub(l.events[0])
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(d):
+		case <-done:
+			return false
+		}
+	}
+}
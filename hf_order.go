@@ -13,6 +13,11 @@ import (
 // (limit) order: set price and quantity for the transaction.
 // (market) order : set amount or quantity for the transaction.
 func (as *ApiService) HfPlaceOrder(ctx context.Context, params map[string]string) (*ApiResponse, error) {
+	if as.orderValidator != nil {
+		if err := as.orderValidator.ValidateHfPlaceOrder(params); err != nil {
+			return nil, err
+		}
+	}
 	req := NewRequest(http.MethodPost, "/api/v1/hf/orders", params)
 	return as.Call(ctx, req)
 }
@@ -23,6 +28,11 @@ func (as *ApiService) HfPlaceOrder(ctx context.Context, params map[string]string
 // For higher latency requirements, please select the "Place hf order" interface.
 // If there is a requirement for returning data integrity, please select this interface
 func (as *ApiService) HfSyncPlaceOrder(ctx context.Context, params map[string]string) (*ApiResponse, error) {
+	if as.orderValidator != nil {
+		if err := as.orderValidator.ValidateHfPlaceOrder(params); err != nil {
+			return nil, err
+		}
+	}
 	req := NewRequest(http.MethodPost, "/api/v1/hf/orders/sync", params)
 	return as.Call(ctx, req)
 }
@@ -173,10 +183,10 @@ func (as *ApiService) HfOrderDetailByClientOid(ctx context.Context, clientOid, s
 // HfAutoCancelSetting  automatically cancel all orders of the set trading pair after the specified time.
 // If this interface is not called again for renewal or cancellation before the set time,
 // the system will help the user to cancel the order of the corresponding trading pair.
-// otherwise it will not.
-func (as *ApiService) HfAutoCancelSetting(ctx context.Context, timeout int64, symbol string) (*ApiResponse, error) {
+// otherwise it will not. The symbols are separated by commas, all symbols if empty; a timeout of -1 cancels the setting.
+func (as *ApiService) HfAutoCancelSetting(ctx context.Context, timeout int64, symbols string) (*ApiResponse, error) {
 	p := map[string]interface{}{
-		"symbol":  symbol,
+		"symbols": symbols,
 		"timeout": timeout,
 	}
 	req := NewRequest(http.MethodPost, "/api/v1/hf/orders/dead-cancel-all", p)
@@ -217,6 +227,11 @@ func (as *ApiService) HfMarginActiveSymbols(ctx context.Context, tradeType strin
 
 // HfCreateMarinOrderV3 This interface is used to place cross-margin or isolated-margin high-frequency margin trading
 func (as *ApiService) HfCreateMarinOrderV3(ctx context.Context, p *HfMarginOrderV3Req) (*ApiResponse, error) {
+	if as.orderValidator != nil {
+		if err := as.orderValidator.ValidateHfMarginOrderV3(p); err != nil {
+			return nil, err
+		}
+	}
 	req := NewRequest(http.MethodPost, "/api/v3/hf/margin/order", p)
 	return as.Call(ctx, req)
 }
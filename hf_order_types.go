@@ -9,6 +9,7 @@ type HfPlaceOrderRes struct {
 	OrderId   string `json:"orderId"`
 	ClientOid string `json:"clientOid"`
 	Success   bool   `json:"success"`
+	FailMsg   string `json:"failMsg"`
 }
 
 type HfSyncPlaceOrderRes struct {
@@ -0,0 +1,70 @@
+package kucoin
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A routeFailure is replied by a route handler as an api failure.
+type routeFailure struct {
+	code    string
+	message string
+}
+
+// A routeRequester replies the requests routed by method and path with the data returned by the handlers,
+// it lets the tests run without the network. An error returned by a handler fails the request without a reply.
+type routeRequester struct {
+	mu     sync.Mutex
+	routes map[string]func(r *Request) interface{}
+	calls  map[string]int
+}
+
+func newRouteRequester() *routeRequester {
+	return &routeRequester{
+		routes: make(map[string]func(r *Request) interface{}),
+		calls:  make(map[string]int),
+	}
+}
+
+// handle routes the requests of method and path to h.
+func (rr *routeRequester) handle(method, path string, h func(r *Request) interface{}) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.routes[method+" "+path] = h
+}
+
+// count returns the number of requests of method and path.
+func (rr *routeRequester) count(method, path string) int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.calls[method+" "+path]
+}
+
+func (rr *routeRequester) Request(ctx context.Context, request *Request, timeout time.Duration) (*Response, error) {
+	k := request.Method + " " + request.Path
+	rr.mu.Lock()
+	h, ok := rr.routes[k]
+	rr.calls[k]++
+	rr.mu.Unlock()
+
+	v := map[string]interface{}{"code": ApiSuccess}
+	if !ok {
+		v = map[string]interface{}{"code": "404000", "msg": "Not found: " + k}
+	} else if d := h(request); d != nil {
+		if e, ok := d.(error); ok {
+			return nil, e
+		}
+		if f, ok := d.(*routeFailure); ok {
+			v = map[string]interface{}{"code": f.code, "msg": f.message}
+		} else {
+			v["data"] = d
+		}
+	}
+	b := []byte(ToJsonString(v))
+	rsp := &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(b))}
+	return NewResponse(request, rsp, nil), nil
+}
@@ -829,8 +829,8 @@ func (as *ApiService) SubscriptionOrdersV3(ctx context.Context, currency, status
 }
 
 type MarginSymbolsV3Model struct {
-	Items     []*MarginSymbolsV3Model `json:"items"`
-	Timestamp int64                   `json:"timestamp"`
+	Items     []*MarginSymbolV3Model `json:"items"`
+	Timestamp int64                  `json:"timestamp"`
 }
 
 type MarginSymbolV3Model struct {
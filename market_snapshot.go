@@ -0,0 +1,444 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The topics of the messages consumed by a MarketSnapshot.
+const (
+	TickerAllTopic      = "/market/ticker:all"
+	SnapshotTopicPrefix = "/market/snapshot:"
+)
+
+// A MarketStats represents the 24h stats of a symbol.
+type MarketStats struct {
+	ChangeRate   string `json:"changeRate"`
+	ChangePrice  string `json:"changePrice"`
+	Open         string `json:"open"`
+	High         string `json:"high"`
+	Low          string `json:"low"`
+	Vol          string `json:"vol"`
+	VolValue     string `json:"volValue"`
+	AveragePrice string `json:"averagePrice"`
+}
+
+// A MarketTicker represents the latest market data of a symbol in a MarketSnapshot.
+// It is immutable, an update replaces it.
+type MarketTicker struct {
+	Symbol      string      `json:"symbol"`
+	Sequence    string      `json:"sequence"`
+	BestBid     string      `json:"bestBid"`
+	BestBidSize string      `json:"bestBidSize"`
+	BestAsk     string      `json:"bestAsk"`
+	BestAskSize string      `json:"bestAskSize"`
+	Last        string      `json:"last"`
+	LastSize    string      `json:"lastSize"`
+	Stats       MarketStats `json:"stats"`
+	// TickerTime and StatsTime are the server times of the ticker and the 24h stats.
+	TickerTime time.Time `json:"tickerTime"`
+	StatsTime  time.Time `json:"statsTime"`
+	// UpdatedAt is the local time of the last update.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Age returns the time elapsed since the last update.
+func (t *MarketTicker) Age() time.Duration {
+	return time.Since(t.UpdatedAt)
+}
+
+// A MarketSnapshotModel represents the data of a message of /market/snapshot.
+type MarketSnapshotModel struct {
+	Sequence string `json:"sequence"`
+	Data     struct {
+		Symbol          string      `json:"symbol"`
+		Buy             json.Number `json:"buy"`
+		Sell            json.Number `json:"sell"`
+		LastTradedPrice json.Number `json:"lastTradedPrice"`
+		ChangeRate      json.Number `json:"changeRate"`
+		ChangePrice     json.Number `json:"changePrice"`
+		Open            json.Number `json:"open"`
+		High            json.Number `json:"high"`
+		Low             json.Number `json:"low"`
+		Vol             json.Number `json:"vol"`
+		VolValue        json.Number `json:"volValue"`
+		AveragePrice    json.Number `json:"averagePrice"`
+		Datetime        int64       `json:"datetime"`
+	} `json:"data"`
+}
+
+// A MarketSubscription receives the changed tickers of a MarketSnapshot.
+type MarketSubscription struct {
+	snapshot *MarketSnapshot
+	symbols  map[string]bool
+	c        chan *MarketTicker
+	dropped  uint64
+	once     sync.Once
+}
+
+// C returns the channel of the changed tickers, it is closed by Close.
+func (ms *MarketSubscription) C() <-chan *MarketTicker {
+	return ms.c
+}
+
+// Dropped returns the number of the changes dropped as the channel was full.
+func (ms *MarketSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&ms.dropped)
+}
+
+// Close stops the subscription and closes the channel.
+func (ms *MarketSubscription) Close() {
+	ms.once.Do(func() {
+		ms.snapshot.subsMu.Lock()
+		delete(ms.snapshot.subs, ms)
+		ms.snapshot.subsMu.Unlock()
+		close(ms.c)
+	})
+}
+
+// MarketSnapshotOpts contains the options of a MarketSnapshot.
+type MarketSnapshotOpts struct {
+	// Markets are the markets of the /market/snapshot subscriptions, all markets by default.
+	Markets []string
+	// ClientOpts are the options of the WebSocketClient started by Start.
+	// The client reconnects 10 times by default.
+	ClientOpts WebSocketClientOpts
+}
+
+// A MarketSnapshot caches the latest ticker and 24h stats of all symbols.
+// It bootstraps from Tickers, and stays live by /market/ticker:all and /market/snapshot.
+// The reads never lock.
+type MarketSnapshot struct {
+	as      *ApiService
+	markets []string
+	opts    WebSocketClientOpts
+
+	// A map[string]*atomic.Value of *MarketTicker, replaced when a symbol is added
+	tickers atomic.Value
+	// Serializes the writers
+	mu sync.Mutex
+
+	subsMu sync.Mutex
+	subs   map[*MarketSubscription]struct{}
+
+	client *WebSocketClient
+}
+
+// NewMarketSnapshot creates an instance of MarketSnapshot.
+func (as *ApiService) NewMarketSnapshot(opts MarketSnapshotOpts) *MarketSnapshot {
+	if opts.ClientOpts.ReconnectAttempts == 0 {
+		opts.ClientOpts.ReconnectAttempts = 10
+	}
+	if !opts.ClientOpts.TLSSkipVerify {
+		opts.ClientOpts.TLSSkipVerify = as.apiSkipVerifyTls
+	}
+	ms := &MarketSnapshot{
+		as:      as,
+		markets: opts.Markets,
+		opts:    opts.ClientOpts,
+		subs:    make(map[*MarketSubscription]struct{}),
+	}
+	ms.tickers.Store(map[string]*atomic.Value{})
+	return ms
+}
+
+// Ticker returns the latest ticker of the symbol, or nil if it is unknown.
+func (ms *MarketSnapshot) Ticker(symbol string) *MarketTicker {
+	v, ok := ms.tickers.Load().(map[string]*atomic.Value)[symbol]
+	if !ok {
+		return nil
+	}
+	return v.Load().(*MarketTicker)
+}
+
+// Tickers returns the latest tickers of all symbols.
+func (ms *MarketSnapshot) Tickers() map[string]*MarketTicker {
+	m := ms.tickers.Load().(map[string]*atomic.Value)
+	ts := make(map[string]*MarketTicker, len(m))
+	for s, v := range m {
+		ts[s] = v.Load().(*MarketTicker)
+	}
+	return ts
+}
+
+// Stale returns the symbols not updated within maxAge.
+func (ms *MarketSnapshot) Stale(maxAge time.Duration) []string {
+	var symbols []string
+	for s, t := range ms.Tickers() {
+		if t.Age() > maxAge {
+			symbols = append(symbols, s)
+		}
+	}
+	return symbols
+}
+
+// Subscribe receives the changed tickers of the symbols, or of all symbols if none is specified.
+// The changes are dropped if the buffer of the channel is full.
+func (ms *MarketSnapshot) Subscribe(buffer int, symbols ...string) *MarketSubscription {
+	sub := &MarketSubscription{snapshot: ms, c: make(chan *MarketTicker, buffer)}
+	if len(symbols) > 0 {
+		sub.symbols = make(map[string]bool, len(symbols))
+		for _, s := range symbols {
+			sub.symbols[s] = true
+		}
+	}
+	ms.subsMu.Lock()
+	ms.subs[sub] = struct{}{}
+	ms.subsMu.Unlock()
+	return sub
+}
+
+// update replaces the ticker of the symbol with the one changed by f, and notifies the subscriptions.
+// f returns false if the data is older than the ticker, which is kept then.
+func (ms *MarketSnapshot) update(symbol string, f func(t *MarketTicker) bool) {
+	ms.mu.Lock()
+	m := ms.tickers.Load().(map[string]*atomic.Value)
+	v, ok := m[symbol]
+	t := &MarketTicker{Symbol: symbol}
+	if ok {
+		*t = *v.Load().(*MarketTicker)
+	}
+	if !f(t) {
+		ms.mu.Unlock()
+		return
+	}
+	t.UpdatedAt = time.Now()
+	if ok {
+		v.Store(t)
+	} else {
+		v = &atomic.Value{}
+		v.Store(t)
+		nm := make(map[string]*atomic.Value, len(m)+1)
+		for s, sv := range m {
+			nm[s] = sv
+		}
+		nm[symbol] = v
+		ms.tickers.Store(nm)
+	}
+	ms.mu.Unlock()
+
+	ms.subsMu.Lock()
+	defer ms.subsMu.Unlock()
+	for sub := range ms.subs {
+		if sub.symbols != nil && !sub.symbols[symbol] {
+			continue
+		}
+		select {
+		case sub.c <- t:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Bootstrap loads the tickers and 24h stats of all symbols from Tickers.
+func (ms *MarketSnapshot) Bootstrap(ctx context.Context) error {
+	rsp, err := ms.as.Tickers(ctx)
+	if err != nil {
+		return err
+	}
+	tr := &TickersResponseModel{}
+	if err := rsp.ReadData(tr); err != nil {
+		return err
+	}
+	at := time.Unix(0, tr.Time*int64(time.Millisecond))
+	for _, tk := range tr.Tickers {
+		tk := tk
+		ms.update(tk.Symbol, func(t *MarketTicker) bool {
+			// Keep the newer data of the live messages
+			changed := false
+			if !t.TickerTime.After(at) {
+				t.BestBid, t.BestAsk, t.Last, t.TickerTime = tk.Buy, tk.Sell, tk.Last, at
+				changed = true
+			}
+			if !t.StatsTime.After(at) {
+				changed = true
+				t.Stats = MarketStats{
+					ChangeRate:   tk.ChangeRate,
+					ChangePrice:  tk.ChangePrice,
+					High:         tk.High,
+					Low:          tk.Low,
+					Vol:          tk.Vol,
+					VolValue:     tk.VolValue,
+					AveragePrice: tk.AveragePrice,
+				}
+				t.StatsTime = at
+			}
+			return changed
+		})
+	}
+	return nil
+}
+
+// SubscribeMessages returns the messages to subscribe the channels the snapshot consumes.
+func (ms *MarketSnapshot) SubscribeMessages() []*WebSocketSubscribeMessage {
+	sms := []*WebSocketSubscribeMessage{NewSubscribeMessage(TickerAllTopic, false)}
+	for _, market := range ms.markets {
+		sms = append(sms, NewSubscribeMessage(SnapshotTopicPrefix+market, false))
+	}
+	return sms
+}
+
+// Apply consumes a message of /market/ticker:all or /market/snapshot, other messages are ignored.
+func (ms *MarketSnapshot) Apply(m *WebSocketDownstreamMessage) error {
+	switch {
+	case m.Topic == TickerAllTopic:
+		tk := &TickerLevel1Model{}
+		if err := m.ReadData(tk); err != nil {
+			return err
+		}
+		at := time.Unix(0, tk.Time*int64(time.Millisecond))
+		ms.update(m.Subject, func(t *MarketTicker) bool {
+			if at.Before(t.TickerTime) {
+				return false
+			}
+			t.Sequence = tk.Sequence
+			t.BestBid, t.BestBidSize = tk.BestBid, tk.BestBidSize
+			t.BestAsk, t.BestAskSize = tk.BestAsk, tk.BestAskSize
+			t.Last, t.LastSize = tk.Price, tk.Size
+			t.TickerTime = at
+			return true
+		})
+	case strings.HasPrefix(m.Topic, SnapshotTopicPrefix):
+		s := &MarketSnapshotModel{}
+		if err := m.ReadData(s); err != nil {
+			return err
+		}
+		d := s.Data
+		if d.Symbol == "" {
+			return errors.Errorf("Invalid snapshot message: %s", m.RawData)
+		}
+		at := time.Unix(0, d.Datetime*int64(time.Millisecond))
+		ms.update(d.Symbol, func(t *MarketTicker) bool {
+			if at.Before(t.StatsTime) {
+				return false
+			}
+			t.Stats = MarketStats{
+				ChangeRate:   d.ChangeRate.String(),
+				ChangePrice:  d.ChangePrice.String(),
+				Open:         d.Open.String(),
+				High:         d.High.String(),
+				Low:          d.Low.String(),
+				Vol:          d.Vol.String(),
+				VolValue:     d.VolValue.String(),
+				AveragePrice: d.AveragePrice.String(),
+			}
+			t.StatsTime = at
+			// The ticker of ticker:all is more frequent and more precise
+			if t.TickerTime.IsZero() {
+				t.BestBid, t.BestAsk, t.Last = d.Buy.String(), d.Sell.String(), d.LastTradedPrice.String()
+				t.TickerTime = at
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// Run applies the messages until messages is closed or ctx is done.
+func (ms *MarketSnapshot) Run(ctx context.Context, messages <-chan *WebSocketDownstreamMessage) {
+	for {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+			if err := ms.Apply(m); err != nil && DebugMode {
+				logrus.Debugf("Apply market message failed, %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Start connects a public WebSocket client, subscribes the channels and bootstraps the snapshot,
+// then applies the messages in background until Stop is called.
+func (ms *MarketSnapshot) Start(ctx context.Context) error {
+	if len(ms.markets) == 0 {
+		rsp, err := ms.as.Markets(ctx)
+		if err != nil {
+			return err
+		}
+		markets := MarketsModel{}
+		if err := rsp.ReadData(&markets); err != nil {
+			return err
+		}
+		ms.markets = markets
+	}
+
+	token := func(ctx context.Context) (*WebSocketTokenModel, error) {
+		rsp, err := ms.as.WebSocketPublicToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tk := &WebSocketTokenModel{}
+		if err := rsp.ReadData(tk); err != nil {
+			return nil, err
+		}
+		return tk, nil
+	}
+	opts := ms.opts
+	if opts.Token == nil {
+		tk, err := token(ctx)
+		if err != nil {
+			return err
+		}
+		opts.Token = tk
+	}
+	if opts.TokenProvider == nil {
+		opts.TokenProvider = token
+	}
+	// Only the latest ticker of a symbol matters, a snapshot message of a market may carry any symbol
+	if opts.Backpressure == BackpressureBlock {
+		opts.Backpressure = BackpressureConflate
+	}
+	if opts.ConflateKey == nil {
+		opts.ConflateKey = func(m *WebSocketDownstreamMessage) string {
+			if m.Topic == TickerAllTopic {
+				return m.Subject
+			}
+			return ""
+		}
+	}
+
+	ms.client = ms.as.NewWebSocketClientOpts(opts)
+	mc, _, err := ms.client.Connect()
+	if err != nil {
+		return err
+	}
+	go ms.Run(context.Background(), mc)
+	if err := ms.client.SubscribeContext(ctx, ms.SubscribeMessages()...); err != nil {
+		ms.client.Stop()
+		return err
+	}
+	// Bootstrap after subscribing, so no change is missed between them
+	if err := ms.Bootstrap(ctx); err != nil {
+		ms.client.Stop()
+		return err
+	}
+	return nil
+}
+
+// Done returns a channel closed when the client started by Start is closed.
+// It returns nil before Start is called, which is never closed.
+func (ms *MarketSnapshot) Done() <-chan struct{} {
+	if ms.client == nil {
+		return nil
+	}
+	return ms.client.Done()
+}
+
+// Stop stops the client started by Start.
+func (ms *MarketSnapshot) Stop() {
+	if ms.client != nil {
+		ms.client.Stop()
+	}
+}
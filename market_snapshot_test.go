@@ -0,0 +1,117 @@
+package kucoin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTickerMessage(symbol, bid, ask string, at int64) *WebSocketDownstreamMessage {
+	m := newTestDownstreamMessage(TickerAllTopic, symbol, 0)
+	m.RawData = []byte(ToJsonString(&TickerLevel1Model{BestBid: bid, BestBidSize: "1", BestAsk: ask, BestAskSize: "2", Price: bid, Size: "0.5", Time: at}))
+	return m
+}
+
+func TestMarketSnapshot_Apply(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodGet, "/api/v1/market/allTickers", func(r *Request) interface{} {
+		return &TickersResponseModel{Time: 1000, Tickers: TickersModel{
+			{Symbol: "BTC-USDT", Buy: "9", Sell: "11", Last: "10", High: "12", Vol: "100"},
+			{Symbol: "ETH-USDT", Buy: "1", Sell: "2", Last: "1.5"},
+		}}
+	})
+	ms := NewApiService(ApiRequesterOption(rr)).NewMarketSnapshot(MarketSnapshotOpts{Markets: []string{"USDS"}})
+	all := ms.Subscribe(16)
+	btc := ms.Subscribe(1, "BTC-USDT")
+	defer all.Close()
+
+	if err := ms.Bootstrap(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tk := ms.Ticker("BTC-USDT"); tk == nil || tk.BestBid != "9" || tk.Stats.High != "12" || tk.TickerTime.UnixNano() != int64(time.Second) {
+		t.Fatalf("Unexpected ticker: %s", ToJsonString(tk))
+	}
+	if ms.Ticker("KCS-USDT") != nil {
+		t.Error("Expected an unknown symbol")
+	}
+
+	if err := ms.Apply(newTestTickerMessage("BTC-USDT", "10", "10.5", 2000)); err != nil {
+		t.Fatal(err)
+	}
+	// An older ticker is ignored
+	if err := ms.Apply(newTestTickerMessage("BTC-USDT", "1", "1", 1500)); err != nil {
+		t.Fatal(err)
+	}
+	sm := newTestDownstreamMessage(SnapshotTopicPrefix+"USDS", "trade.snapshot", 0)
+	sm.RawData = []byte(`{"sequence":"1","data":{"symbol":"BTC-USDT","buy":10,"sell":10.5,"lastTradedPrice":10.2,"high":13.5,"low":8,"vol":120.25,"changeRate":0.01,"datetime":3000}}`)
+	if err := ms.Apply(sm); err != nil {
+		t.Fatal(err)
+	}
+	tk := ms.Ticker("BTC-USDT")
+	if tk.BestBid != "10" || tk.BestAskSize != "2" || tk.Last != "10" || tk.Stats.High != "13.5" || tk.Stats.Vol != "120.25" || tk.StatsTime.UnixNano() != 3*int64(time.Second) {
+		t.Errorf("Unexpected ticker: %s", ToJsonString(tk))
+	}
+
+	if n := len(all.C()); n != 4 {
+		t.Errorf("Expected 4 changes, got %d", n)
+	}
+	// The buffer of 1 is full after the bootstrap
+	if tk := <-btc.C(); tk.BestBid != "9" || btc.Dropped() != 2 {
+		t.Errorf("Unexpected change %s with %d dropped", ToJsonString(tk), btc.Dropped())
+	}
+	btc.Close()
+	if _, ok := <-btc.C(); ok {
+		t.Error("Expected the channel closed")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	ms.Apply(newTestTickerMessage("ETH-USDT", "1", "2", 2000))
+	if s := ms.Stale(10 * time.Millisecond); len(s) != 1 || s[0] != "BTC-USDT" {
+		t.Errorf("Unexpected stale symbols: %v", s)
+	}
+	if sms := ms.SubscribeMessages(); len(sms) != 2 || sms[1].Topic != "/market/snapshot:USDS" {
+		t.Errorf("Unexpected subscriptions: %s", ToJsonString(sms))
+	}
+}
+
+func TestMarketSnapshot_ConcurrentReads(t *testing.T) {
+	ms := NewApiService().NewMarketSnapshot(MarketSnapshotOpts{})
+	// Nothing is closed before Start
+	if ms.Done() != nil {
+		t.Error("Expected a nil channel before Start")
+	}
+	ms.Stop()
+	symbols := []string{"A-USDT", "B-USDT", "C-USDT", "D-USDT"}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, s := range symbols {
+					if tk := ms.Ticker(s); tk != nil && tk.BestBid != tk.Last {
+						t.Errorf("Inconsistent ticker: %s", ToJsonString(tk))
+					}
+				}
+				ms.Tickers()
+			}
+		}()
+	}
+	for i := int64(1); i <= 200; i++ {
+		p := IntToString(i)
+		ms.Apply(newTestTickerMessage(symbols[i%4], p, p, i))
+	}
+	close(done)
+	wg.Wait()
+	if n := len(ms.Tickers()); n != 4 {
+		t.Errorf("Expected 4 symbols, got %d", n)
+	}
+}
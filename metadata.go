@@ -0,0 +1,463 @@
+package kucoin
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// A MetadataEventType is the type of a change of the metadata.
+type MetadataEventType string
+
+// The types of the changes of the metadata.
+const (
+	MetadataSymbolListed     MetadataEventType = "symbolListed"
+	MetadataSymbolDelisted   MetadataEventType = "symbolDelisted"
+	MetadataTradingEnabled   MetadataEventType = "tradingEnabled"
+	MetadataTradingDisabled  MetadataEventType = "tradingDisabled"
+	MetadataDepositEnabled   MetadataEventType = "depositEnabled"
+	MetadataDepositDisabled  MetadataEventType = "depositDisabled"
+	MetadataWithdrawEnabled  MetadataEventType = "withdrawEnabled"
+	MetadataWithdrawDisabled MetadataEventType = "withdrawDisabled"
+)
+
+// A MetadataEvent represents a change of a symbol, or of a chain of a currency.
+type MetadataEvent struct {
+	Type MetadataEventType `json:"type"`
+	// Symbol is set for the changes of the symbols.
+	Symbol string `json:"symbol,omitempty"`
+	// Margin reports whether the symbol is a margin symbol of MarginSymbolsV3.
+	Margin bool `json:"margin,omitempty"`
+	// Currency and Chain are set for the deposit and withdrawal changes.
+	Currency string `json:"currency,omitempty"`
+	Chain    string `json:"chain,omitempty"`
+}
+
+// All defaults of MetadataCacheOpts.
+const (
+	defaultMetadataRefreshInterval = 5 * time.Minute
+	defaultMetadataEventBuffer     = 256
+)
+
+// MetadataCacheOpts contains the options of a MetadataCache.
+type MetadataCacheOpts struct {
+	// Market filters the symbols of SymbolsV2, all markets by default.
+	Market string
+	// Margin loads the margin symbols of MarginSymbolsV3 too.
+	Margin bool
+	// RefreshInterval is the interval of the refreshes of Run, 5m by default.
+	RefreshInterval time.Duration
+	// EventBuffer is the capacity of the event channel, 256 by default.
+	// The events are dropped when it is full.
+	EventBuffer int
+}
+
+// metadataSnapshot is an immutable version of the metadata with its indexes.
+type metadataSnapshot struct {
+	symbols       map[string]*SymbolModelV2
+	byBase        map[string]SymbolsModelV2
+	byQuote       map[string]SymbolsModelV2
+	currencies    map[string]*CurrencyV3Model
+	byChain       map[string]CurrenciesV3Model
+	marginSymbols map[string]*MarginSymbolV3Model
+	// missing are the currencies queried by Currency and not found, until the next refresh
+	missing map[string]bool
+}
+
+// newMetadataSnapshot indexes the metadata.
+func newMetadataSnapshot(symbols SymbolsModelV2, currencies map[string]*CurrencyV3Model, margin []*MarginSymbolV3Model) *metadataSnapshot {
+	s := &metadataSnapshot{
+		symbols:       make(map[string]*SymbolModelV2, len(symbols)),
+		byBase:        make(map[string]SymbolsModelV2),
+		byQuote:       make(map[string]SymbolsModelV2),
+		currencies:    currencies,
+		byChain:       make(map[string]CurrenciesV3Model),
+		marginSymbols: make(map[string]*MarginSymbolV3Model, len(margin)),
+	}
+	for _, sm := range symbols {
+		s.symbols[sm.Symbol] = sm
+		s.byBase[sm.BaseCurrency] = append(s.byBase[sm.BaseCurrency], sm)
+		s.byQuote[sm.QuoteCurrency] = append(s.byQuote[sm.QuoteCurrency], sm)
+	}
+	for _, c := range currencies {
+		for _, ch := range c.Chains {
+			s.byChain[ch.ChainId] = append(s.byChain[ch.ChainId], c)
+		}
+	}
+	for _, cs := range s.byChain {
+		sort.Slice(cs, func(i, j int) bool { return cs[i].Currency < cs[j].Currency })
+	}
+	for _, m := range margin {
+		s.marginSymbols[m.Symbol] = m
+	}
+	return s
+}
+
+// A MetadataCache caches the symbols, the currencies with their chains and the margin symbols.
+// It loads them lazily on the first read, refreshes them by Run, and emits the changes found by a refresh.
+// The returned models are shared by all readers, they must not be modified.
+type MetadataCache struct {
+	as   *ApiService
+	opts MetadataCacheOpts
+
+	// Serializes the loads
+	loadMu sync.Mutex
+	mu     sync.RWMutex
+	snap   *metadataSnapshot
+
+	events  chan *MetadataEvent
+	dropped uint64
+}
+
+// NewMetadataCache creates an instance of MetadataCache.
+func (as *ApiService) NewMetadataCache(opts MetadataCacheOpts) *MetadataCache {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultMetadataRefreshInterval
+	}
+	if opts.EventBuffer <= 0 {
+		opts.EventBuffer = defaultMetadataEventBuffer
+	}
+	return &MetadataCache{
+		as:     as,
+		opts:   opts,
+		events: make(chan *MetadataEvent, opts.EventBuffer),
+	}
+}
+
+// Events returns the channel of the changes found by the refreshes.
+func (mc *MetadataCache) Events() <-chan *MetadataEvent {
+	return mc.events
+}
+
+// DroppedEvents returns the number of the events dropped as the channel was full.
+func (mc *MetadataCache) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&mc.dropped)
+}
+
+// snapshot returns the metadata, it loads them if they have never been loaded.
+func (mc *MetadataCache) snapshot(ctx context.Context) (*metadataSnapshot, error) {
+	mc.mu.RLock()
+	s := mc.snap
+	mc.mu.RUnlock()
+	if s != nil {
+		return s, nil
+	}
+
+	mc.loadMu.Lock()
+	defer mc.loadMu.Unlock()
+	// Loaded while waiting for the lock
+	mc.mu.RLock()
+	s = mc.snap
+	mc.mu.RUnlock()
+	if s != nil {
+		return s, nil
+	}
+	return mc.load(ctx)
+}
+
+// Refresh loads the metadata again, and emits the changes since the previous load.
+func (mc *MetadataCache) Refresh(ctx context.Context) error {
+	mc.loadMu.Lock()
+	defer mc.loadMu.Unlock()
+	_, err := mc.load(ctx)
+	return err
+}
+
+// load queries the metadata and replaces the snapshot, the caller must hold loadMu.
+func (mc *MetadataCache) load(ctx context.Context) (*metadataSnapshot, error) {
+	rsp, err := mc.as.SymbolsV2(ctx, mc.opts.Market)
+	if err != nil {
+		return nil, err
+	}
+	symbols := SymbolsModelV2{}
+	if err := rsp.ReadData(&symbols); err != nil {
+		return nil, err
+	}
+
+	rsp, err = mc.as.CurrenciesV3(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cs := CurrenciesV3Model{}
+	if err := rsp.ReadData(&cs); err != nil {
+		return nil, err
+	}
+	currencies := make(map[string]*CurrencyV3Model, len(cs))
+	for _, c := range cs {
+		currencies[c.Currency] = c
+	}
+
+	var margin []*MarginSymbolV3Model
+	if mc.opts.Margin {
+		rsp, err = mc.as.MarginSymbolsV3(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ms := &MarginSymbolsV3Model{}
+		if err := rsp.ReadData(ms); err != nil {
+			return nil, err
+		}
+		margin = ms.Items
+	}
+
+	s := newMetadataSnapshot(symbols, currencies, margin)
+	mc.mu.Lock()
+	old := mc.snap
+	mc.snap = s
+	mc.mu.Unlock()
+	if old != nil {
+		for _, e := range diffMetadata(old, s) {
+			mc.emit(e)
+		}
+	}
+	return s, nil
+}
+
+// emit sends the event without blocking.
+func (mc *MetadataCache) emit(e *MetadataEvent) {
+	select {
+	case mc.events <- e:
+	default:
+		atomic.AddUint64(&mc.dropped, 1)
+		if DebugMode {
+			logrus.Debugf("Drop a metadata event: %s", ToJsonString(e))
+		}
+	}
+}
+
+// diffMetadata returns the changes from a snapshot to the next one, sorted by symbol and currency.
+func diffMetadata(old, s *metadataSnapshot) []*MetadataEvent {
+	trading := func(symbols map[string]*SymbolModelV2) map[string]bool {
+		m := make(map[string]bool, len(symbols))
+		for k, v := range symbols {
+			m[k] = v.EnableTrading
+		}
+		return m
+	}
+	marginTrading := func(symbols map[string]*MarginSymbolV3Model) map[string]bool {
+		m := make(map[string]bool, len(symbols))
+		for k, v := range symbols {
+			m[k] = v.EnableTrading
+		}
+		return m
+	}
+	events := diffSymbols(trading(old.symbols), trading(s.symbols), false)
+	events = append(events, diffSymbols(marginTrading(old.marginSymbols), marginTrading(s.marginSymbols), true)...)
+
+	currencies := make([]string, 0, len(s.currencies))
+	for k := range s.currencies {
+		currencies = append(currencies, k)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		chains := make(map[string]CurrencyChainV3Model)
+		if o, ok := old.currencies[currency]; ok {
+			for _, ch := range o.Chains {
+				chains[ch.ChainId] = ch
+			}
+		}
+		for _, ch := range s.currencies[currency].Chains {
+			// A new chain is compared to a disabled one
+			was := chains[ch.ChainId]
+			for _, t := range []struct {
+				was, is           bool
+				enabled, disabled MetadataEventType
+			}{
+				{was.IsDepositEnabled, ch.IsDepositEnabled, MetadataDepositEnabled, MetadataDepositDisabled},
+				{was.IsWithdrawEnabled, ch.IsWithdrawEnabled, MetadataWithdrawEnabled, MetadataWithdrawDisabled},
+			} {
+				switch {
+				case t.was && !t.is:
+					events = append(events, &MetadataEvent{Type: t.disabled, Currency: currency, Chain: ch.ChainId})
+				case !t.was && t.is:
+					events = append(events, &MetadataEvent{Type: t.enabled, Currency: currency, Chain: ch.ChainId})
+				}
+			}
+		}
+	}
+	return events
+}
+
+// diffSymbols returns the listings, delistings and trading changes between the enableTrading flags of the symbols.
+func diffSymbols(old, cur map[string]bool, margin bool) []*MetadataEvent {
+	symbols := make([]string, 0, len(cur))
+	for k := range cur {
+		symbols = append(symbols, k)
+	}
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			symbols = append(symbols, k)
+		}
+	}
+	sort.Strings(symbols)
+
+	var events []*MetadataEvent
+	for _, symbol := range symbols {
+		was, listed := old[symbol]
+		is, ok := cur[symbol]
+		t := MetadataEventType("")
+		switch {
+		case !listed:
+			t = MetadataSymbolListed
+		case !ok:
+			t = MetadataSymbolDelisted
+		case was && !is:
+			t = MetadataTradingDisabled
+		case !was && is:
+			t = MetadataTradingEnabled
+		default:
+			continue
+		}
+		events = append(events, &MetadataEvent{Type: t, Symbol: symbol, Margin: margin})
+	}
+	return events
+}
+
+// Run refreshes the metadata every RefreshInterval until ctx is done.
+// A failed refresh is retried at the next interval.
+func (mc *MetadataCache) Run(ctx context.Context) {
+	t := time.NewTicker(mc.opts.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := mc.Refresh(ctx); err != nil && DebugMode {
+				logrus.Debugf("Refresh metadata failed, %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Symbol returns the symbol, or nil if it is unknown.
+func (mc *MetadataCache) Symbol(ctx context.Context, symbol string) (*SymbolModelV2, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.symbols[symbol], nil
+}
+
+// Symbols returns all symbols sorted by name.
+func (mc *MetadataCache) Symbols(ctx context.Context) (SymbolsModelV2, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l := make(SymbolsModelV2, 0, len(s.symbols))
+	for _, sm := range s.symbols {
+		l = append(l, sm)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Symbol < l[j].Symbol })
+	return l, nil
+}
+
+// SymbolsByBase returns the symbols of the base currency.
+func (mc *MetadataCache) SymbolsByBase(ctx context.Context, currency string) (SymbolsModelV2, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(SymbolsModelV2(nil), s.byBase[currency]...), nil
+}
+
+// SymbolsByQuote returns the symbols of the quote currency.
+func (mc *MetadataCache) SymbolsByQuote(ctx context.Context, currency string) (SymbolsModelV2, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(SymbolsModelV2(nil), s.byQuote[currency]...), nil
+}
+
+// MarginSymbol returns the margin symbol, or nil if it is unknown or Margin is off.
+func (mc *MetadataCache) MarginSymbol(ctx context.Context, symbol string) (*MarginSymbolV3Model, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.marginSymbols[symbol], nil
+}
+
+// Currency returns the currency. A currency missing from the cache is queried by CurrencyInfoV3,
+// e.g. one listed since the last refresh, and nil is returned if it does not exist.
+// A currency not found is not queried again until the next refresh.
+func (mc *MetadataCache) Currency(ctx context.Context, currency string) (*CurrencyV3Model, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := s.currencies[currency]; ok || s.missing[currency] {
+		return c, nil
+	}
+
+	rsp, err := mc.as.CurrencyInfoV3(ctx, currency)
+	if err != nil {
+		return nil, err
+	}
+	c := &CurrencyV3Model{}
+	if err := rsp.ReadData(c); err != nil {
+		return nil, errors.Errorf("Query currency %s failed, %s", currency, err.Error())
+	}
+	if c.Currency == "" {
+		c = nil
+	}
+
+	// Index the currency or the miss unless the snapshot has been replaced meanwhile
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.snap == s {
+		mc.snap = s.withCurrency(currency, c)
+	}
+	return c, nil
+}
+
+// withCurrency returns a copy of the snapshot indexing the currency, a nil one is indexed as missing.
+func (s *metadataSnapshot) withCurrency(currency string, c *CurrencyV3Model) *metadataSnapshot {
+	if c == nil {
+		n := *s
+		n.missing = make(map[string]bool, len(s.missing)+1)
+		for k := range s.missing {
+			n.missing[k] = true
+		}
+		n.missing[currency] = true
+		return &n
+	}
+	currencies := make(map[string]*CurrencyV3Model, len(s.currencies)+1)
+	for k, v := range s.currencies {
+		currencies[k] = v
+	}
+	currencies[c.Currency] = c
+	n := newMetadataSnapshot(nil, currencies, nil)
+	n.symbols, n.byBase, n.byQuote, n.marginSymbols, n.missing = s.symbols, s.byBase, s.byQuote, s.marginSymbols, s.missing
+	return n
+}
+
+// CurrenciesByChain returns the currencies supporting the chain of the id, e.g. trx, sorted by currency.
+func (mc *MetadataCache) CurrenciesByChain(ctx context.Context, chainId string) (CurrenciesV3Model, error) {
+	s, err := mc.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(CurrenciesV3Model(nil), s.byChain[chainId]...), nil
+}
+
+// Chain returns the chain of the id of the currency, or nil if the currency does not support it.
+func (mc *MetadataCache) Chain(ctx context.Context, currency, chainId string) (*CurrencyChainV3Model, error) {
+	c, err := mc.Currency(ctx, currency)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	for i := range c.Chains {
+		if c.Chains[i].ChainId == chainId {
+			return &c.Chains[i], nil
+		}
+	}
+	return nil, nil
+}
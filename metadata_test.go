@@ -0,0 +1,139 @@
+package kucoin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestMetadataCache_Refresh(t *testing.T) {
+	var mu sync.Mutex
+	symbols := SymbolsModelV2{
+		{Symbol: "KCS-USDT", BaseCurrency: "KCS", QuoteCurrency: "USDT", EnableTrading: true},
+		{Symbol: "KCS-BTC", BaseCurrency: "KCS", QuoteCurrency: "BTC", EnableTrading: true},
+		{Symbol: "OLD-USDT", BaseCurrency: "OLD", QuoteCurrency: "USDT", EnableTrading: true},
+	}
+	currencies := CurrenciesV3Model{
+		{Currency: "USDT", Chains: []CurrencyChainV3Model{
+			{ChainId: "trx", IsDepositEnabled: true, IsWithdrawEnabled: true},
+			{ChainId: "eth", IsDepositEnabled: true, IsWithdrawEnabled: true},
+		}},
+		{Currency: "KCS", Chains: []CurrencyChainV3Model{{ChainId: "eth", IsDepositEnabled: true}}},
+	}
+	margin := &MarginSymbolsV3Model{Items: []*MarginSymbolV3Model{{Symbol: "KCS-USDT", EnableTrading: true}}}
+
+	rr := newRouteRequester()
+	rr.handle(http.MethodGet, "/api/v2/symbols", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return symbols
+	})
+	rr.handle(http.MethodGet, "/api/v3/currencies/", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return currencies
+	})
+	rr.handle(http.MethodGet, "/api/v3/margin/symbols", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return margin
+	})
+	rr.handle(http.MethodGet, "/api/v3/currencies/NEW", func(r *Request) interface{} {
+		return &CurrencyV3Model{Currency: "NEW", Chains: []CurrencyChainV3Model{{ChainId: "trx", IsDepositEnabled: true}}}
+	})
+	rr.handle(http.MethodGet, "/api/v3/currencies/NONE", func(r *Request) interface{} {
+		return &CurrencyV3Model{}
+	})
+	mc := NewApiService(ApiRequesterOption(rr)).NewMetadataCache(MetadataCacheOpts{Margin: true})
+	ctx := context.Background()
+
+	// Loaded lazily once
+	if s, err := mc.Symbol(ctx, "KCS-USDT"); err != nil || s == nil || s.QuoteCurrency != "USDT" {
+		t.Fatalf("Unexpected symbol %s with error %v", ToJsonString(s), err)
+	}
+	if l, _ := mc.SymbolsByBase(ctx, "KCS"); len(l) != 2 {
+		t.Errorf("Expected 2 symbols of KCS, got %d", len(l))
+	}
+	if l, _ := mc.SymbolsByQuote(ctx, "USDT"); len(l) != 2 {
+		t.Errorf("Expected 2 symbols of USDT, got %d", len(l))
+	}
+	if l, _ := mc.CurrenciesByChain(ctx, "eth"); len(l) != 2 || l[0].Currency != "KCS" {
+		t.Errorf("Unexpected currencies of eth: %s", ToJsonString(l))
+	}
+	if m, _ := mc.MarginSymbol(ctx, "KCS-USDT"); m == nil || !m.EnableTrading {
+		t.Errorf("Unexpected margin symbol: %s", ToJsonString(m))
+	}
+	if rr.count(http.MethodGet, "/api/v2/symbols") != 1 {
+		t.Errorf("Expected 1 load, got %d", rr.count(http.MethodGet, "/api/v2/symbols"))
+	}
+
+	// A currency listed since the load is queried
+	if ch, err := mc.Chain(ctx, "NEW", "trx"); err != nil || ch == nil || !ch.IsDepositEnabled {
+		t.Errorf("Unexpected chain %s with error %v", ToJsonString(ch), err)
+	}
+	if l, _ := mc.CurrenciesByChain(ctx, "trx"); len(l) != 2 {
+		t.Errorf("Expected 2 currencies of trx, got %d", len(l))
+	}
+	mc.Currency(ctx, "NEW")
+	if n := rr.count(http.MethodGet, "/api/v3/currencies/NEW"); n != 1 {
+		t.Errorf("Expected 1 query of NEW, got %d", n)
+	}
+	// A currency not found is cached as missing
+	for i := 0; i < 2; i++ {
+		if ch, err := mc.Chain(ctx, "NONE", "trx"); err != nil || ch != nil {
+			t.Errorf("Unexpected chain %s with error %v", ToJsonString(ch), err)
+		}
+	}
+	if n := rr.count(http.MethodGet, "/api/v3/currencies/NONE"); n != 1 {
+		t.Errorf("Expected 1 query of NONE, got %d", n)
+	}
+
+	mu.Lock()
+	symbols = SymbolsModelV2{
+		{Symbol: "KCS-USDT", BaseCurrency: "KCS", QuoteCurrency: "USDT", EnableTrading: false},
+		{Symbol: "KCS-BTC", BaseCurrency: "KCS", QuoteCurrency: "BTC", EnableTrading: true},
+		{Symbol: "NEW-USDT", BaseCurrency: "NEW", QuoteCurrency: "USDT", EnableTrading: true},
+	}
+	currencies = CurrenciesV3Model{
+		{Currency: "USDT", Chains: []CurrencyChainV3Model{
+			{ChainId: "trx", IsDepositEnabled: true, IsWithdrawEnabled: false},
+			{ChainId: "eth", IsDepositEnabled: true, IsWithdrawEnabled: true},
+		}},
+		{Currency: "KCS", Chains: []CurrencyChainV3Model{{ChainId: "eth", IsDepositEnabled: true, IsWithdrawEnabled: true}}},
+	}
+	margin = &MarginSymbolsV3Model{}
+	mu.Unlock()
+	if err := mc.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*MetadataEvent
+	for len(mc.Events()) > 0 {
+		events = append(events, <-mc.Events())
+	}
+	want := []MetadataEvent{
+		{Type: MetadataTradingDisabled, Symbol: "KCS-USDT"},
+		{Type: MetadataSymbolListed, Symbol: "NEW-USDT"},
+		{Type: MetadataSymbolDelisted, Symbol: "OLD-USDT"},
+		{Type: MetadataSymbolDelisted, Symbol: "KCS-USDT", Margin: true},
+		{Type: MetadataWithdrawEnabled, Currency: "KCS", Chain: "eth"},
+		{Type: MetadataWithdrawDisabled, Currency: "USDT", Chain: "trx"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Unexpected events: %s", ToJsonString(events))
+	}
+	for i, e := range events {
+		if *e != want[i] {
+			t.Errorf("Expected the event %s, got %s", ToJsonString(want[i]), ToJsonString(e))
+		}
+	}
+	if s, _ := mc.Symbol(ctx, "OLD-USDT"); s != nil {
+		t.Error("Expected the delisted symbol removed")
+	}
+	// The misses are forgotten by a refresh
+	mc.Currency(ctx, "NONE")
+	if n := rr.count(http.MethodGet, "/api/v3/currencies/NONE"); n != 2 {
+		t.Errorf("Expected 2 queries of NONE, got %d", n)
+	}
+}
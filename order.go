@@ -45,6 +45,11 @@ type CreateOrderResultModel struct {
 
 // CreateOrder places a new order.
 func (as *ApiService) CreateOrder(ctx context.Context, o *CreateOrderModel) (*ApiResponse, error) {
+	if as.orderValidator != nil {
+		if err := as.orderValidator.ValidateCreateOrder(o); err != nil {
+			return nil, err
+		}
+	}
 	req := NewRequest(http.MethodPost, "/api/v1/orders", o)
 	return as.Call(ctx, req)
 }
@@ -277,6 +282,11 @@ func (as *ApiService) CancelStopOrderBy(ctx context.Context, params map[string]s
 
 // CreateMarginOrder places a new margin order.
 func (as *ApiService) CreateMarginOrder(ctx context.Context, o *CreateOrderModel) (*ApiResponse, error) {
+	if as.orderValidator != nil {
+		if err := as.orderValidator.ValidateCreateOrder(o); err != nil {
+			return nil, err
+		}
+	}
 	req := NewRequest(http.MethodPost, "/api/v1/margin/order", o)
 	return as.Call(ctx, req)
 }
@@ -0,0 +1,467 @@
+package kucoin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// An OrderState is a state of the lifecycle of an order.
+type OrderState string
+
+// The states of an order, an order moves forward only and stops in a terminal state.
+const (
+	OrderStateNew             OrderState = "new"
+	OrderStateOpen            OrderState = "open"
+	OrderStatePartiallyFilled OrderState = "partiallyFilled"
+	OrderStateFilled          OrderState = "filled"
+	OrderStateCancelled       OrderState = "cancelled"
+	OrderStateRejected        OrderState = "rejected"
+)
+
+// rank orders the states along the lifecycle, the terminal states have the same rank.
+func (s OrderState) rank() int {
+	switch s {
+	case OrderStateOpen:
+		return 1
+	case OrderStatePartiallyFilled:
+		return 2
+	case OrderStateFilled, OrderStateCancelled, OrderStateRejected:
+		return 3
+	}
+	return 0
+}
+
+// Terminal reports whether the order will not change any more.
+func (s OrderState) Terminal() bool {
+	return s.rank() == 3
+}
+
+// An OrderKind is the API an order has been placed with.
+type OrderKind string
+
+// The kinds of the tracked orders.
+const (
+	OrderKindSpot     OrderKind = "spot"
+	OrderKindHf       OrderKind = "hf"
+	OrderKindMarginV3 OrderKind = "marginV3"
+)
+
+// An OrderFill represents a fill of a tracked order.
+type OrderFill struct {
+	TradeId   string `json:"tradeId"`
+	Price     string `json:"price"`
+	Size      string `json:"size"`
+	Liquidity string `json:"liquidity"`
+	Ts        int64  `json:"ts"`
+}
+
+// A TrackedOrder is a snapshot of an order tracked by an OrderTracker.
+type TrackedOrder struct {
+	Kind         OrderKind    `json:"kind"`
+	ClientOid    string       `json:"clientOid"`
+	OrderId      string       `json:"orderId"`
+	Symbol       string       `json:"symbol"`
+	Side         string       `json:"side"`
+	Price        string       `json:"price"`
+	Size         string       `json:"size"`
+	FilledSize   string       `json:"filledSize"`
+	CanceledSize string       `json:"canceledSize"`
+	State        OrderState   `json:"state"`
+	Reason       string       `json:"reason,omitempty"`
+	Fills        []*OrderFill `json:"fills"`
+}
+
+// trackedOrder is the mutable state of an order, guarded by the lock of the tracker.
+type trackedOrder struct {
+	TrackedOrder
+	trades map[string]bool
+	done   chan struct{}
+}
+
+// snapshot copies the order, the caller must hold the lock.
+func (o *trackedOrder) snapshot() *TrackedOrder {
+	s := o.TrackedOrder
+	s.Fills = append([]*OrderFill(nil), o.Fills...)
+	return &s
+}
+
+// advance moves the order to the state if it is not behind the current one.
+// A terminal state is never left, the caller must hold the lock.
+func (o *trackedOrder) advance(s OrderState) {
+	if o.State.Terminal() || s.rank() < o.State.rank() {
+		return
+	}
+	o.State = s
+	if s.Terminal() {
+		close(o.done)
+	}
+}
+
+// fill records the filled size reported by an event, the filled size never decreases.
+func (o *trackedOrder) fill(size string) {
+	if size != "" && decimalCmp(size, o.FilledSize) > 0 {
+		o.FilledSize = size
+	}
+}
+
+// An OrderTracker tracks the lifecycle of the orders keyed by their client oids and order ids.
+// It merges the results of the REST API and the private orderChange events of WebSocket,
+// which may arrive in any order: the state of an order only moves forward, and the fills are deduplicated.
+type OrderTracker struct {
+	as        *ApiService
+	mu        sync.Mutex
+	orders    map[string]*trackedOrder
+	byOrderId map[string]*trackedOrder
+}
+
+// NewOrderTracker creates an instance of OrderTracker.
+func (as *ApiService) NewOrderTracker() *OrderTracker {
+	return &OrderTracker{
+		as:        as,
+		orders:    make(map[string]*trackedOrder),
+		byOrderId: make(map[string]*trackedOrder),
+	}
+}
+
+// Track registers a new order before placing it, it fails if the client oid is empty or tracked already.
+func (ot *OrderTracker) Track(kind OrderKind, clientOid, symbol, side, price, size string) error {
+	if clientOid == "" {
+		return errors.New("Empty clientOid")
+	}
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	if _, ok := ot.orders[clientOid]; ok {
+		return errors.Errorf("Duplicate clientOid %s", clientOid)
+	}
+	ot.orders[clientOid] = &trackedOrder{
+		TrackedOrder: TrackedOrder{Kind: kind, ClientOid: clientOid, Symbol: symbol, Side: side, Price: price, Size: size, State: OrderStateNew},
+		trades:       make(map[string]bool),
+		done:         make(chan struct{}),
+	}
+	return nil
+}
+
+// Placed links the order id returned by the REST API to the tracked client oid.
+func (ot *OrderTracker) Placed(clientOid, orderId string) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	ot.link(ot.orders[clientOid], orderId)
+}
+
+// Rejected marks the tracked order rejected by the REST API with the reason.
+func (ot *OrderTracker) Rejected(clientOid, reason string) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	if o, ok := ot.orders[clientOid]; ok && o.State == OrderStateNew {
+		o.Reason = reason
+		o.advance(OrderStateRejected)
+	}
+}
+
+// link indexes the order by the order id, the caller must hold the lock.
+func (ot *OrderTracker) link(o *trackedOrder, orderId string) {
+	if o == nil || orderId == "" {
+		return
+	}
+	o.OrderId = orderId
+	ot.byOrderId[orderId] = o
+}
+
+// lookup returns the order of the client oid or the order id, the caller must hold the lock.
+func (ot *OrderTracker) lookup(clientOid, orderId string) *trackedOrder {
+	if o, ok := ot.orders[clientOid]; ok {
+		return o
+	}
+	if o, ok := ot.byOrderId[orderId]; ok {
+		return o
+	}
+	return nil
+}
+
+// place reads the reply of the REST API placing the tracked order,
+// a failure replied by the API or an invalid order rejects the order.
+// The order stays new if the request failed without a reply, since it may have been placed.
+func (ot *OrderTracker) place(clientOid string, rsp *ApiResponse, err error, v interface{}) error {
+	if e, ok := err.(*OrderValidationError); ok {
+		ot.Rejected(clientOid, e.Error())
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := rsp.ReadData(v); err != nil {
+		if rsp.HttpSuccessful() && !rsp.ApiSuccessful() {
+			ot.Rejected(clientOid, rsp.Message)
+		}
+		return err
+	}
+	return nil
+}
+
+// CreateOrder tracks and places a classic order, the client oid is required.
+func (ot *OrderTracker) CreateOrder(ctx context.Context, o *CreateOrderModel) (*TrackedOrder, error) {
+	if err := ot.Track(OrderKindSpot, o.ClientOid, o.Symbol, o.Side, o.Price, o.Size); err != nil {
+		return nil, err
+	}
+	rsp, err := ot.as.CreateOrder(ctx, o)
+	r := &CreateOrderResultModel{}
+	if err := ot.place(o.ClientOid, rsp, err, r); err != nil {
+		return ot.Order(o.ClientOid), err
+	}
+	ot.Placed(o.ClientOid, r.OrderId)
+	return ot.Order(o.ClientOid), nil
+}
+
+// HfPlaceOrder tracks and places a HF order, the clientOid parameter is required.
+func (ot *OrderTracker) HfPlaceOrder(ctx context.Context, params map[string]string) (*TrackedOrder, error) {
+	clientOid := params["clientOid"]
+	if err := ot.Track(OrderKindHf, clientOid, params["symbol"], params["side"], params["price"], params["size"]); err != nil {
+		return nil, err
+	}
+	rsp, err := ot.as.HfPlaceOrder(ctx, params)
+	r := &HfPlaceOrderRes{}
+	if err := ot.place(clientOid, rsp, err, r); err != nil {
+		return ot.Order(clientOid), err
+	}
+	ot.Placed(clientOid, r.OrderId)
+	return ot.Order(clientOid), nil
+}
+
+// HfSyncPlaceOrder tracks and places a HF order, and applies the result of the matching.
+// The clientOid parameter is required.
+func (ot *OrderTracker) HfSyncPlaceOrder(ctx context.Context, params map[string]string) (*TrackedOrder, error) {
+	clientOid := params["clientOid"]
+	if err := ot.Track(OrderKindHf, clientOid, params["symbol"], params["side"], params["price"], params["size"]); err != nil {
+		return nil, err
+	}
+	rsp, err := ot.as.HfSyncPlaceOrder(ctx, params)
+	r := &HfSyncPlaceOrderRes{}
+	if err := ot.place(clientOid, rsp, err, r); err != nil {
+		return ot.Order(clientOid), err
+	}
+	if r.ClientOid == "" {
+		r.ClientOid = clientOid
+	}
+	ot.ApplySyncPlaceResult(r)
+	return ot.Order(clientOid), nil
+}
+
+// HfCreateMarinOrderV3 tracks and places a HF margin order, the client oid is required.
+func (ot *OrderTracker) HfCreateMarinOrderV3(ctx context.Context, p *HfMarginOrderV3Req) (*TrackedOrder, error) {
+	if err := ot.Track(OrderKindMarginV3, p.ClientOid, p.Symbol, p.Side, p.Price, p.Size); err != nil {
+		return nil, err
+	}
+	rsp, err := ot.as.HfCreateMarinOrderV3(ctx, p)
+	// The order id is replied as orderId
+	r := &struct {
+		HfMarginOrderV3Resp
+		OrderId string `json:"orderId"`
+	}{}
+	if err := ot.place(p.ClientOid, rsp, err, r); err != nil {
+		return ot.Order(p.ClientOid), err
+	}
+	if r.OrderId == "" {
+		r.OrderId = r.OrderNo
+	}
+	ot.Placed(p.ClientOid, r.OrderId)
+	return ot.Order(p.ClientOid), nil
+}
+
+// ApplySyncPlaceResult applies the result of HfSyncPlaceOrder to the tracked order.
+func (ot *OrderTracker) ApplySyncPlaceResult(r *HfSyncPlaceOrderRes) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	o := ot.lookup(r.ClientOid, r.OrderId)
+	if o == nil {
+		return
+	}
+	ot.link(o, r.OrderId)
+	if o.Size == "" {
+		o.Size = r.OriginSize
+	}
+	o.fill(r.DealSize)
+	if r.CanceledSize != "" {
+		o.CanceledSize = r.CanceledSize
+	}
+	o.advance(orderStateOf(r.Status == "done", decimalCmp(r.CanceledSize, "0") > 0, r.DealSize))
+}
+
+// ApplyHfOrder applies the detail of a HF order to the tracked order.
+func (ot *OrderTracker) ApplyHfOrder(r *HfOrderModel) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	o := ot.lookup(r.ClientOid, r.Id)
+	if o == nil {
+		return
+	}
+	ot.link(o, r.Id)
+	if o.Size == "" {
+		o.Size = r.Size
+	}
+	o.fill(r.DealSize)
+	if r.CancelledSize != "" {
+		o.CanceledSize = r.CancelledSize
+	}
+	o.advance(orderStateOf(!r.Active, r.CancelExist || decimalCmp(r.CancelledSize, "0") > 0, r.DealSize))
+}
+
+// ApplyOrder applies the detail of a classic order to the tracked order.
+func (ot *OrderTracker) ApplyOrder(r *OrderModel) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	o := ot.lookup(r.ClientOid, r.Id)
+	if o == nil {
+		return
+	}
+	ot.link(o, r.Id)
+	if o.Size == "" {
+		o.Size = r.Size
+	}
+	o.fill(r.DealSize)
+	o.advance(orderStateOf(!r.IsActive, r.CancelExist, r.DealSize))
+}
+
+// orderStateOf returns the state of an order reported by the REST API.
+// A done order is filled unless it has been cancelled or nothing has been filled.
+func orderStateOf(done, cancelled bool, dealSize string) OrderState {
+	filled := decimalCmp(dealSize, "0") > 0
+	switch {
+	case done && (cancelled || !filled):
+		return OrderStateCancelled
+	case done:
+		return OrderStateFilled
+	case filled:
+		return OrderStatePartiallyFilled
+	}
+	return OrderStateOpen
+}
+
+// Apply applies a private orderChange message, the other messages are ignored.
+func (ot *OrderTracker) Apply(m *WebSocketDownstreamMessage) error {
+	if m.Topic != PrivateOrderTopic || m.Subject != OrderChangeSubject {
+		return nil
+	}
+	e := &PrivateOrderChangeModel{}
+	if err := m.ReadData(e); err != nil {
+		return err
+	}
+	ot.ApplyEvent(e)
+	return nil
+}
+
+// ApplyEvent applies an orderChange event to the tracked order, the events of the untracked orders are ignored.
+func (ot *OrderTracker) ApplyEvent(e *PrivateOrderChangeModel) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	o := ot.lookup(e.ClientOid, e.OrderId)
+	if o == nil {
+		return
+	}
+	ot.link(o, e.OrderId)
+	if o.Symbol == "" {
+		o.Symbol = e.Symbol
+	}
+	if o.Side == "" {
+		o.Side = e.Side
+	}
+	if o.Price == "" {
+		o.Price = e.Price
+	}
+	// An update event changes the size of the order
+	if e.Size != "" && (o.Size == "" || e.Type == "update") {
+		o.Size = e.Size
+	}
+	if e.CanceledSize != "" {
+		o.CanceledSize = e.CanceledSize
+	}
+	if e.TradeId != "" && !o.trades[e.TradeId] {
+		o.trades[e.TradeId] = true
+		ts, _ := e.Ts.Int64()
+		o.Fills = append(o.Fills, &OrderFill{TradeId: e.TradeId, Price: e.MatchPrice, Size: e.MatchSize, Liquidity: e.Liquidity, Ts: ts})
+		total := "0"
+		for _, f := range o.Fills {
+			total = decimalAdd(total, f.Size)
+		}
+		o.fill(total)
+	}
+	o.fill(e.FilledSize)
+
+	switch e.Type {
+	case "received":
+		o.advance(OrderStateNew)
+	case "open":
+		o.advance(OrderStateOpen)
+	case "match":
+		o.advance(OrderStatePartiallyFilled)
+		if e.RemainSize != "" && decimalCmp(e.RemainSize, "0") == 0 {
+			o.advance(OrderStateFilled)
+		}
+	case "filled":
+		o.advance(OrderStateFilled)
+	case "canceled":
+		o.advance(OrderStateCancelled)
+	}
+}
+
+// Run applies the messages until messages is closed or ctx is done.
+func (ot *OrderTracker) Run(ctx context.Context, messages <-chan *WebSocketDownstreamMessage) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if err := ot.Apply(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Order returns a snapshot of the order of the client oid or the order id, or nil if it is not tracked.
+func (ot *OrderTracker) Order(id string) *TrackedOrder {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	if o := ot.lookup(id, id); o != nil {
+		return o.snapshot()
+	}
+	return nil
+}
+
+// Fills returns the fills of the order of the client oid or the order id in the order they were received.
+func (ot *OrderTracker) Fills(id string) []*OrderFill {
+	if o := ot.Order(id); o != nil {
+		return o.Fills
+	}
+	return nil
+}
+
+// Wait waits for the order of the client oid or the order id to reach a terminal state until ctx is done.
+func (ot *OrderTracker) Wait(ctx context.Context, id string) (*TrackedOrder, error) {
+	ot.mu.Lock()
+	o := ot.lookup(id, id)
+	ot.mu.Unlock()
+	if o == nil {
+		return nil, errors.Errorf("Unknown order %s", id)
+	}
+	select {
+	case <-o.done:
+		return ot.Order(id), nil
+	case <-ctx.Done():
+		return ot.Order(id), errors.Errorf("Wait order %s failed, %s", id, ctx.Err())
+	}
+}
+
+// Forget stops tracking the order of the client oid or the order id.
+func (ot *OrderTracker) Forget(id string) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	if o := ot.lookup(id, id); o != nil {
+		delete(ot.orders, o.ClientOid)
+		delete(ot.byOrderId, o.OrderId)
+	}
+}
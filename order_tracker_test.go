@@ -0,0 +1,145 @@
+package kucoin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOrderTracker_OutOfOrderEvents(t *testing.T) {
+	rr := newRouteRequester()
+	var ot *OrderTracker
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		// The WebSocket events may arrive before the REST reply
+		ot.ApplyEvent(&PrivateOrderChangeModel{ClientOid: "c1", OrderId: "o1", Type: "open", Status: "open"})
+		return &HfPlaceOrderRes{OrderId: "o1", ClientOid: "c1", Success: true}
+	})
+	ot = NewApiService(ApiRequesterOption(rr)).NewOrderTracker()
+
+	o, err := ot.HfPlaceOrder(context.Background(), map[string]string{"clientOid": "c1", "symbol": "KCS-USDT", "side": "buy", "price": "1", "size": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.OrderId != "o1" || o.State != OrderStateOpen {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+
+	waited := make(chan *TrackedOrder)
+	go func() {
+		o, err := ot.Wait(context.Background(), "o1")
+		if err != nil {
+			t.Error(err)
+		}
+		waited <- o
+	}()
+
+	events := []*PrivateOrderChangeModel{
+		{OrderId: "o1", Type: "match", Status: "match", TradeId: "t2", MatchPrice: "1", MatchSize: "2", RemainSize: "0", FilledSize: "3", Ts: "2"},
+		{OrderId: "o1", Type: "received", Status: "new"},
+		{OrderId: "o1", Type: "match", Status: "match", TradeId: "t1", MatchPrice: "1", MatchSize: "1", RemainSize: "2", FilledSize: "1", Ts: "1"},
+		{OrderId: "o1", Type: "match", Status: "match", TradeId: "t1", MatchPrice: "1", MatchSize: "1", RemainSize: "2", FilledSize: "1", Ts: "1"},
+		{OrderId: "o1", Type: "canceled", Status: "done"},
+		{OrderId: "o2", Type: "open", Status: "open"},
+	}
+	for _, e := range events {
+		if err := ot.Apply(newTestOrderChange(e)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case o := <-waited:
+		if o.State != OrderStateFilled || o.FilledSize != "3" || len(o.Fills) != 2 {
+			t.Errorf("Unexpected order: %s", ToJsonString(o))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait the terminal state timeout")
+	}
+	if fs := ot.Fills("c1"); len(fs) != 2 || fs[0].TradeId != "t2" || fs[1].Size != "1" {
+		t.Errorf("Unexpected fills: %s", ToJsonString(fs))
+	}
+	if ot.Order("o2") != nil {
+		t.Error("Expected the untracked order ignored")
+	}
+}
+
+func TestOrderTracker_RestResults(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/hf/orders/sync", func(r *Request) interface{} {
+		return &HfSyncPlaceOrderRes{OrderId: "o1", ClientOid: "c1", OriginSize: "2", DealSize: "1", RemainSize: "1", Status: "open"}
+	})
+	rr.handle(http.MethodPost, "/api/v3/hf/margin/order", func(r *Request) interface{} {
+		return &routeFailure{code: "400100", message: "Balance insufficient"}
+	})
+	rr.handle(http.MethodPost, "/api/v1/orders", func(r *Request) interface{} {
+		return &CreateOrderResultModel{OrderId: "o3"}
+	})
+	ot := NewApiService(ApiRequesterOption(rr)).NewOrderTracker()
+	ctx := context.Background()
+
+	o, err := ot.HfSyncPlaceOrder(ctx, map[string]string{"clientOid": "c1", "symbol": "KCS-USDT", "side": "buy", "price": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.State != OrderStatePartiallyFilled || o.Size != "2" || o.FilledSize != "1" {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+	// A stale detail does not move the order backward
+	ot.ApplyHfOrder(&HfOrderModel{Id: "o1", Active: true, DealSize: "0"})
+	if o := ot.Order("o1"); o.State != OrderStatePartiallyFilled || o.FilledSize != "1" {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+	ot.ApplyHfOrder(&HfOrderModel{Id: "o1", Active: false, DealSize: "1", CancelledSize: "1", CancelExist: true})
+	if o := ot.Order("c1"); o.State != OrderStateCancelled || o.CanceledSize != "1" {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+
+	o, err = ot.HfCreateMarinOrderV3(ctx, &HfMarginOrderV3Req{ClientOid: "c2", Symbol: "KCS-USDT", Side: "buy", Size: "1"})
+	if err == nil || o.State != OrderStateRejected || o.Reason != "Balance insufficient" {
+		t.Errorf("Unexpected order %s with error %v", ToJsonString(o), err)
+	}
+	if o, err := ot.Wait(ctx, "c2"); err != nil || o.State != OrderStateRejected {
+		t.Errorf("Unexpected order %s with error %v", ToJsonString(o), err)
+	}
+
+	o, err = ot.CreateOrder(ctx, &CreateOrderModel{ClientOid: "c3", Symbol: "KCS-USDT", Side: "sell", Size: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Kind != OrderKindSpot || o.OrderId != "o3" || o.State != OrderStateNew {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+	if _, err := ot.CreateOrder(ctx, &CreateOrderModel{ClientOid: "c3"}); err == nil {
+		t.Error("Expected an error of the duplicate clientOid")
+	}
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := ot.Wait(wctx, "o3"); err == nil {
+		t.Error("Expected an error of the open order")
+	}
+
+	ot.Forget("o3")
+	if ot.Order("c3") != nil || ot.Order("o3") != nil {
+		t.Error("Expected the order forgotten")
+	}
+}
+
+func TestOrderTracker_HfMarginOrderId(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v3/hf/margin/order", func(r *Request) interface{} {
+		return map[string]string{"orderId": "m1", "clientOid": "c1"}
+	})
+	ot := NewApiService(ApiRequesterOption(rr)).NewOrderTracker()
+	o, err := ot.HfCreateMarinOrderV3(context.Background(), &HfMarginOrderV3Req{ClientOid: "c1", Symbol: "KCS-USDT", Side: "buy", Price: "1", Size: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.OrderId != "m1" || o.State != OrderStateNew {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+	// The events keyed by the order id only are matched
+	ot.ApplyHfOrder(&HfOrderModel{Id: "m1", Active: true, DealSize: "1"})
+	if o := ot.Order("c1"); o.State != OrderStatePartiallyFilled || o.FilledSize != "1" {
+		t.Errorf("Unexpected order: %s", ToJsonString(o))
+	}
+}
@@ -0,0 +1,278 @@
+package kucoin
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A RoundingMode is the direction a price, size or funds is rounded to a legal tick.
+type RoundingMode int
+
+// The rounding modes of an OrderValidator.
+const (
+	// RoundDown rounds to the lower tick.
+	RoundDown RoundingMode = iota
+	// RoundUp rounds to the upper tick.
+	RoundUp
+	// RoundNearest rounds to the nearest tick, half up.
+	RoundNearest
+	// RoundPassive rounds away from the market, i.e. down for a buy and up for a sell.
+	RoundPassive
+	// RoundReject rejects a value off the tick instead of rounding it.
+	RoundReject
+)
+
+// direction returns the direction of decimalRound for the side.
+func (m RoundingMode) direction(side string) int {
+	switch m {
+	case RoundUp:
+		return 1
+	case RoundNearest:
+		return 0
+	case RoundPassive:
+		if side == "sell" {
+			return 1
+		}
+	}
+	return -1
+}
+
+// The rules checked by an OrderValidator.
+const (
+	OrderRuleSymbol         = "symbol"
+	OrderRuleEnableTrading  = "enableTrading"
+	OrderRuleRequired       = "required"
+	OrderRulePriceIncrement = "priceIncrement"
+	OrderRuleBaseIncrement  = "baseIncrement"
+	OrderRuleQuoteIncrement = "quoteIncrement"
+	OrderRuleBaseMinSize    = "baseMinSize"
+	OrderRuleBaseMaxSize    = "baseMaxSize"
+	OrderRuleQuoteMinSize   = "quoteMinSize"
+	OrderRuleQuoteMaxSize   = "quoteMaxSize"
+	OrderRuleMinFunds       = "minFunds"
+	OrderRulePriceLimitRate = "priceLimitRate"
+)
+
+// An OrderValidationError represents an order violating a rule of its symbol.
+type OrderValidationError struct {
+	Symbol string `json:"symbol"`
+	// Field is the field of the order: price, size or funds.
+	Field string `json:"field"`
+	// Rule is the violated rule, e.g. OrderRuleBaseMinSize.
+	Rule  string `json:"rule"`
+	Value string `json:"value"`
+	// Limit is the value of the rule.
+	Limit string `json:"limit"`
+}
+
+// Error implements error.
+func (e *OrderValidationError) Error() string {
+	if e.Limit == "" {
+		return fmt.Sprintf("Invalid order of %s, %s %s violates %s", e.Symbol, e.Field, e.Value, e.Rule)
+	}
+	return fmt.Sprintf("Invalid order of %s, %s %s violates %s %s", e.Symbol, e.Field, e.Value, e.Rule, e.Limit)
+}
+
+// OrderValidatorOpts contains the options of an OrderValidator.
+type OrderValidatorOpts struct {
+	// PriceRounding rounds the price to PriceIncrement, RoundDown by default.
+	PriceRounding RoundingMode
+	// SizeRounding rounds the size to BaseIncrement, RoundDown by default.
+	SizeRounding RoundingMode
+	// FundsRounding rounds the funds to QuoteIncrement, RoundDown by default.
+	FundsRounding RoundingMode
+	// ReferencePrice returns the price PriceLimitRate applies to, e.g. the last traded price.
+	// The rate is not checked if it is nil or returns an empty string.
+	ReferencePrice func(symbol string) string
+}
+
+// An OrderParams represents the fields of an order checked by an OrderValidator.
+type OrderParams struct {
+	Symbol string
+	Side   string
+	// Type is limit or market, limit by default.
+	Type  string
+	Price string
+	Size  string
+	Funds string
+}
+
+// An OrderValidator checks the orders against the rules of their symbols before sending them,
+// and rounds the prices, sizes and funds to legal ticks. It works without the network.
+type OrderValidator struct {
+	opts    OrderValidatorOpts
+	mu      sync.RWMutex
+	symbols map[string]*SymbolModelV2
+}
+
+// NewOrderValidator creates an instance of OrderValidator with the rules of the symbols.
+func NewOrderValidator(symbols SymbolsModelV2, opts OrderValidatorOpts) *OrderValidator {
+	v := &OrderValidator{opts: opts}
+	v.SetSymbols(symbols)
+	return v
+}
+
+// SetSymbols replaces the rules of the symbols.
+func (v *OrderValidator) SetSymbols(symbols SymbolsModelV2) {
+	m := make(map[string]*SymbolModelV2, len(symbols))
+	for _, s := range symbols {
+		m[s.Symbol] = s
+	}
+	v.mu.Lock()
+	v.symbols = m
+	v.mu.Unlock()
+}
+
+// Symbol returns the rules of the symbol, or nil if it is unknown.
+func (v *OrderValidator) Symbol(symbol string) *SymbolModelV2 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.symbols[symbol]
+}
+
+// Validate rounds the price, size and funds of the order in place, then checks the rules of its symbol.
+// It returns an *OrderValidationError if a rule is violated.
+func (v *OrderValidator) Validate(p *OrderParams) error {
+	s := v.Symbol(p.Symbol)
+	if s == nil {
+		return &OrderValidationError{Symbol: p.Symbol, Field: "symbol", Rule: OrderRuleSymbol, Value: p.Symbol}
+	}
+	if !s.EnableTrading {
+		return &OrderValidationError{Symbol: p.Symbol, Field: "symbol", Rule: OrderRuleEnableTrading, Value: p.Symbol}
+	}
+
+	var err error
+	if p.Type == "" || p.Type == "limit" {
+		if p.Price, err = v.round(s, "price", p.Price, s.PriceIncrement, OrderRulePriceIncrement, v.opts.PriceRounding, p.Side); err != nil {
+			return err
+		}
+		if err := v.checkPriceLimit(s, p); err != nil {
+			return err
+		}
+	}
+	if p.Size != "" || p.Funds == "" {
+		if p.Size, err = v.round(s, "size", p.Size, s.BaseIncrement, OrderRuleBaseIncrement, v.opts.SizeRounding, p.Side); err != nil {
+			return err
+		}
+		if err := checkRange(s, "size", p.Size, s.BaseMinSize, OrderRuleBaseMinSize, s.BaseMaxSize, OrderRuleBaseMaxSize); err != nil {
+			return err
+		}
+		if p.Price != "" {
+			if err := checkMinFunds(s, "size", p.Size, decimalMul(p.Price, p.Size)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// A market order by funds
+	if p.Funds, err = v.round(s, "funds", p.Funds, s.QuoteIncrement, OrderRuleQuoteIncrement, v.opts.FundsRounding, p.Side); err != nil {
+		return err
+	}
+	if err := checkRange(s, "funds", p.Funds, s.QuoteMinSize, OrderRuleQuoteMinSize, s.QuoteMaxSize, OrderRuleQuoteMaxSize); err != nil {
+		return err
+	}
+	return checkMinFunds(s, "funds", p.Funds, p.Funds)
+}
+
+// round rounds the value of the field to the increment with the mode.
+func (v *OrderValidator) round(s *SymbolModelV2, field, value, increment, rule string, mode RoundingMode, side string) (string, error) {
+	if value == "" || decimalCmp(value, "0") <= 0 {
+		return value, &OrderValidationError{Symbol: s.Symbol, Field: field, Rule: OrderRuleRequired, Value: value}
+	}
+	r := decimalRound(value, increment, mode.direction(side))
+	if mode == RoundReject && decimalCmp(r, value) != 0 {
+		return value, &OrderValidationError{Symbol: s.Symbol, Field: field, Rule: rule, Value: value, Limit: increment}
+	}
+	if decimalCmp(r, "0") <= 0 {
+		return value, &OrderValidationError{Symbol: s.Symbol, Field: field, Rule: rule, Value: value, Limit: increment}
+	}
+	return r, nil
+}
+
+// checkPriceLimit checks the price is within PriceLimitRate of the reference price:
+// a buy at most ref * (1 + rate), a sell at least ref * (1 - rate).
+func (v *OrderValidator) checkPriceLimit(s *SymbolModelV2, p *OrderParams) error {
+	if v.opts.ReferencePrice == nil || decimalCmp(s.PriceLimitRate, "0") <= 0 {
+		return nil
+	}
+	ref := v.opts.ReferencePrice(s.Symbol)
+	if ref == "" {
+		return nil
+	}
+	if p.Side == "sell" {
+		limit := decimalMul(ref, decimalSub("1", s.PriceLimitRate))
+		if decimalCmp(p.Price, limit) < 0 {
+			return &OrderValidationError{Symbol: s.Symbol, Field: "price", Rule: OrderRulePriceLimitRate, Value: p.Price, Limit: limit}
+		}
+		return nil
+	}
+	limit := decimalMul(ref, decimalAdd("1", s.PriceLimitRate))
+	if decimalCmp(p.Price, limit) > 0 {
+		return &OrderValidationError{Symbol: s.Symbol, Field: "price", Rule: OrderRulePriceLimitRate, Value: p.Price, Limit: limit}
+	}
+	return nil
+}
+
+// checkRange checks the value of the field is within the min and max, an empty bound is not checked.
+func checkRange(s *SymbolModelV2, field, value, min, minRule, max, maxRule string) error {
+	if min != "" && decimalCmp(value, min) < 0 {
+		return &OrderValidationError{Symbol: s.Symbol, Field: field, Rule: minRule, Value: value, Limit: min}
+	}
+	if max != "" && decimalCmp(max, "0") > 0 && decimalCmp(value, max) > 0 {
+		return &OrderValidationError{Symbol: s.Symbol, Field: field, Rule: maxRule, Value: value, Limit: max}
+	}
+	return nil
+}
+
+// checkMinFunds checks the notional of the order is at least MinFunds.
+func checkMinFunds(s *SymbolModelV2, field, value, notional string) error {
+	if s.MinFunds != "" && decimalCmp(notional, s.MinFunds) < 0 {
+		return &OrderValidationError{Symbol: s.Symbol, Field: field, Rule: OrderRuleMinFunds, Value: value, Limit: s.MinFunds}
+	}
+	return nil
+}
+
+// ValidateCreateOrder validates a classic or margin order, and rounds it in place.
+// A stop order is validated like a limit or market order.
+func (v *OrderValidator) ValidateCreateOrder(o *CreateOrderModel) error {
+	p := &OrderParams{Symbol: o.Symbol, Side: o.Side, Type: o.Type, Price: o.Price, Size: o.Size, Funds: o.Funds}
+	if err := v.Validate(p); err != nil {
+		return err
+	}
+	o.Price, o.Size, o.Funds = p.Price, p.Size, p.Funds
+	return nil
+}
+
+// ValidateHfPlaceOrder validates the parameters of a HF order, and rounds them in place.
+func (v *OrderValidator) ValidateHfPlaceOrder(params map[string]string) error {
+	p := &OrderParams{Symbol: params["symbol"], Side: params["side"], Type: params["type"], Price: params["price"], Size: params["size"], Funds: params["funds"]}
+	if err := v.Validate(p); err != nil {
+		return err
+	}
+	for k, f := range map[string]string{"price": p.Price, "size": p.Size, "funds": p.Funds} {
+		if f != "" {
+			params[k] = f
+		}
+	}
+	return nil
+}
+
+// ValidateHfMarginOrderV3 validates a HF margin order, and rounds it in place.
+func (v *OrderValidator) ValidateHfMarginOrderV3(o *HfMarginOrderV3Req) error {
+	p := &OrderParams{Symbol: o.Symbol, Side: o.Side, Type: o.Type, Price: o.Price, Size: o.Size, Funds: o.Funds}
+	if err := v.Validate(p); err != nil {
+		return err
+	}
+	o.Price, o.Size, o.Funds = p.Price, p.Size, p.Funds
+	return nil
+}
+
+// ApiOrderValidatorOption creates a instance of ApiServiceOption about the order validator.
+// CreateOrder, CreateMarginOrder, HfPlaceOrder, HfSyncPlaceOrder and HfCreateMarinOrderV3
+// validate and round the orders in place before sending them.
+func ApiOrderValidatorOption(v *OrderValidator) ApiServiceOption {
+	return func(service *ApiService) {
+		service.orderValidator = v
+	}
+}
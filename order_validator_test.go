@@ -0,0 +1,112 @@
+package kucoin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func newTestSymbols() SymbolsModelV2 {
+	return SymbolsModelV2{
+		{Symbol: "KCS-USDT", BaseMinSize: "0.01", BaseMaxSize: "10000", BaseIncrement: "0.01", QuoteMinSize: "0.1", QuoteMaxSize: "99999", QuoteIncrement: "0.001", PriceIncrement: "0.005", PriceLimitRate: "0.1", MinFunds: "1", EnableTrading: true},
+		{Symbol: "OLD-USDT", EnableTrading: false},
+	}
+}
+
+func TestDecimalRound(t *testing.T) {
+	for _, c := range []struct {
+		v, inc    string
+		direction int
+		want      string
+	}{
+		{"1.2345", "0.01", -1, "1.23"},
+		{"1.2345", "0.01", 1, "1.24"},
+		{"1.235", "0.01", 0, "1.24"},
+		{"1.234", "0.01", 0, "1.23"},
+		{"1.23", "0.01", 1, "1.23"},
+		{"7.3", "0.5", -1, "7"},
+		{"7.3", "0.5", 1, "7.5"},
+		{"12", "5", 0, "10"},
+		{"1.2345", "", -1, "1.2345"},
+	} {
+		if r := decimalRound(c.v, c.inc, c.direction); r != c.want {
+			t.Errorf("Round %s by %s to %d: expected %s, got %s", c.v, c.inc, c.direction, c.want, r)
+		}
+	}
+}
+
+func TestOrderValidator_Validate(t *testing.T) {
+	v := NewOrderValidator(newTestSymbols(), OrderValidatorOpts{
+		PriceRounding:  RoundPassive,
+		ReferencePrice: func(symbol string) string { return "10" },
+	})
+
+	p := &OrderParams{Symbol: "KCS-USDT", Side: "sell", Price: "10.0012", Size: "0.123"}
+	if err := v.Validate(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Price != "10.005" || p.Size != "0.12" {
+		t.Errorf("Unexpected rounded order: %+v", p)
+	}
+	p = &OrderParams{Symbol: "KCS-USDT", Side: "buy", Price: "10.0012", Size: "1"}
+	if err := v.Validate(p); err != nil || p.Price != "10" {
+		t.Errorf("Unexpected rounded order %+v with error %v", p, err)
+	}
+	p = &OrderParams{Symbol: "KCS-USDT", Side: "buy", Type: "market", Funds: "5.0009"}
+	if err := v.Validate(p); err != nil || p.Funds != "5" {
+		t.Errorf("Unexpected rounded order %+v with error %v", p, err)
+	}
+
+	for _, c := range []struct {
+		p    *OrderParams
+		rule string
+	}{
+		{&OrderParams{Symbol: "BTC-USDT", Price: "1", Size: "1"}, OrderRuleSymbol},
+		{&OrderParams{Symbol: "OLD-USDT", Price: "1", Size: "1"}, OrderRuleEnableTrading},
+		{&OrderParams{Symbol: "KCS-USDT", Size: "1"}, OrderRuleRequired},
+		{&OrderParams{Symbol: "KCS-USDT", Price: "10", Size: "0.001"}, OrderRuleBaseIncrement},
+		{&OrderParams{Symbol: "KCS-USDT", Price: "10", Size: "20000"}, OrderRuleBaseMaxSize},
+		{&OrderParams{Symbol: "KCS-USDT", Price: "10", Size: "0.05"}, OrderRuleMinFunds},
+		{&OrderParams{Symbol: "KCS-USDT", Side: "buy", Price: "11.5", Size: "1"}, OrderRulePriceLimitRate},
+		{&OrderParams{Symbol: "KCS-USDT", Side: "sell", Price: "8.5", Size: "1"}, OrderRulePriceLimitRate},
+		{&OrderParams{Symbol: "KCS-USDT", Type: "market", Funds: "0.05"}, OrderRuleQuoteMinSize},
+		{&OrderParams{Symbol: "KCS-USDT", Type: "market", Funds: "0.5"}, OrderRuleMinFunds},
+	} {
+		err := v.Validate(c.p)
+		e, ok := err.(*OrderValidationError)
+		if !ok || e.Rule != c.rule {
+			t.Errorf("Expected the rule %s violated by %+v, got %v", c.rule, c.p, err)
+		}
+	}
+
+	r := NewOrderValidator(newTestSymbols(), OrderValidatorOpts{SizeRounding: RoundReject})
+	if err := r.Validate(&OrderParams{Symbol: "KCS-USDT", Price: "10", Size: "1.234"}); err == nil {
+		t.Error("Expected an error of the size off the tick")
+	}
+}
+
+func TestApiOrderValidatorOption(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		return &HfPlaceOrderRes{OrderId: "o1"}
+	})
+	as := NewApiService(ApiRequesterOption(rr), ApiOrderValidatorOption(NewOrderValidator(newTestSymbols(), OrderValidatorOpts{})))
+
+	p := map[string]string{"symbol": "KCS-USDT", "side": "buy", "type": "limit", "price": "10.004", "size": "1.009"}
+	if _, err := as.HfPlaceOrder(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if p["price"] != "10" || p["size"] != "1" {
+		t.Errorf("Unexpected rounded parameters: %v", p)
+	}
+
+	// An invalid order is rejected without a request
+	ot := as.NewOrderTracker()
+	o, err := ot.HfCreateMarinOrderV3(context.Background(), &HfMarginOrderV3Req{ClientOid: "c1", Symbol: "KCS-USDT", Side: "buy", Type: "limit", Price: "10", Size: "0.001"})
+	if _, ok := err.(*OrderValidationError); !ok || o.State != OrderStateRejected {
+		t.Errorf("Unexpected order %s with error %v", ToJsonString(o), err)
+	}
+	if n := rr.count(http.MethodPost, "/api/v3/hf/margin/order"); n != 0 {
+		t.Errorf("Expected no request, got %d", n)
+	}
+}
@@ -0,0 +1,79 @@
+package kucoin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A StateStore persists the state of a component, so that it survives process restarts.
+type StateStore interface {
+	// Load returns the saved state, or nil if nothing has been saved.
+	Load() ([]byte, error)
+	// Save replaces the saved state.
+	Save(data []byte) error
+}
+
+// A FileStateStore saves the state into a file, it is replaced atomically.
+type FileStateStore struct {
+	path string
+}
+
+// NewFileStateStore creates an instance of FileStateStore saving into the file of the path.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Load implements StateStore.
+func (s *FileStateStore) Load() ([]byte, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// Save implements StateStore, the state is written into a temporary file renamed to the path.
+func (s *FileStateStore) Save(data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// A MemoryStateStore keeps the state in memory, e.g. for the tests.
+type MemoryStateStore struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// Load implements StateStore.
+func (s *MemoryStateStore) Load() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.data...), nil
+}
+
+// Save implements StateStore.
+func (s *MemoryStateStore) Save(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append([]byte(nil), data...)
+	return nil
+}
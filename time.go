@@ -3,6 +3,8 @@ package kucoin
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type ServerTimeModel int64
@@ -12,3 +14,41 @@ func (as *ApiService) ServerTime(ctx context.Context) (*ApiResponse, error) {
 	req := NewRequest(http.MethodGet, "/api/v1/timestamp", nil)
 	return as.Call(ctx, req)
 }
+
+// A ServerClock estimates the server time from the offset of the local clock to the API server time.
+// The zero value is the local clock.
+type ServerClock struct {
+	offset int64
+}
+
+// Sync measures the offset by ServerTime, the server time is taken at the middle of the round trip.
+func (c *ServerClock) Sync(ctx context.Context, as *ApiService) error {
+	before := time.Now()
+	rsp, err := as.ServerTime(ctx)
+	if err != nil {
+		return err
+	}
+	after := time.Now()
+	var ts ServerTimeModel
+	if err := rsp.ReadData(&ts); err != nil {
+		return err
+	}
+	local := before.Add(after.Sub(before) / 2)
+	c.SetOffset(time.Unix(0, int64(ts)*int64(time.Millisecond)).Sub(local))
+	return nil
+}
+
+// SetOffset sets the offset of the server time to the local time.
+func (c *ServerClock) SetOffset(d time.Duration) {
+	atomic.StoreInt64(&c.offset, int64(d))
+}
+
+// Offset returns the offset of the server time to the local time.
+func (c *ServerClock) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.offset))
+}
+
+// Now returns the current server time.
+func (c *ServerClock) Now() time.Time {
+	return time.Now().Add(c.Offset())
+}
@@ -0,0 +1,563 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TickerTopicPrefix is the prefix of the topics of the ticker of the symbols.
+const TickerTopicPrefix = "/market/ticker:"
+
+// A TrailingStopState is the state of an emulated trailing stop.
+type TrailingStopState string
+
+// The states of an emulated trailing stop.
+const (
+	// TrailingStopPending waits for the price to reach ActivationPrice.
+	TrailingStopPending TrailingStopState = "pending"
+	// TrailingStopActive trails the price.
+	TrailingStopActive TrailingStopState = "active"
+	// TrailingStopTriggered has been triggered, its order may or may not have been placed.
+	TrailingStopTriggered TrailingStopState = "triggered"
+	// TrailingStopPlaced has placed its order.
+	TrailingStopPlaced TrailingStopState = "placed"
+	// TrailingStopFailed failed to place its order for the Reason.
+	TrailingStopFailed TrailingStopState = "failed"
+	// TrailingStopCancelled has been cancelled before being triggered.
+	TrailingStopCancelled TrailingStopState = "cancelled"
+)
+
+// A TrailingStop represents a trailing stop emulated by a TrailingStopEmulator, it is also its persisted state.
+// A sell stop protects a long position: its trigger trails the highest price by the distance,
+// and it fires when the price falls to the trigger or rises to TakeProfit.
+// A buy stop mirrors it: its trigger trails the lowest price,
+// and it fires when the price rises to the trigger or falls to TakeProfit.
+type TrailingStop struct {
+	Id     string `json:"id"`
+	Symbol string `json:"symbol"`
+	// Side is the side of the order placed when the stop fires.
+	Side string `json:"side"`
+	// Type is the type of the order, market or limit.
+	Type string `json:"type"`
+	Size string `json:"size,omitempty"`
+	// Funds is the funds of a market buy order without a size.
+	Funds string `json:"funds,omitempty"`
+	// LimitOffset is the slippage allowed to a limit order: it is priced at the firing price
+	// minus the offset for a sell, plus the offset for a buy.
+	LimitOffset string `json:"limitOffset,omitempty"`
+
+	// TrailPercent is the distance of the trigger as a ratio of the price, e.g. "0.02".
+	TrailPercent string `json:"trailPercent,omitempty"`
+	// TrailAmount is the absolute distance of the trigger, used if TrailPercent is empty.
+	TrailAmount string `json:"trailAmount,omitempty"`
+	// ActivationPrice starts trailing once the price reaches it: at or above it for a sell, at or below it for a buy.
+	ActivationPrice string `json:"activationPrice,omitempty"`
+	// TakeProfit fires the stop once the price reaches it in the favorable direction.
+	TakeProfit string `json:"takeProfit,omitempty"`
+
+	State TrailingStopState `json:"state"`
+	// Extreme is the best price seen while active, the highest for a sell and the lowest for a buy.
+	Extreme string `json:"extreme,omitempty"`
+	Trigger string `json:"trigger,omitempty"`
+	// FiredPrice is the price which fired the stop.
+	FiredPrice string `json:"firedPrice,omitempty"`
+	// ClientOid is the client oid of the order, assigned when the stop is added.
+	ClientOid string `json:"clientOid"`
+	OrderId   string `json:"orderId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// validate checks the stop.
+func (ts *TrailingStop) validate() error {
+	if ts.Symbol == "" || (ts.Side != "buy" && ts.Side != "sell") {
+		return errors.Errorf("Invalid trailing stop of %s %s", ts.Side, ts.Symbol)
+	}
+	if ts.Type != "market" && ts.Type != "limit" {
+		return errors.Errorf("Invalid trailing stop of type %s", ts.Type)
+	}
+	if decimalCmp(ts.Size, "0") <= 0 && (ts.Type != "market" || ts.Side != "buy" || decimalCmp(ts.Funds, "0") <= 0) {
+		return errors.Errorf("Invalid trailing stop of size %s", ts.Size)
+	}
+	if decimalCmp(ts.TrailPercent, "0") <= 0 && decimalCmp(ts.TrailAmount, "0") <= 0 && ts.TakeProfit == "" {
+		return errors.New("Invalid trailing stop without a distance")
+	}
+	if decimalCmp(ts.TrailPercent, "1") >= 0 {
+		return errors.Errorf("Invalid trailing stop of percent %s", ts.TrailPercent)
+	}
+	return nil
+}
+
+// trailing reports whether the stop trails the price.
+func (ts *TrailingStop) trailing() bool {
+	return decimalCmp(ts.TrailPercent, "0") > 0 || decimalCmp(ts.TrailAmount, "0") > 0
+}
+
+// update updates the extreme and the trigger with the price, and reports whether the stop fires.
+func (ts *TrailingStop) update(price string) bool {
+	sell := ts.Side == "sell"
+	// better reports whether a is more favorable than b
+	better := func(a, b string) bool {
+		if sell {
+			return decimalCmp(a, b) > 0
+		}
+		return decimalCmp(a, b) < 0
+	}
+	if ts.State == TrailingStopPending {
+		if better(ts.ActivationPrice, price) {
+			return false
+		}
+		ts.State = TrailingStopActive
+	}
+	if ts.TakeProfit != "" && !better(ts.TakeProfit, price) {
+		return true
+	}
+	if !ts.trailing() {
+		return false
+	}
+	if ts.Extreme == "" || better(price, ts.Extreme) {
+		ts.Extreme = price
+		d := ts.TrailAmount
+		if decimalCmp(ts.TrailPercent, "0") > 0 {
+			d = decimalMul(price, ts.TrailPercent)
+		}
+		if sell {
+			ts.Trigger = decimalSub(price, d)
+		} else {
+			ts.Trigger = decimalAdd(price, d)
+		}
+	}
+	return !better(price, ts.Trigger)
+}
+
+// params returns the parameters of the HF order of the stop fired at the price.
+func (ts *TrailingStop) params(price string) map[string]string {
+	p := map[string]string{
+		"clientOid": ts.ClientOid,
+		"symbol":    ts.Symbol,
+		"side":      ts.Side,
+		"type":      ts.Type,
+	}
+	if ts.Size != "" {
+		p["size"] = ts.Size
+	} else {
+		p["funds"] = ts.Funds
+	}
+	if ts.Type == "limit" {
+		if ts.Side == "sell" {
+			p["price"] = decimalSub(price, ts.LimitOffset)
+		} else {
+			p["price"] = decimalAdd(price, ts.LimitOffset)
+		}
+	}
+	return p
+}
+
+// All defaults of TrailingStopOpts.
+const (
+	defaultTrailingStopSaveInterval  = time.Second
+	defaultTrailingStopEventBuffer   = 64
+	defaultTrailingStopRetryInterval = 5 * time.Second
+)
+
+// TrailingStopOpts contains the options of a TrailingStopEmulator.
+type TrailingStopOpts struct {
+	// Store persists the stops, they are kept in memory only if it is nil.
+	Store StateStore
+	// SaveInterval is the min interval of saving the moves of the triggers, 1s by default.
+	// The changes of the states are saved immediately.
+	SaveInterval time.Duration
+	// Generator generates the ids and the client oids of the stops, NewClientOidGenerator("") by default.
+	Generator ClientOidGenerator
+	// EventBuffer is the size of the channel of Events(), 64 by default.
+	EventBuffer int
+	// RetryInterval is the interval Run() resolves the stops left triggered by an unknown failure, 5s by default.
+	RetryInterval time.Duration
+}
+
+// A TrailingStopEmulator emulates trailing stops and take-profits on the client side:
+// it watches the ticker stream, maintains the triggers, and places a HF order when a stop fires.
+// The stops are persisted before placing their orders, a stop triggered before a restart
+// is resolved by its client oid, so that its order is never placed twice.
+type TrailingStopEmulator struct {
+	as     *ApiService
+	opts   TrailingStopOpts
+	events chan *TrailingStop
+
+	mu       sync.Mutex
+	stops    map[string]*TrailingStop
+	dirty    bool
+	lastSave time.Time
+}
+
+// NewTrailingStopEmulator creates an instance of TrailingStopEmulator, and loads the stops from the store.
+func (as *ApiService) NewTrailingStopEmulator(opts TrailingStopOpts) (*TrailingStopEmulator, error) {
+	if opts.SaveInterval <= 0 {
+		opts.SaveInterval = defaultTrailingStopSaveInterval
+	}
+	if opts.EventBuffer <= 0 {
+		opts.EventBuffer = defaultTrailingStopEventBuffer
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultTrailingStopRetryInterval
+	}
+	if opts.Generator == nil {
+		g, err := NewClientOidGenerator("")
+		if err != nil {
+			return nil, err
+		}
+		opts.Generator = g
+	}
+	e := &TrailingStopEmulator{
+		as:     as,
+		opts:   opts,
+		events: make(chan *TrailingStop, opts.EventBuffer),
+		stops:  make(map[string]*TrailingStop),
+	}
+	if opts.Store == nil {
+		return e, nil
+	}
+	b, err := opts.Store.Load()
+	if err != nil || len(b) == 0 {
+		return e, err
+	}
+	var l []*TrailingStop
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, errors.Errorf("Load trailing stops failed, %s", err.Error())
+	}
+	for _, ts := range l {
+		e.stops[ts.Id] = ts
+	}
+	return e, nil
+}
+
+// Events returns the channel of the stops changing their states, they are dropped if it is full.
+func (e *TrailingStopEmulator) Events() <-chan *TrailingStop {
+	return e.events
+}
+
+// Add adds a stop and returns a copy of it. The id and the client oid are generated if they are empty.
+// It is active at once without an ActivationPrice.
+func (e *TrailingStopEmulator) Add(ts TrailingStop) (*TrailingStop, error) {
+	if err := ts.validate(); err != nil {
+		return nil, err
+	}
+	if ts.Id == "" {
+		ts.Id = e.opts.Generator.NewClientOid()
+	}
+	if ts.ClientOid == "" {
+		ts.ClientOid = e.opts.Generator.NewClientOid()
+	}
+	ts.State = TrailingStopActive
+	if ts.ActivationPrice != "" {
+		ts.State = TrailingStopPending
+	}
+	ts.Extreme, ts.Trigger, ts.FiredPrice, ts.OrderId, ts.Reason = "", "", "", "", ""
+	ts.UpdatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.stops[ts.Id]; ok {
+		return nil, errors.Errorf("Duplicate trailing stop %s", ts.Id)
+	}
+	e.stops[ts.Id] = &ts
+	if err := e.save(); err != nil {
+		delete(e.stops, ts.Id)
+		return nil, err
+	}
+	c := ts
+	return &c, nil
+}
+
+// Cancel cancels a pending or active stop.
+func (e *TrailingStopEmulator) Cancel(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ts, ok := e.stops[id]
+	if !ok {
+		return errors.Errorf("Unknown trailing stop %s", id)
+	}
+	if ts.State != TrailingStopPending && ts.State != TrailingStopActive {
+		return errors.Errorf("Cancel trailing stop %s failed, it is %s", id, ts.State)
+	}
+	e.setState(ts, TrailingStopCancelled, "")
+	return e.save()
+}
+
+// Remove forgets a stop which is not pending or active.
+func (e *TrailingStopEmulator) Remove(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ts, ok := e.stops[id]
+	if !ok {
+		return nil
+	}
+	if ts.State == TrailingStopPending || ts.State == TrailingStopActive || ts.State == TrailingStopTriggered {
+		return errors.Errorf("Remove trailing stop %s failed, it is %s", id, ts.State)
+	}
+	delete(e.stops, id)
+	return e.save()
+}
+
+// Stop returns a copy of the stop, or nil if it is unknown.
+func (e *TrailingStopEmulator) Stop(id string) *TrailingStop {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ts, ok := e.stops[id]; ok {
+		c := *ts
+		return &c
+	}
+	return nil
+}
+
+// Stops returns the copies of all stops sorted by id.
+func (e *TrailingStopEmulator) Stops() []*TrailingStop {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l := make([]*TrailingStop, 0, len(e.stops))
+	for _, ts := range e.stops {
+		c := *ts
+		l = append(l, &c)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Id < l[j].Id })
+	return l
+}
+
+// Symbols returns the symbols of the pending and active stops, whose tickers should be subscribed.
+func (e *TrailingStopEmulator) Symbols() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := make(map[string]bool)
+	for _, ts := range e.stops {
+		if ts.State == TrailingStopPending || ts.State == TrailingStopActive {
+			m[ts.Symbol] = true
+		}
+	}
+	l := make([]string, 0, len(m))
+	for s := range m {
+		l = append(l, s)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// setState changes the state of the stop and emits it, the caller must hold the lock.
+func (e *TrailingStopEmulator) setState(ts *TrailingStop, s TrailingStopState, reason string) {
+	ts.State, ts.Reason = s, reason
+	ts.UpdatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	c := *ts
+	select {
+	case e.events <- &c:
+	default:
+	}
+}
+
+// save saves all stops, the caller must hold the lock.
+func (e *TrailingStopEmulator) save() error {
+	e.dirty = false
+	e.lastSave = time.Now()
+	if e.opts.Store == nil {
+		return nil
+	}
+	l := make([]*TrailingStop, 0, len(e.stops))
+	for _, ts := range e.stops {
+		l = append(l, ts)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Id < l[j].Id })
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := e.opts.Store.Save(b); err != nil {
+		e.dirty = true
+		return errors.Errorf("Save trailing stops failed, %s", err.Error())
+	}
+	return nil
+}
+
+// Flush saves the moves of the triggers not saved yet.
+func (e *TrailingStopEmulator) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.dirty {
+		return nil
+	}
+	return e.save()
+}
+
+// Apply consumes a message of /market/ticker:{symbol} or /market/ticker:all, other messages are ignored.
+func (e *TrailingStopEmulator) Apply(ctx context.Context, m *WebSocketDownstreamMessage) error {
+	if !strings.HasPrefix(m.Topic, TickerTopicPrefix) {
+		return nil
+	}
+	symbol := strings.TrimPrefix(m.Topic, TickerTopicPrefix)
+	if m.Topic == TickerAllTopic {
+		symbol = m.Subject
+	}
+	tk := &TickerLevel1Model{}
+	if err := m.ReadData(tk); err != nil {
+		return err
+	}
+	return e.Update(ctx, symbol, tk.Price)
+}
+
+// Update updates the stops of the symbol with the last price, and places the orders of the stops fired.
+// The fired stops are saved as triggered before placing their orders,
+// a stop failing to be placed does not prevent the others from being placed.
+func (e *TrailingStopEmulator) Update(ctx context.Context, symbol, price string) error {
+	if decimalCmp(price, "0") <= 0 {
+		return nil
+	}
+	e.mu.Lock()
+	var fired []*TrailingStop
+	changed := false
+	for _, ts := range e.stops {
+		if ts.Symbol != symbol || (ts.State != TrailingStopPending && ts.State != TrailingStopActive) {
+			continue
+		}
+		extreme, state := ts.Extreme, ts.State
+		if ts.update(price) {
+			ts.FiredPrice = price
+			e.setState(ts, TrailingStopTriggered, "")
+			fired = append(fired, ts)
+			continue
+		}
+		if ts.State != state {
+			e.setState(ts, ts.State, "")
+			changed = true
+		} else if ts.Extreme != extreme {
+			e.dirty = true
+		}
+	}
+	var err error
+	if len(fired) > 0 || changed || e.dirty && time.Since(e.lastSave) >= e.opts.SaveInterval {
+		err = e.save()
+	}
+	e.mu.Unlock()
+	if err != nil {
+		// The orders are not placed without the triggered states saved
+		return err
+	}
+
+	var failures []string
+	for _, ts := range fired {
+		if err := e.place(ctx, ts); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("Place the orders of %d trailing stops failed, %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// place places the order of a triggered stop.
+func (e *TrailingStopEmulator) place(ctx context.Context, ts *TrailingStop) error {
+	e.mu.Lock()
+	p := ts.params(ts.FiredPrice)
+	e.mu.Unlock()
+	rsp, err := e.as.HfPlaceOrder(ctx, p)
+	v := &HfPlaceOrderRes{}
+	if err == nil {
+		err = rsp.ReadData(v)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case err == nil:
+		ts.OrderId = v.OrderId
+		e.setState(ts, TrailingStopPlaced, "")
+	case unknownPlaceFailure(rsp, err):
+		// It stays triggered until it is resolved by Recover(), which Run() calls periodically
+		if DebugMode {
+			logrus.Debugf("Place the order of trailing stop %s failed, %s", ts.Id, err.Error())
+		}
+		return nil
+	default:
+		e.setState(ts, TrailingStopFailed, err.Error())
+	}
+	return e.save()
+}
+
+// Recover resolves the stops triggered before a restart or an unknown failure by their client oids:
+// a stop whose order exists is placed, the order of the others is placed again.
+func (e *TrailingStopEmulator) Recover(ctx context.Context) error {
+	e.mu.Lock()
+	var triggered []*TrailingStop
+	for _, ts := range e.stops {
+		if ts.State == TrailingStopTriggered {
+			triggered = append(triggered, ts)
+		}
+	}
+	e.mu.Unlock()
+
+	var failures []string
+	for _, ts := range triggered {
+		rsp, err := e.as.HfOrderDetailByClientOid(ctx, ts.ClientOid, ts.Symbol)
+		o := &HfOrderModel{}
+		if err == nil {
+			err = rsp.ReadData(o)
+		}
+		if err == nil && o.Id != "" {
+			e.mu.Lock()
+			ts.OrderId = o.Id
+			e.setState(ts, TrailingStopPlaced, "")
+			err = e.save()
+			e.mu.Unlock()
+			if err != nil {
+				failures = append(failures, err.Error())
+			}
+			continue
+		}
+		// The order is placed again only if the API replies that it does not exist
+		if err != nil && unknownPlaceFailure(rsp, err) {
+			failures = append(failures, "resolve trailing stop "+ts.Id+", "+err.Error())
+			continue
+		}
+		if err := e.place(ctx, ts); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("Recover %d trailing stops failed, %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Run recovers the triggered stops, then applies the messages until messages is closed or ctx is done.
+// The stops left triggered by an unknown failure are recovered again every RetryInterval.
+// It returns the first error, e.g. a stop failing to be saved.
+func (e *TrailingStopEmulator) Run(ctx context.Context, messages <-chan *WebSocketDownstreamMessage) error {
+	if err := e.Recover(ctx); err != nil {
+		return err
+	}
+	defer e.Flush()
+	t := time.NewTicker(e.opts.RetryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			// A stop not resolved yet is retried on the next tick
+			if err := e.Recover(ctx); err != nil && DebugMode {
+				logrus.Debugf("Recover trailing stops failed, %s", err.Error())
+			}
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if err := e.Apply(ctx, m); err != nil {
+				return err
+			}
+		}
+	}
+}
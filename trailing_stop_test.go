@@ -0,0 +1,185 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTrailingStop_Update(t *testing.T) {
+	for _, c := range []struct {
+		ts      TrailingStop
+		prices  string
+		fired   int
+		trigger string
+	}{
+		// A sell stop trails the highest price
+		{TrailingStop{Side: "sell", TrailPercent: "0.1", State: TrailingStopActive}, "10,12,11,10.9,10.8", 4, "10.8"},
+		// A buy stop trails the lowest price
+		{TrailingStop{Side: "buy", TrailAmount: "1", State: TrailingStopActive}, "10,8,8.5,9,10", 3, "9"},
+		// It trails once activated
+		{TrailingStop{Side: "sell", TrailAmount: "1", ActivationPrice: "12", State: TrailingStopPending}, "10,8,12,11.5,11", 4, "11"},
+		// A take-profit fires without trailing
+		{TrailingStop{Side: "sell", TakeProfit: "12", State: TrailingStopActive}, "10,8,11.9,12.1", 3, ""},
+	} {
+		fired := -1
+		for i, p := range strings.Split(c.prices, ",") {
+			if c.ts.update(p) {
+				fired = i
+				break
+			}
+		}
+		if fired != c.fired || c.ts.Trigger != c.trigger {
+			t.Errorf("Expected %s stop fired at %d by %s, got %d by %s", c.ts.Side, c.fired, c.trigger, fired, c.ts.Trigger)
+		}
+	}
+}
+
+func TestTrailingStopEmulator_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kucoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStateStore(filepath.Join(dir, "stops.json"))
+
+	var params []map[string]string
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		p := make(map[string]string)
+		if err := json.Unmarshal(r.Body, &p); err != nil {
+			return err
+		}
+		params = append(params, p)
+		if len(params) == 1 {
+			return errors.New("i/o timeout")
+		}
+		return &HfPlaceOrderRes{OrderId: "o1", ClientOid: p["clientOid"], Success: true}
+	})
+	as := NewApiService(ApiRequesterOption(rr))
+	ctx := context.Background()
+
+	e, err := as.NewTrailingStopEmulator(TrailingStopOpts{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := e.Add(TrailingStop{Symbol: "KCS-USDT", Side: "sell", Type: "limit", Size: "2", TrailAmount: "1", LimitOffset: "0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"10", "12"} {
+		m := newTestDownstreamMessage(TickerTopicPrefix+"KCS-USDT", "trade.ticker", 1)
+		m.RawData = []byte(`{"price":"` + p + `"}`)
+		if err := e.Apply(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Update(ctx, "KCS-BTC", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// The order may have been placed after the timeout
+	if err := e.Update(ctx, "KCS-USDT", "10.9"); err != nil {
+		t.Fatal(err)
+	}
+	if s := e.Stop(ts.Id); s.State != TrailingStopTriggered || s.Trigger != "11" || s.FiredPrice != "10.9" {
+		t.Errorf("Unexpected stop: %s", ToJsonString(s))
+	}
+	if len(params) != 1 || params[0]["price"] != "10.8" || params[0]["size"] != "2" || params[0]["clientOid"] != ts.ClientOid {
+		t.Errorf("Unexpected orders: %v", params)
+	}
+
+	// The restarted emulator places the order again after querying it does not exist
+	resolve := "/api/v1/hf/orders/client-order/" + ts.ClientOid
+	rr.handle(http.MethodGet, resolve, func(r *Request) interface{} {
+		return &routeFailure{code: "400100", message: "order not exist."}
+	})
+	e, err = as.NewTrailingStopEmulator(TrailingStopOpts{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s := e.Stop(ts.Id); s.State != TrailingStopPlaced || s.OrderId != "o1" || rr.count(http.MethodGet, resolve) != 1 {
+		t.Errorf("Unexpected stop: %s", ToJsonString(s))
+	}
+	if len(params) != 2 || params[1]["clientOid"] != ts.ClientOid {
+		t.Errorf("Unexpected orders: %v", params)
+	}
+
+	// The state survives the restart
+	e, err = as.NewTrailingStopEmulator(TrailingStopOpts{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := e.Stop(ts.Id); s == nil || s.State != TrailingStopPlaced || len(e.Symbols()) != 0 {
+		t.Errorf("Unexpected stop: %s", ToJsonString(s))
+	}
+	if err := e.Remove(ts.Id); err != nil || len(e.Stops()) != 0 {
+		t.Errorf("Unexpected stops %s with error %v", ToJsonString(e.Stops()), err)
+	}
+}
+
+func TestTrailingStopEmulator_RunRetries(t *testing.T) {
+	var mu sync.Mutex
+	placed := 0
+	rr := newRouteRequester()
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", func(r *Request) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		placed++
+		if placed == 1 {
+			return errors.New("i/o timeout")
+		}
+		return &HfPlaceOrderRes{OrderId: "o1", Success: true}
+	})
+	e, err := NewApiService(ApiRequesterOption(rr)).NewTrailingStopEmulator(TrailingStopOpts{RetryInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := e.Add(TrailingStop{Symbol: "KCS-USDT", Side: "sell", Type: "market", Size: "1", TrailAmount: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/client-order/"+ts.ClientOid, func(r *Request) interface{} {
+		return &routeFailure{code: "400100", message: "order not exist."}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan *WebSocketDownstreamMessage)
+	done := make(chan error, 1)
+	go func() { done <- e.Run(ctx, messages) }()
+	for _, p := range []string{"10", "12", "10.9"} {
+		m := newTestDownstreamMessage(TickerTopicPrefix+"KCS-USDT", "trade.ticker", 1)
+		m.RawData = []byte(`{"price":"` + p + `"}`)
+		messages <- m
+	}
+
+	// The stop left triggered by the timeout is placed without a restart
+	deadline := time.Now().Add(2 * time.Second)
+	for e.Stop(ts.Id).State != TrailingStopPlaced && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := e.Stop(ts.Id); s.State != TrailingStopPlaced || s.OrderId != "o1" {
+		t.Errorf("Unexpected stop: %s", ToJsonString(s))
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected the error of ctx, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if placed != 2 {
+		t.Errorf("Expected 2 placements, got %d", placed)
+	}
+}
@@ -0,0 +1,434 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// An AccountKind is the account an order is placed in.
+type AccountKind string
+
+// The account kinds of a UnifiedOrderService.
+const (
+	AccountSpot           AccountKind = "spot"
+	AccountSpotHf         AccountKind = "spotHf"
+	AccountCrossMargin    AccountKind = "crossMargin"
+	AccountIsolatedMargin AccountKind = "isolatedMargin"
+)
+
+// margin reports whether the account is a margin account.
+func (k AccountKind) margin() bool {
+	return k == AccountCrossMargin || k == AccountIsolatedMargin
+}
+
+// UnifiedOrderOpts contains the options of a UnifiedOrderService.
+type UnifiedOrderOpts struct {
+	// ClassicMargin routes the margin orders to the classic margin endpoints
+	// instead of the HF margin endpoints of v3.
+	ClassicMargin bool
+	// Generator generates the client oid of an order without one, NewClientOidGenerator("") by default.
+	Generator ClientOidGenerator
+}
+
+// A UnifiedOrderRequest is the input parameter of UnifiedOrderService.PlaceOrder(), whatever the account.
+type UnifiedOrderRequest struct {
+	Account   AccountKind `json:"account"`
+	ClientOid string      `json:"clientOid"`
+	Symbol    string      `json:"symbol"`
+	Side      string      `json:"side"`
+	// Type is limit or market, limit by default.
+	Type   string `json:"type,omitempty"`
+	Remark string `json:"remark,omitempty"`
+	Stp    string `json:"stp,omitempty"`
+
+	// LIMIT ORDER PARAMETERS
+	Price       string `json:"price,omitempty"`
+	Size        string `json:"size,omitempty"`
+	TimeInForce string `json:"timeInForce,omitempty"`
+	CancelAfter int64  `json:"cancelAfter,omitempty"`
+	PostOnly    bool   `json:"postOnly,omitempty"`
+	Hidden      bool   `json:"hidden,omitempty"`
+	Iceberg     bool   `json:"iceberg,omitempty"`
+	// VisibleSize is ignored by the HF margin orders of v3.
+	VisibleSize string `json:"visibleSize,omitempty"`
+
+	// MARKET ORDER PARAMETERS
+	Funds string `json:"funds,omitempty"`
+
+	// MARGIN ORDER PARAMETERS
+	AutoBorrow bool `json:"autoBorrow,omitempty"`
+	AutoRepay  bool `json:"autoRepay,omitempty"`
+}
+
+// A UnifiedOrderResult is the result of UnifiedOrderService.PlaceOrder().
+type UnifiedOrderResult struct {
+	Account   AccountKind `json:"account"`
+	OrderId   string      `json:"orderId"`
+	ClientOid string      `json:"clientOid"`
+	// BorrowSize and LoanApplyId are returned by the margin orders borrowing automatically.
+	BorrowSize  string `json:"borrowSize,omitempty"`
+	LoanApplyId string `json:"loanApplyId,omitempty"`
+}
+
+// A UnifiedOrder represents an order queried by a UnifiedOrderService, whatever the account.
+type UnifiedOrder struct {
+	Account     AccountKind `json:"account"`
+	Id          string      `json:"id"`
+	ClientOid   string      `json:"clientOid"`
+	Symbol      string      `json:"symbol"`
+	Side        string      `json:"side"`
+	Type        string      `json:"type"`
+	Price       string      `json:"price"`
+	Size        string      `json:"size"`
+	Funds       string      `json:"funds"`
+	DealSize    string      `json:"dealSize"`
+	DealFunds   string      `json:"dealFunds"`
+	Fee         string      `json:"fee"`
+	FeeCurrency string      `json:"feeCurrency"`
+	TimeInForce string      `json:"timeInForce"`
+	Remark      string      `json:"remark"`
+	Active      bool        `json:"active"`
+	CancelExist bool        `json:"cancelExist"`
+	CreatedAt   int64       `json:"createdAt"`
+	// State is derived from Active, CancelExist and DealSize.
+	State OrderState `json:"state"`
+}
+
+// A UnifiedOrderService places, cancels and queries the orders of the spot, spot HF and margin accounts
+// with the same request and result types, and routes them to the endpoints of the accounts.
+type UnifiedOrderService struct {
+	as   *ApiService
+	opts UnifiedOrderOpts
+}
+
+// NewUnifiedOrderService creates an instance of UnifiedOrderService.
+func (as *ApiService) NewUnifiedOrderService(opts UnifiedOrderOpts) *UnifiedOrderService {
+	if opts.Generator == nil {
+		opts.Generator, _ = NewClientOidGenerator("")
+	}
+	return &UnifiedOrderService{as: as, opts: opts}
+}
+
+// checkAccount returns an error if the account is unknown.
+func checkAccount(account AccountKind) error {
+	switch account {
+	case AccountSpot, AccountSpotHf, AccountCrossMargin, AccountIsolatedMargin:
+		return nil
+	}
+	return errors.Errorf("Unknown account kind %q", account)
+}
+
+// PlaceOrder places an order in the account of the request. A client oid is generated if it is empty.
+func (s *UnifiedOrderService) PlaceOrder(ctx context.Context, o *UnifiedOrderRequest) (*UnifiedOrderResult, error) {
+	if err := checkAccount(o.Account); err != nil {
+		return nil, err
+	}
+	if o.ClientOid == "" {
+		o.ClientOid = s.opts.Generator.NewClientOid()
+	}
+	r := &UnifiedOrderResult{Account: o.Account, ClientOid: o.ClientOid}
+
+	switch {
+	case o.Account == AccountSpotHf:
+		rsp, err := s.as.HfPlaceOrder(ctx, o.hfParams())
+		if err != nil {
+			return nil, err
+		}
+		v := &HfPlaceOrderRes{}
+		if err := rsp.ReadData(v); err != nil {
+			return nil, err
+		}
+		r.OrderId = v.OrderId
+	case o.Account.margin() && !s.opts.ClassicMargin:
+		rsp, err := s.as.HfCreateMarinOrderV3(ctx, o.hfMarginOrderV3())
+		if err != nil {
+			return nil, err
+		}
+		// The order id is replied as orderId
+		v := &struct {
+			HfMarginOrderV3Resp
+			OrderId string `json:"orderId"`
+		}{}
+		if err := rsp.ReadData(v); err != nil {
+			return nil, err
+		}
+		if v.OrderId == "" {
+			v.OrderId = v.OrderNo
+		}
+		r.OrderId, r.BorrowSize, r.LoanApplyId = v.OrderId, v.BorrowSize, v.LoanApplyId
+	default:
+		var rsp *ApiResponse
+		var err error
+		if o.Account.margin() {
+			rsp, err = s.as.CreateMarginOrder(ctx, o.createOrder())
+		} else {
+			rsp, err = s.as.CreateOrder(ctx, o.createOrder())
+		}
+		if err != nil {
+			return nil, err
+		}
+		v := &UnifiedOrderResult{}
+		if err := rsp.ReadData(v); err != nil {
+			return nil, err
+		}
+		r.OrderId, r.BorrowSize, r.LoanApplyId = v.OrderId, v.BorrowSize, v.LoanApplyId
+	}
+	return r, nil
+}
+
+// createOrder returns the classic or classic margin order of the request.
+func (o *UnifiedOrderRequest) createOrder() *CreateOrderModel {
+	m := &CreateOrderModel{
+		ClientOid:   o.ClientOid,
+		Side:        o.Side,
+		Symbol:      o.Symbol,
+		Type:        o.Type,
+		Remark:      o.Remark,
+		STP:         o.Stp,
+		Price:       o.Price,
+		Size:        o.Size,
+		TimeInForce: o.TimeInForce,
+		CancelAfter: o.CancelAfter,
+		PostOnly:    o.PostOnly,
+		Hidden:      o.Hidden,
+		IceBerg:     o.Iceberg,
+		VisibleSize: o.VisibleSize,
+		Funds:       o.Funds,
+	}
+	switch o.Account {
+	case AccountCrossMargin:
+		m.MarginMode, m.AutoBorrow, m.AutoRepay = "cross", o.AutoBorrow, o.AutoRepay
+	case AccountIsolatedMargin:
+		m.MarginMode, m.AutoBorrow, m.AutoRepay = "isolated", o.AutoBorrow, o.AutoRepay
+	}
+	return m
+}
+
+// hfParams returns the parameters of the HF order of the request.
+func (o *UnifiedOrderRequest) hfParams() map[string]string {
+	p := map[string]string{}
+	for k, v := range map[string]string{
+		"clientOid":   o.ClientOid,
+		"symbol":      o.Symbol,
+		"side":        o.Side,
+		"type":        o.Type,
+		"remark":      o.Remark,
+		"stp":         o.Stp,
+		"price":       o.Price,
+		"size":        o.Size,
+		"timeInForce": o.TimeInForce,
+		"visibleSize": o.VisibleSize,
+		"funds":       o.Funds,
+	} {
+		if v != "" {
+			p[k] = v
+		}
+	}
+	if p["type"] == "" {
+		p["type"] = "limit"
+	}
+	if o.CancelAfter > 0 {
+		p["cancelAfter"] = strconv.FormatInt(o.CancelAfter, 10)
+	}
+	for k, v := range map[string]bool{"postOnly": o.PostOnly, "hidden": o.Hidden, "iceberg": o.Iceberg} {
+		if v {
+			p[k] = "true"
+		}
+	}
+	return p
+}
+
+// hfMarginOrderV3 returns the HF margin order of the request.
+func (o *UnifiedOrderRequest) hfMarginOrderV3() *HfMarginOrderV3Req {
+	t := o.Type
+	if t == "" {
+		t = "limit"
+	}
+	return &HfMarginOrderV3Req{
+		ClientOid:   o.ClientOid,
+		Symbol:      o.Symbol,
+		Side:        o.Side,
+		Type:        t,
+		Stp:         o.Stp,
+		IsIsolated:  o.Account == AccountIsolatedMargin,
+		AutoBorrow:  o.AutoBorrow,
+		AutoRepay:   o.AutoRepay,
+		Price:       o.Price,
+		Size:        o.Size,
+		TimeInForce: o.TimeInForce,
+		CancelAfter: o.CancelAfter,
+		PostOnly:    o.PostOnly,
+		Hidden:      o.Hidden,
+		Iceberg:     o.Iceberg,
+		Funds:       o.Funds,
+	}
+}
+
+// hf reports whether the orders of the account are placed with the HF endpoints.
+func (s *UnifiedOrderService) hf(account AccountKind) bool {
+	return account == AccountSpotHf || account.margin() && !s.opts.ClassicMargin
+}
+
+// CancelOrder cancels an order of the account by its order id.
+// The symbol is required by the HF endpoints, and ignored by the classic ones.
+func (s *UnifiedOrderService) CancelOrder(ctx context.Context, account AccountKind, symbol, orderId string) error {
+	rsp, err := s.cancel(ctx, account, symbol, orderId, "")
+	if err != nil {
+		return err
+	}
+	return rsp.ReadData(nil)
+}
+
+// CancelOrderByClientOid cancels an order of the account by its client oid.
+// The symbol is required by the HF endpoints, and ignored by the classic ones.
+func (s *UnifiedOrderService) CancelOrderByClientOid(ctx context.Context, account AccountKind, symbol, clientOid string) error {
+	rsp, err := s.cancel(ctx, account, symbol, "", clientOid)
+	if err != nil {
+		return err
+	}
+	return rsp.ReadData(nil)
+}
+
+// cancel sends the cancellation of an order by its order id if it is not empty, by its client oid otherwise.
+func (s *UnifiedOrderService) cancel(ctx context.Context, account AccountKind, symbol, orderId, clientOid string) (*ApiResponse, error) {
+	if err := checkAccount(account); err != nil {
+		return nil, err
+	}
+	if orderId != "" {
+		switch {
+		case account == AccountSpotHf:
+			return s.as.HfCancelOrder(ctx, orderId, symbol)
+		case s.hf(account):
+			return s.as.HfCancelMarinOrderV3(ctx, &HfCancelMarinOrderV3Req{OrderId: orderId, Symbol: symbol})
+		}
+		return s.as.CancelOrder(ctx, orderId)
+	}
+	switch {
+	case account == AccountSpotHf:
+		return s.as.HfCancelOrderByClientId(ctx, clientOid, symbol)
+	case s.hf(account):
+		return s.as.HfCancelClientMarinOrderV3(ctx, &HfCancelClientMarinOrderV3Req{ClientOid: clientOid, Symbol: symbol})
+	}
+	return s.as.CancelOrderByClient(ctx, clientOid)
+}
+
+// Order returns an order of the account by its order id.
+// The symbol is required by the HF endpoints, and ignored by the classic ones.
+func (s *UnifiedOrderService) Order(ctx context.Context, account AccountKind, symbol, orderId string) (*UnifiedOrder, error) {
+	if err := checkAccount(account); err != nil {
+		return nil, err
+	}
+	switch {
+	case account == AccountSpotHf:
+		return s.hfOrder(s.as.HfOrderDetail(ctx, orderId, symbol))
+	case s.hf(account):
+		return s.hfMarginOrder(account)(s.as.HfMarinOrderV3(ctx, &HfMarinOrderV3Req{OrderId: orderId, Symbol: symbol}))
+	}
+	return s.classicOrder(account)(s.as.Order(ctx, orderId))
+}
+
+// OrderByClientOid returns an order of the account by its client oid.
+// The symbol is required by the HF endpoints, and ignored by the classic ones.
+func (s *UnifiedOrderService) OrderByClientOid(ctx context.Context, account AccountKind, symbol, clientOid string) (*UnifiedOrder, error) {
+	if err := checkAccount(account); err != nil {
+		return nil, err
+	}
+	switch {
+	case account == AccountSpotHf:
+		return s.hfOrder(s.as.HfOrderDetailByClientOid(ctx, clientOid, symbol))
+	case s.hf(account):
+		return s.hfMarginOrder(account)(s.as.HfMarinClientOrderV3(ctx, &HfMarinClientOrderV3Req{ClientOid: clientOid, Symbol: symbol}))
+	}
+	return s.classicOrder(account)(s.as.OrderByClient(ctx, clientOid))
+}
+
+// hfOrder converts a HF order.
+func (s *UnifiedOrderService) hfOrder(rsp *ApiResponse, err error) (*UnifiedOrder, error) {
+	if err != nil {
+		return nil, err
+	}
+	v := &HfOrderModel{}
+	if err := rsp.ReadData(v); err != nil {
+		return nil, err
+	}
+	createdAt, _ := v.CreatedAt.Int64()
+	cancelled := v.CancelExist || decimalCmp(v.CancelledSize, "0") > 0
+	return &UnifiedOrder{
+		Account: AccountSpotHf, Id: v.Id, ClientOid: v.ClientOid, Symbol: v.Symbol, Side: v.Side, Type: v.Type,
+		Price: v.Price, Size: v.Size, Funds: v.Funds, DealSize: v.DealSize, DealFunds: v.DealFunds,
+		Fee: v.Fee, FeeCurrency: v.FeeCurrency, TimeInForce: v.TimeInForce, Remark: v.Remark,
+		Active: v.Active, CancelExist: cancelled, CreatedAt: createdAt,
+		State: orderStateOf(!v.Active, cancelled, v.DealSize),
+	}, nil
+}
+
+// An hfMarginOrderModel is the detail of a HF margin order, the order id is a string unlike MarginFillModel.
+type hfMarginOrderModel struct {
+	Id            string      `json:"id"`
+	OrderId       string      `json:"orderId"`
+	ClientOid     string      `json:"clientOid"`
+	Symbol        string      `json:"symbol"`
+	Side          string      `json:"side"`
+	Type          string      `json:"type"`
+	Price         string      `json:"price"`
+	Size          string      `json:"size"`
+	Funds         string      `json:"funds"`
+	DealSize      string      `json:"dealSize"`
+	DealFunds     string      `json:"dealFunds"`
+	CancelledSize string      `json:"cancelledSize"`
+	Fee           string      `json:"fee"`
+	FeeCurrency   string      `json:"feeCurrency"`
+	TimeInForce   string      `json:"timeInForce"`
+	Remark        string      `json:"remark"`
+	Active        bool        `json:"active"`
+	CancelExist   bool        `json:"cancelExist"`
+	CreatedAt     json.Number `json:"createdAt"`
+}
+
+// hfMarginOrder returns a converter of the HF margin orders of the account.
+func (s *UnifiedOrderService) hfMarginOrder(account AccountKind) func(rsp *ApiResponse, err error) (*UnifiedOrder, error) {
+	return func(rsp *ApiResponse, err error) (*UnifiedOrder, error) {
+		if err != nil {
+			return nil, err
+		}
+		v := &hfMarginOrderModel{}
+		if err := rsp.ReadData(v); err != nil {
+			return nil, err
+		}
+		if v.Id == "" {
+			v.Id = v.OrderId
+		}
+		createdAt, _ := v.CreatedAt.Int64()
+		cancelled := v.CancelExist || decimalCmp(v.CancelledSize, "0") > 0
+		return &UnifiedOrder{
+			Account: account, Id: v.Id, ClientOid: v.ClientOid, Symbol: v.Symbol, Side: v.Side, Type: v.Type,
+			Price: v.Price, Size: v.Size, Funds: v.Funds, DealSize: v.DealSize, DealFunds: v.DealFunds,
+			Fee: v.Fee, FeeCurrency: v.FeeCurrency, TimeInForce: v.TimeInForce, Remark: v.Remark,
+			Active: v.Active, CancelExist: cancelled, CreatedAt: createdAt,
+			State: orderStateOf(!v.Active, cancelled, v.DealSize),
+		}, nil
+	}
+}
+
+// classicOrder returns a converter of the classic orders of the account.
+func (s *UnifiedOrderService) classicOrder(account AccountKind) func(rsp *ApiResponse, err error) (*UnifiedOrder, error) {
+	return func(rsp *ApiResponse, err error) (*UnifiedOrder, error) {
+		if err != nil {
+			return nil, err
+		}
+		v := &OrderModel{}
+		if err := rsp.ReadData(v); err != nil {
+			return nil, err
+		}
+		return &UnifiedOrder{
+			Account: account, Id: v.Id, ClientOid: v.ClientOid, Symbol: v.Symbol, Side: v.Side, Type: v.Type,
+			Price: v.Price, Size: v.Size, Funds: v.Funds, DealSize: v.DealSize, DealFunds: v.DealFunds,
+			Fee: v.Fee, FeeCurrency: v.FeeCurrency, TimeInForce: v.TimeInForce, Remark: v.Remark,
+			Active: v.IsActive, CancelExist: v.CancelExist, CreatedAt: v.CreatedAt,
+			State: orderStateOf(!v.IsActive, v.CancelExist, v.DealSize),
+		}, nil
+	}
+}
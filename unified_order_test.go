@@ -0,0 +1,103 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestUnifiedOrderService_PlaceOrder(t *testing.T) {
+	rr := newRouteRequester()
+	bodies := make(map[string]map[string]interface{})
+	record := func(path string, data interface{}) func(r *Request) interface{} {
+		return func(r *Request) interface{} {
+			b := make(map[string]interface{})
+			_ = json.Unmarshal(r.Body, &b)
+			bodies[path] = b
+			return data
+		}
+	}
+	rr.handle(http.MethodPost, "/api/v1/orders", record("/api/v1/orders", &CreateOrderResultModel{OrderId: "o1"}))
+	rr.handle(http.MethodPost, "/api/v1/hf/orders", record("/api/v1/hf/orders", &HfPlaceOrderRes{OrderId: "o2"}))
+	rr.handle(http.MethodPost, "/api/v3/hf/margin/order", record("/api/v3/hf/margin/order", map[string]string{"orderId": "o3", "borrowSize": "5"}))
+	rr.handle(http.MethodPost, "/api/v1/margin/order", record("/api/v1/margin/order", &UnifiedOrderResult{OrderId: "o4", LoanApplyId: "l1"}))
+	as := NewApiService(ApiRequesterOption(rr))
+	s := as.NewUnifiedOrderService(UnifiedOrderOpts{})
+	c := as.NewUnifiedOrderService(UnifiedOrderOpts{ClassicMargin: true})
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		s       *UnifiedOrderService
+		account AccountKind
+		path    string
+		orderId string
+		check   func(b map[string]interface{}) bool
+	}{
+		{s, AccountSpot, "/api/v1/orders", "o1", func(b map[string]interface{}) bool { return b["marginMode"] == nil }},
+		{s, AccountSpotHf, "/api/v1/hf/orders", "o2", func(b map[string]interface{}) bool { return b["type"] == "limit" && b["postOnly"] == "true" }},
+		{s, AccountIsolatedMargin, "/api/v3/hf/margin/order", "o3", func(b map[string]interface{}) bool { return b["isIsolated"] == true && b["autoBorrow"] == true }},
+		{s, AccountCrossMargin, "/api/v3/hf/margin/order", "o3", func(b map[string]interface{}) bool { return b["isIsolated"] == false }},
+		{c, AccountCrossMargin, "/api/v1/margin/order", "o4", func(b map[string]interface{}) bool { return b["marginMode"] == "cross" }},
+	} {
+		o := &UnifiedOrderRequest{Account: tc.account, Symbol: "KCS-USDT", Side: "buy", Price: "10", Size: "1", PostOnly: true, AutoBorrow: true}
+		r, err := tc.s.PlaceOrder(ctx, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.OrderId != tc.orderId || r.Account != tc.account || r.ClientOid == "" || r.ClientOid != o.ClientOid {
+			t.Errorf("Unexpected result of %s: %s", tc.account, ToJsonString(r))
+		}
+		if b := bodies[tc.path]; b["clientOid"] != r.ClientOid || !tc.check(b) {
+			t.Errorf("Unexpected request of %s: %s", tc.account, ToJsonString(b))
+		}
+	}
+	if r, _ := c.PlaceOrder(ctx, &UnifiedOrderRequest{Account: AccountIsolatedMargin, ClientOid: "c1"}); r.LoanApplyId != "l1" || bodies["/api/v1/margin/order"]["marginMode"] != "isolated" {
+		t.Errorf("Unexpected result: %s", ToJsonString(r))
+	}
+	if _, err := s.PlaceOrder(ctx, &UnifiedOrderRequest{Account: "futures"}); err == nil {
+		t.Error("Expected an error of the unknown account")
+	}
+}
+
+func TestUnifiedOrderService_Order(t *testing.T) {
+	rr := newRouteRequester()
+	rr.handle(http.MethodGet, "/api/v1/orders/o1", func(r *Request) interface{} {
+		return &OrderModel{Id: "o1", IsActive: false, DealSize: "1"}
+	})
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/o2", func(r *Request) interface{} {
+		return &HfOrderModel{Id: "o2", Active: true, DealSize: "0.5"}
+	})
+	rr.handle(http.MethodGet, "/api/v3/hf/margin/orders/client-order/c3?symbol=KCS-USDT", func(r *Request) interface{} {
+		// A partly filled order cancelled without cancelExist
+		return map[string]interface{}{"id": "671667306afcdb000723107f", "clientOid": "c3", "active": false,
+			"dealSize": "0.5", "cancelledSize": "0.5", "cancelExist": false, "createdAt": 1729521459000}
+	})
+	rr.handle(http.MethodDelete, "/api/v1/hf/orders/client-order/c2", func(r *Request) interface{} {
+		return &CancelOrderByClientResultModel{ClientOid: "c2"}
+	})
+	rr.handle(http.MethodDelete, "/api/v1/orders/o1", func(r *Request) interface{} {
+		return &CancelOrderResultModel{CancelledOrderIds: []string{"o1"}}
+	})
+	s := NewApiService(ApiRequesterOption(rr)).NewUnifiedOrderService(UnifiedOrderOpts{})
+	ctx := context.Background()
+
+	if o, err := s.Order(ctx, AccountSpot, "KCS-USDT", "o1"); err != nil || o.State != OrderStateFilled {
+		t.Errorf("Unexpected order %s with error %v", ToJsonString(o), err)
+	}
+	if o, err := s.Order(ctx, AccountSpotHf, "KCS-USDT", "o2"); err != nil || o.State != OrderStatePartiallyFilled {
+		t.Errorf("Unexpected order %s with error %v", ToJsonString(o), err)
+	}
+	if o, err := s.OrderByClientOid(ctx, AccountCrossMargin, "KCS-USDT", "c3"); err != nil || o.Id != "671667306afcdb000723107f" || o.State != OrderStateCancelled || o.CreatedAt != 1729521459000 {
+		t.Errorf("Unexpected order %s with error %v", ToJsonString(o), err)
+	}
+	if err := s.CancelOrderByClientOid(ctx, AccountSpotHf, "KCS-USDT", "c2"); err != nil {
+		t.Error(err)
+	}
+	if err := s.CancelOrder(ctx, AccountSpot, "KCS-USDT", "o1"); err != nil {
+		t.Error(err)
+	}
+	if err := s.CancelOrder(ctx, AccountSpotHf, "KCS-USDT", "missing"); err == nil {
+		t.Error("Expected an error of the missing order")
+	}
+}
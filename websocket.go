@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -68,6 +70,8 @@ const (
 	Message            = "message"
 	Notice             = "notice"
 	Command            = "command"
+	OpenTunnelMessage  = "openTunnel"
+	CloseTunnelMessage = "closeTunnel"
 )
 
 // A WebSocketMessage represents a message between the WebSocket client and server.
@@ -82,12 +86,31 @@ type WebSocketSubscribeMessage struct {
 	Topic          string `json:"topic"`
 	PrivateChannel bool   `json:"privateChannel"`
 	Response       bool   `json:"response"`
+	// TunnelId scopes the subscription to a tunnel opened by OpenTunnel.
+	TunnelId string `json:"tunnelId,omitempty"`
+}
+
+// lastMessageId is the latest id returned by newMessageId.
+var lastMessageId int64
+
+// newMessageId returns a unique id for an upstream message,
+// derived from the current time and strictly increasing within the process.
+func newMessageId() string {
+	for {
+		id, last := time.Now().UnixNano(), atomic.LoadInt64(&lastMessageId)
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastMessageId, last, id) {
+			return IntToString(id)
+		}
+	}
 }
 
 // NewPingMessage creates a ping message instance.
 func NewPingMessage() *WebSocketMessage {
 	return &WebSocketMessage{
-		Id:   IntToString(time.Now().UnixNano()),
+		Id:   newMessageId(),
 		Type: PingMessage,
 	}
 }
@@ -96,7 +119,7 @@ func NewPingMessage() *WebSocketMessage {
 func NewSubscribeMessage(topic string, privateChannel bool) *WebSocketSubscribeMessage {
 	return &WebSocketSubscribeMessage{
 		WebSocketMessage: &WebSocketMessage{
-			Id:   IntToString(time.Now().UnixNano()),
+			Id:   newMessageId(),
 			Type: SubscribeMessage,
 		},
 		Topic:          topic,
@@ -112,7 +135,7 @@ type WebSocketUnsubscribeMessage WebSocketSubscribeMessage
 func NewUnsubscribeMessage(topic string, privateChannel bool) *WebSocketUnsubscribeMessage {
 	return &WebSocketUnsubscribeMessage{
 		WebSocketMessage: &WebSocketMessage{
-			Id:   IntToString(time.Now().UnixNano()),
+			Id:   newMessageId(),
 			Type: UnsubscribeMessage,
 		},
 		Topic:          topic,
@@ -124,10 +147,11 @@ func NewUnsubscribeMessage(topic string, privateChannel bool) *WebSocketUnsubscr
 // A WebSocketDownstreamMessage represents a message from the WebSocket server to client.
 type WebSocketDownstreamMessage struct {
 	*WebSocketMessage
-	Sn      int64           `json:"sn"`
-	Topic   string          `json:"topic"`
-	Subject string          `json:"subject"`
-	RawData json.RawMessage `json:"data"`
+	Sn       int64           `json:"sn"`
+	Topic    string          `json:"topic"`
+	Subject  string          `json:"subject"`
+	TunnelId string          `json:"tunnelId,omitempty"`
+	RawData  json.RawMessage `json:"data"`
 }
 
 // ReadData read the data in channel.
@@ -135,36 +159,216 @@ func (m *WebSocketDownstreamMessage) ReadData(v interface{}) error {
 	return json.Unmarshal(m.RawData, v)
 }
 
+// A WebSocketState represents the state of the connection of a WebSocketClient.
+type WebSocketState int32
+
+// All states of a WebSocketClient.
+const (
+	// WebSocketIdle is the state before connecting.
+	WebSocketIdle WebSocketState = iota
+	// WebSocketConnecting is the state of the first dial.
+	WebSocketConnecting
+	// WebSocketConnected is the state after the welcome message is received.
+	WebSocketConnected
+	// WebSocketReconnecting is the state after a connection broke, until a new one is connected.
+	WebSocketReconnecting
+	// WebSocketClosed is the terminal state, all goroutines have quit.
+	WebSocketClosed
+)
+
+// String returns the name of the state.
+func (s WebSocketState) String() string {
+	switch s {
+	case WebSocketIdle:
+		return "idle"
+	case WebSocketConnecting:
+		return "connecting"
+	case WebSocketConnected:
+		return "connected"
+	case WebSocketReconnecting:
+		return "reconnecting"
+	case WebSocketClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 // A WebSocketClient represents a connection to WebSocket server.
 type WebSocketClient struct {
 	// Wait all goroutines quit
 	wg *sync.WaitGroup
 	// Stop subscribing channel
-	done chan struct{}
-	// Pong channel to check pong message
-	pongs chan string
-	// ACK channel to check pong message
-	acks chan string
-	// Error channel
+	done     chan struct{}
+	stopOnce sync.Once
+	// Closed when all goroutines quit
+	stopped chan struct{}
+	// Set to 1 once the goroutines are started
+	started int32
+	// Current state and terminal error
+	stateMu     sync.Mutex
+	state       WebSocketState
+	err         error
+	stateChange func(from, to WebSocketState)
+	// Requests waiting for a reply, keyed by message id
+	pendingMu sync.Mutex
+	pending   map[string]chan *webSocketReply
+	// Subscribed channels, subscribed again after reconnecting
+	subscriptionsMu sync.Mutex
+	subscriptions   map[string]*WebSocketSubscribeMessage
+	// Tunnels by id, the messages of a tunnel are routed to it
+	tunnelsMu sync.Mutex
+	tunnels   map[string]*WebSocketTunnel
+	// Error channel, receives the terminal error only
 	errors chan error
+	// Outbound frame queue, drained by the writer goroutine only
+	writes chan *webSocketWrite
+	// Downstream message buffer, applies the backpressure policy
+	queue *webSocketMessageQueue
+	// Heartbeat and feed metrics
+	metrics *webSocketMetrics
 	// Downstream message channel
-	messages        chan *WebSocketDownstreamMessage
-	conn            *websocket.Conn
-	token           *WebSocketTokenModel
-	server          *WebSocketServerModel
-	enableHeartbeat bool
-	skipVerifyTls   bool
-	timeout         time.Duration
+	messages          chan *WebSocketDownstreamMessage
+	dialer            *websocket.Dialer
+	transport         WebSocketDialer
+	header            http.Header
+	token             *WebSocketTokenModel
+	tokenProvider     func(ctx context.Context) (*WebSocketTokenModel, error)
+	reconnectAttempts int
+	reconnectDelay    time.Duration
+	timeout           time.Duration
+}
+
+// A webSocketSession is a single connection of the client with its own goroutines,
+// it is replaced by a new one after reconnecting.
+type webSocketSession struct {
+	conn   WebSocketConn
+	server *WebSocketServerModel
+	// Pong channel to check pong message
+	pongs chan string
+	// Cancelled to stop the goroutines of the session
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// Closed when the connection broke
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error
+}
+
+// fail records the first error breaking the session.
+func (s *webSocketSession) fail(err error) {
+	s.failOnce.Do(func() {
+		s.err = err
+		close(s.failed)
+	})
+}
+
+// A webSocketReply represents the frame replied to a request, or the error failing the request.
+type webSocketReply struct {
+	raw json.RawMessage
+	err error
+}
+
+// A webSocketWrite represents an outbound frame waiting in the send queue.
+type webSocketWrite struct {
+	ctx  context.Context
+	data []byte
+	err  chan error
 }
 
 var defaultTimeout = time.Second * 5
 
+// defaultSendQueueSize is the capacity of the outbound frame queue.
+const defaultSendQueueSize = 64
+
+// defaultReadBufferSize is the size of the read buffer of the connection.
+const defaultReadBufferSize = 2048000 //2000 kb
+
+// defaultHandshakeTimeout is the timeout of the WebSocket handshake.
+const defaultHandshakeTimeout = 45 * time.Second
+
 // WebSocketClientOpts defines the options for the client
 // during the websocket connection.
 type WebSocketClientOpts struct {
 	Token         *WebSocketTokenModel
 	TLSSkipVerify bool
 	Timeout       time.Duration
+	// SendQueueSize is the capacity of the outbound frame queue, 64 by default.
+	// Senders block when the queue is full.
+	SendQueueSize int
+	// MessageBufferSize is the capacity of the downstream message buffer, 2048 by default.
+	MessageBufferSize int
+	// Backpressure is the policy applied when the downstream message buffer is full, BackpressureBlock by default.
+	Backpressure WebSocketBackpressure
+	// ConflateKey keys the messages conflated by BackpressureConflate, TickerConflateKey by default.
+	// Messages with an empty key are never conflated.
+	ConflateKey func(m *WebSocketDownstreamMessage) string
+
+	// HandshakeTimeout is the timeout of the WebSocket handshake, 45s by default.
+	HandshakeTimeout time.Duration
+	// ReadBufferSize is the size of the read buffer of the connection, 2000kb by default.
+	ReadBufferSize int
+	// WriteBufferSize is the size of the write buffer of the connection, 4kb by default.
+	WriteBufferSize int
+	// EnableCompression negotiates the permessage-deflate compression with the server.
+	EnableCompression bool
+	// Header is the additional HTTP header sent in the handshake.
+	Header http.Header
+	// TLSConfig is the TLS configuration of the connection, TLSSkipVerify is applied to a copy of it.
+	TLSConfig *tls.Config
+	// NetDialContext dials the TCP connection, net.Dialer is used by default.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Proxy returns the proxy of the handshake request, http.ProxyFromEnvironment by default.
+	Proxy func(*http.Request) (*url.URL, error)
+	// Dialer dials the connections instead of the gorilla dialer configured by the options above,
+	// e.g. an in-memory server in tests.
+	Dialer WebSocketDialer
+
+	// ReconnectAttempts is the number of attempts to reconnect a broken connection before the client is closed,
+	// 0 disables reconnecting. The subscribed channels are subscribed again after reconnecting.
+	ReconnectAttempts int
+	// ReconnectDelay is the delay before a reconnecting attempt, 1s by default.
+	// It doubles after each failure up to 30s.
+	ReconnectDelay time.Duration
+	// TokenProvider returns the token before a reconnecting attempt, the initial token is reused by default.
+	TokenProvider func(ctx context.Context) (*WebSocketTokenModel, error)
+	// StateChange is called on every state transition of the client, it must not block.
+	StateChange func(from, to WebSocketState)
+	// MessageLag measures the lag of the messages from the timestamps in their payloads,
+	// which are decoded again on the read goroutine. It is disabled by default.
+	MessageLag bool
+	// Clock is the server clock the message lag is measured against, the local clock by default.
+	Clock *ServerClock
+}
+
+// newWebSocketDialer creates a dialer owned by a client from the options.
+func newWebSocketDialer(opts WebSocketClientOpts) *websocket.Dialer {
+	tc := &tls.Config{}
+	if opts.TLSConfig != nil {
+		tc = opts.TLSConfig.Clone()
+	}
+	if opts.TLSSkipVerify {
+		tc.InsecureSkipVerify = true
+	}
+	d := &websocket.Dialer{
+		NetDialContext:    opts.NetDialContext,
+		Proxy:             opts.Proxy,
+		TLSClientConfig:   tc,
+		HandshakeTimeout:  opts.HandshakeTimeout,
+		ReadBufferSize:    opts.ReadBufferSize,
+		WriteBufferSize:   opts.WriteBufferSize,
+		EnableCompression: opts.EnableCompression,
+	}
+	if d.Proxy == nil {
+		d.Proxy = http.ProxyFromEnvironment
+	}
+	if d.HandshakeTimeout <= 0 {
+		d.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if d.ReadBufferSize <= 0 {
+		d.ReadBufferSize = defaultReadBufferSize
+	}
+	return d
 }
 
 // NewWebSocketClient creates an instance of WebSocketClient.
@@ -178,28 +382,149 @@ func (as *ApiService) NewWebSocketClient(token *WebSocketTokenModel) *WebSocketC
 
 // NewWebSocketClientOpts creates an instance of WebSocketClient with the parsed options.
 func (as *ApiService) NewWebSocketClientOpts(opts WebSocketClientOpts) *WebSocketClient {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.SendQueueSize <= 0 {
+		opts.SendQueueSize = defaultSendQueueSize
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = defaultReconnectDelay
+	}
 	wc := &WebSocketClient{
-		wg:            &sync.WaitGroup{},
-		done:          make(chan struct{}),
-		errors:        make(chan error, 1),
-		pongs:         make(chan string, 1),
-		acks:          make(chan string, 1),
-		token:         opts.Token,
-		messages:      make(chan *WebSocketDownstreamMessage, 2048),
-		skipVerifyTls: opts.TLSSkipVerify,
-		timeout:       opts.Timeout,
+		wg:                &sync.WaitGroup{},
+		done:              make(chan struct{}),
+		stopped:           make(chan struct{}),
+		stateChange:       opts.StateChange,
+		errors:            make(chan error, 1),
+		pending:           make(map[string]chan *webSocketReply),
+		subscriptions:     make(map[string]*WebSocketSubscribeMessage),
+		tunnels:           make(map[string]*WebSocketTunnel),
+		writes:            make(chan *webSocketWrite, opts.SendQueueSize),
+		token:             opts.Token,
+		tokenProvider:     opts.TokenProvider,
+		reconnectAttempts: opts.ReconnectAttempts,
+		reconnectDelay:    opts.ReconnectDelay,
+		queue:             newWebSocketMessageQueue(opts.MessageBufferSize, opts.Backpressure, opts.ConflateKey),
+		metrics:           newWebSocketMetrics(opts.Clock, opts.MessageLag),
+		messages:          make(chan *WebSocketDownstreamMessage),
+		dialer:            newWebSocketDialer(opts),
+		header:            opts.Header.Clone(),
+		timeout:           opts.Timeout,
+	}
+	wc.transport = opts.Dialer
+	if wc.transport == nil {
+		wc.transport = &webSocketDialer{dialer: wc.dialer}
 	}
 	return wc
 }
 
+// State returns the current state of the client.
+func (wc *WebSocketClient) State() WebSocketState {
+	wc.stateMu.Lock()
+	defer wc.stateMu.Unlock()
+	return wc.state
+}
+
+// Done returns a channel closed when the client is closed and all goroutines have quit.
+func (wc *WebSocketClient) Done() <-chan struct{} {
+	return wc.stopped
+}
+
+// Err returns the terminal error of the client after Done is closed,
+// it is nil if the client was stopped by Stop.
+func (wc *WebSocketClient) Err() error {
+	wc.stateMu.Lock()
+	defer wc.stateMu.Unlock()
+	return wc.err
+}
+
+// setState moves the client to the state, the closed state is terminal.
+func (wc *WebSocketClient) setState(to WebSocketState) {
+	wc.stateMu.Lock()
+	from := wc.state
+	if from == to || from == WebSocketClosed {
+		wc.stateMu.Unlock()
+		return
+	}
+	wc.state = to
+	wc.stateMu.Unlock()
+	wc.notifyState(from, to)
+}
+
+// transit moves the client from the state to another one, it reports false if the client is in another state.
+func (wc *WebSocketClient) transit(from, to WebSocketState) bool {
+	wc.stateMu.Lock()
+	if wc.state != from {
+		wc.stateMu.Unlock()
+		return false
+	}
+	wc.state = to
+	wc.stateMu.Unlock()
+	wc.notifyState(from, to)
+	return true
+}
+
+func (wc *WebSocketClient) notifyState(from, to WebSocketState) {
+	if DebugMode {
+		logrus.Debugf("WebSocket state changed: %s => %s", from, to)
+	}
+	if wc.stateChange != nil {
+		wc.stateChange(from, to)
+	}
+}
+
 // Connect connects the WebSocket server.
 func (wc *WebSocketClient) Connect() (<-chan *WebSocketDownstreamMessage, <-chan error, error) {
-	// Find out a server
-	s, err := wc.token.Servers.RandomServer()
+	return wc.ConnectContext(context.Background())
+}
+
+// ConnectContext connects the WebSocket server, ctx bounds the dial and the wait of the welcome message.
+// The connection lives until ctx is done, Stop is called or it breaks without reconnecting,
+// then all goroutines quit and the message and error channels are closed.
+// The error channel receives the terminal error only, which is also returned by Err.
+// The client is closed if it fails to connect, and it connects once only.
+func (wc *WebSocketClient) ConnectContext(ctx context.Context) (<-chan *WebSocketDownstreamMessage, <-chan error, error) {
+	select {
+	case <-wc.done:
+		return wc.messages, wc.errors, errors.New("WebSocket client has been stopped")
+	default:
+	}
+
+	if !wc.transit(WebSocketIdle, WebSocketConnecting) {
+		return wc.messages, wc.errors, errors.New("WebSocket client has been connected")
+	}
+	s, err := wc.dial(ctx)
 	if err != nil {
+		wc.close(err)
 		return wc.messages, wc.errors, err
 	}
-	wc.server = s
+
+	atomic.StoreInt32(&wc.started, 1)
+	wc.wg.Add(2)
+	go wc.deliver(wc.queue, wc.messages, nil)
+	go wc.run(s)
+	wc.setState(WebSocketConnected)
+
+	// Stop when the parent context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			wc.close(ctx.Err())
+		case <-wc.done:
+		}
+	}()
+
+	return wc.messages, wc.errors, nil
+}
+
+// dial connects a server of the token, and starts the goroutines of the session after the welcome message.
+func (wc *WebSocketClient) dial(ctx context.Context) (*webSocketSession, error) {
+	// Find out a server
+	server, err := wc.token.Servers.RandomServer()
+	if err != nil {
+		return nil, err
+	}
 
 	// Concat ws url
 	q := url.Values{}
@@ -208,176 +533,558 @@ func (wc *WebSocketClient) Connect() (<-chan *WebSocketDownstreamMessage, <-chan
 	if wc.token.AcceptUserMessage == true {
 		q.Add("acceptUserMessage", "true")
 	}
-	u := fmt.Sprintf("%s?%s", s.Endpoint, q.Encode())
-
-	// Ignore verify tls
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: wc.skipVerifyTls}
+	u := fmt.Sprintf("%s?%s", server.Endpoint, q.Encode())
 
 	// Connect ws server
-	websocket.DefaultDialer.ReadBufferSize = 2048000 //2000 kb
-	wc.conn, _, err = websocket.DefaultDialer.Dial(u, nil)
+	conn, err := wc.transport.DialContext(ctx, u, wc.header)
 	if err != nil {
-		return wc.messages, wc.errors, err
+		return nil, err
 	}
 
 	// Must read the first welcome message
+	if err := wc.readWelcome(ctx, conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	s := &webSocketSession{
+		conn:   conn,
+		server: server,
+		pongs:  make(chan string, 1),
+		failed: make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(3)
+	go wc.read(s)
+	go wc.write(s)
+	go wc.keepHeartbeat(s)
+	return s, nil
+}
+
+// readWelcome waits for the welcome message within the timeout of the client, or until ctx is done.
+func (wc *WebSocketClient) readWelcome(ctx context.Context, conn WebSocketConn) error {
+	deadline := time.Now().Add(wc.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+
+	// Interrupt the blocking read once ctx is done
+	quit, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-quit:
+		}
+	}()
+	err := wc.waitWelcome(ctx, conn)
+	// The deadline is cleared after the interruption has quit, which would break the session otherwise
+	close(quit)
+	<-exited
+	if err != nil {
+		return err
+	}
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// waitWelcome reads the messages until the welcome message.
+func (wc *WebSocketClient) waitWelcome(ctx context.Context, conn WebSocketConn) error {
 	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.Errorf("Wait welcome message failed, %s", ctx.Err())
+			}
+			return errors.Errorf("Wait welcome message failed, %s", err.Error())
+		}
 		m := &WebSocketDownstreamMessage{}
-		if err := wc.conn.ReadJSON(m); err != nil {
-			return wc.messages, wc.errors, err
+		if err := json.Unmarshal(b, m); err != nil {
+			return errors.Errorf("Wait welcome message failed, %s", err.Error())
 		}
 		if DebugMode {
 			logrus.Debugf("Received a WebSocket message: %s", ToJsonString(m))
 		}
 		if m.Type == ErrorMessage {
-			return wc.messages, wc.errors, errors.Errorf("Error message: %s", ToJsonString(m))
+			return errors.Errorf("Error message: %s", ToJsonString(m))
 		}
 		if m.Type == WelcomeMessage {
-			break
+			return nil
 		}
 	}
+}
 
-	wc.wg.Add(2)
-	go wc.read()
-	go wc.keepHeartbeat()
+// run supervises the sessions, it reconnects a broken session or closes the client.
+func (wc *WebSocketClient) run(s *webSocketSession) {
+	defer wc.wg.Done()
 
-	return wc.messages, wc.errors, nil
+	for {
+		select {
+		case <-wc.done:
+			wc.closeSession(s, errors.New("WebSocket client has been stopped"))
+			return
+		case <-s.failed:
+		}
+
+		wc.closeSession(s, s.err)
+		if wc.reconnectAttempts <= 0 {
+			wc.terminate(s.err)
+			return
+		}
+		wc.setState(WebSocketReconnecting)
+		ns, err := wc.reconnect(s.err)
+		if err != nil {
+			wc.terminate(err)
+			return
+		}
+		s = ns
+		wc.setState(WebSocketConnected)
+	}
 }
 
-func (wc *WebSocketClient) read() {
-	defer func() {
-		close(wc.pongs)
-		close(wc.messages)
-		wc.wg.Done()
-	}()
+// closeSession stops the goroutines of the session, and fails the requests waiting for a reply.
+func (wc *WebSocketClient) closeSession(s *webSocketSession, err error) {
+	s.cancel()
+	_ = s.conn.Close()
+	s.wg.Wait()
+	wc.failPending(errors.Errorf("WebSocket connection has been closed, %s", err))
+}
 
-	for {
+// reconnect dials a new session and subscribes the channels again.
+func (wc *WebSocketClient) reconnect(cause error) (*webSocketSession, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
 		select {
 		case <-wc.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delay, err := wc.reconnectDelay, cause
+	for i := 0; i < wc.reconnectAttempts; i++ {
+		if DebugMode {
+			logrus.Debugf("Reconnect the WebSocket in %v, %s", delay, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, errors.New("WebSocket client has been stopped")
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+
+		if wc.tokenProvider != nil {
+			tk, terr := wc.tokenProvider(ctx)
+			if terr != nil {
+				err = terr
+				continue
+			}
+			wc.token = tk
+		}
+		s, derr := wc.dial(ctx)
+		if derr != nil {
+			err = derr
+			continue
+		}
+		if err = wc.resubscribe(ctx); err != nil {
+			wc.closeSession(s, err)
+			continue
+		}
+		return s, nil
+	}
+	return nil, errors.Errorf("Reconnect failed after %d attempts, %s", wc.reconnectAttempts, err)
+}
+
+// resubscribe opens the tunnels and subscribes the channels subscribed before reconnecting.
+func (wc *WebSocketClient) resubscribe(ctx context.Context) error {
+	wc.tunnelsMu.Lock()
+	tunnels := make([]string, 0, len(wc.tunnels))
+	for id := range wc.tunnels {
+		tunnels = append(tunnels, id)
+	}
+	wc.tunnelsMu.Unlock()
+	for _, id := range tunnels {
+		m := NewOpenTunnelMessage(id)
+		if _, err := wc.Request(ctx, m.Id, m); err != nil {
+			return errors.Errorf("Reopen tunnel %s failed, %s", id, err.Error())
+		}
+	}
+
+	wc.subscriptionsMu.Lock()
+	channels := make([]*WebSocketSubscribeMessage, 0, len(wc.subscriptions))
+	for _, c := range wc.subscriptions {
+		channels = append(channels, c)
+	}
+	wc.subscriptionsMu.Unlock()
+
+	for _, c := range channels {
+		// A new message id for every attempt
+		sc := NewSubscribeMessage(c.Topic, c.PrivateChannel)
+		sc.Response = c.Response
+		sc.TunnelId = c.TunnelId
+		if _, err := wc.Request(ctx, sc.Id, sc); err != nil {
+			return errors.Errorf("Resubscribe %s failed, %s", c.Topic, err.Error())
+		}
+	}
+	return nil
+}
+
+// terminate closes the client with the error of the broken connection.
+func (wc *WebSocketClient) terminate(err error) {
+	// The error channel receives the terminal error only, so it never blocks
+	select {
+	case wc.errors <- err:
+	default:
+	}
+	wc.close(err)
+}
+
+// close stops the client once with the terminal error,
+// the channels are closed when all goroutines quit.
+func (wc *WebSocketClient) close(err error) {
+	wc.stopOnce.Do(func() {
+		wc.stateMu.Lock()
+		wc.err = err
+		wc.stateMu.Unlock()
+		close(wc.done)
+		// Wait for OpenTunnel to start the goroutine of a tunnel
+		wc.tunnelsMu.Lock()
+		wc.tunnelsMu.Unlock()
+		go func() {
+			wc.wg.Wait()
+			// The deliver goroutine closes the message channel if it has been started
+			if atomic.LoadInt32(&wc.started) == 0 {
+				close(wc.messages)
+			}
+			close(wc.errors)
+			wc.setState(WebSocketClosed)
+			close(wc.stopped)
+		}()
+	})
+}
+
+func (wc *WebSocketClient) read(s *webSocketSession) {
+	defer s.wg.Done()
+
+	for {
+		_, b, err := s.conn.ReadMessage()
+		if err != nil {
+			s.fail(err)
 			return
-		default:
-			m := &WebSocketDownstreamMessage{}
-			if err := wc.conn.ReadJSON(m); err != nil {
-				wc.errors <- err
-				return
+		}
+		if DebugMode {
+			logrus.Debugf("Received a WebSocket message: %s", b)
+		}
+		m := &WebSocketDownstreamMessage{}
+		if err := json.Unmarshal(b, m); err != nil {
+			s.fail(err)
+			return
+		}
+		switch m.Type {
+		case WelcomeMessage:
+		case PongMessage:
+			select {
+			case s.pongs <- m.Id:
+			default:
 			}
-			if DebugMode {
-				logrus.Debugf("Received a WebSocket message: %s", ToJsonString(m))
+		case AckMessage:
+			if !wc.resolvePending(m.Id, b, nil) && DebugMode {
+				logrus.Debugf("Received an unexpected ack: %s", m.Id)
 			}
-			// log.Printf("ReadJSON: %s", ToJsonString(m))
-			switch m.Type {
-			case WelcomeMessage:
-			case PongMessage:
-				if wc.enableHeartbeat {
-					wc.pongs <- m.Id
-				}
-			case AckMessage:
-				// log.Printf("Subscribed: %s==%s? %s", channel.Id, m.Id, channel.Topic)
-				wc.acks <- m.Id
-			case ErrorMessage:
-				wc.errors <- errors.Errorf("Error message: %s", ToJsonString(m))
+		case ErrorMessage:
+			// An error replied to a request fails that request only
+			if wc.resolvePending(m.Id, b, errors.Errorf("Error message: %s", b)) {
+				continue
+			}
+			s.fail(errors.Errorf("Error message: %s", b))
+			return
+		case Message, Notice, Command:
+			wc.metrics.received(m, time.Now())
+			q := wc.route(m)
+			if q != nil && !q.push(m, s.ctx.Done()) {
 				return
-			case Message, Notice, Command:
-				wc.messages <- m
-			default:
-				wc.errors <- errors.Errorf("Unknown message type: %s", m.Type)
 			}
+		default:
+			// Other replies correlated by id, e.g. the responses of the trade operations
+			if !wc.resolvePending(m.Id, b, nil) && DebugMode {
+				logrus.Debugf("Unknown message type: %s", m.Type)
+			}
+		}
+	}
+}
+
+// route returns the buffer of the message, i.e. the one of its tunnel or the client.
+// It returns nil for a message of a closed tunnel.
+func (wc *WebSocketClient) route(m *WebSocketDownstreamMessage) *webSocketMessageQueue {
+	if m.TunnelId == "" {
+		return wc.queue
+	}
+	wc.tunnelsMu.Lock()
+	defer wc.tunnelsMu.Unlock()
+	if t, ok := wc.tunnels[m.TunnelId]; ok {
+		return t.queue
+	}
+	if DebugMode {
+		logrus.Debugf("Drop a message of the closed tunnel %s", m.TunnelId)
+	}
+	return nil
+}
+
+// deliver hands the messages buffered in q over to the consumer of c until the client or stop is done.
+func (wc *WebSocketClient) deliver(q *webSocketMessageQueue, c chan *WebSocketDownstreamMessage, stop <-chan struct{}) {
+	defer func() {
+		close(c)
+		wc.wg.Done()
+	}()
+
+	for {
+		m, ok := q.pop(wc.done)
+		if !ok {
+			return
+		}
+		select {
+		case c <- m:
+			q.delivered()
+		case <-wc.done:
+			return
+		case <-stop:
+			return
 		}
 	}
 }
 
-func (wc *WebSocketClient) keepHeartbeat() {
-	wc.enableHeartbeat = true
+// Metrics returns the rolling ping round trip time, and the lag and rate of the messages per topic.
+func (wc *WebSocketClient) Metrics() WebSocketMetrics {
+	return wc.metrics.snapshot()
+}
+
+// MessageStats returns the counters of the downstream message buffer.
+func (wc *WebSocketClient) MessageStats() WebSocketMessageStats {
+	return wc.queue.snapshot()
+}
+
+func (wc *WebSocketClient) keepHeartbeat(s *webSocketSession) {
 	// New ticker to send ping message
-	pt := time.NewTicker(time.Duration(wc.server.PingInterval)*time.Millisecond - time.Millisecond*200)
-	defer wc.wg.Done()
+	pt := time.NewTicker(time.Duration(s.server.PingInterval)*time.Millisecond - time.Millisecond*200)
+	defer s.wg.Done()
 	defer pt.Stop()
 
 	for {
 		select {
-		case <-wc.done:
+		case <-s.ctx.Done():
 			return
 		case <-pt.C:
 			p := NewPingMessage()
-			m := ToJsonString(p)
-			if DebugMode {
-				logrus.Debugf("Sent a WebSocket message: %s", m)
-			}
-			if err := wc.conn.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
-				wc.errors <- err
+			sent := time.Now()
+			if err := wc.Send(s.ctx, p); err != nil {
+				s.fail(err)
 				return
 			}
 
-			// log.Printf("Ping: %s", ToJsonString(p))
 			// Waiting (with timeout) for the server to response pong message
 			// If timeout, close this connection
-			select {
-			case pid := <-wc.pongs:
-				if pid != p.Id {
-					wc.errors <- errors.Errorf("Invalid pong id %s, expect %s", pid, p.Id)
+			timeout := time.After(time.Duration(s.server.PingTimeout) * time.Millisecond)
+		wait:
+			for {
+				select {
+				case pid := <-s.pongs:
+					// Skip the pong of a stale ping
+					if pid == p.Id {
+						wc.metrics.heartbeat(time.Since(sent))
+						break wait
+					}
+				case <-timeout:
+					s.fail(errors.Errorf("Wait pong message timeout in %d ms", s.server.PingTimeout))
+					return
+				case <-s.ctx.Done():
 					return
 				}
-			case <-time.After(time.Duration(wc.server.PingTimeout) * time.Millisecond):
-				wc.errors <- errors.Errorf("Wait pong message timeout in %d ms", wc.server.PingTimeout)
+			}
+		}
+	}
+}
+
+func (wc *WebSocketClient) write(s *webSocketSession) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case w := <-wc.writes:
+			// The sender has given up waiting, drop the frame
+			if err := w.ctx.Err(); err != nil {
+				w.err <- err
+				continue
+			}
+			if DebugMode {
+				logrus.Debugf("Sent a WebSocket message: %s", w.data)
+			}
+			_ = s.conn.SetWriteDeadline(time.Now().Add(wc.timeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, w.data); err != nil {
+				w.err <- err
+				s.fail(err)
 				return
 			}
+			w.err <- nil
 		}
 	}
 }
 
+// Send encodes v as JSON and queues it for the writer goroutine,
+// then waits until the frame has been written to the connection.
+// If ctx has no deadline, the timeout of the client is applied.
+func (wc *WebSocketClient) Send(ctx context.Context, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wc.timeout)
+		defer cancel()
+	}
+
+	w := &webSocketWrite{ctx: ctx, data: b, err: make(chan error, 1)}
+	select {
+	case wc.writes <- w:
+	case <-wc.done:
+		return errors.New("WebSocket client has been stopped")
+	case <-ctx.Done():
+		return errors.Errorf("Send message failed, %s", ctx.Err())
+	}
+
+	select {
+	case err := <-w.err:
+		return err
+	case <-wc.done:
+		return errors.New("WebSocket client has been stopped")
+	case <-ctx.Done():
+		return errors.Errorf("Send message failed, %s", ctx.Err())
+	}
+}
+
+// resolvePending delivers the reply of the request with the id, and reports whether the request was pending.
+func (wc *WebSocketClient) resolvePending(id string, raw []byte, err error) bool {
+	wc.pendingMu.Lock()
+	defer wc.pendingMu.Unlock()
+	c, ok := wc.pending[id]
+	if ok {
+		delete(wc.pending, id)
+		c <- &webSocketReply{raw: raw, err: err}
+	}
+	return ok
+}
+
+// forgetPending removes the request with the id which is no longer waited for.
+func (wc *WebSocketClient) forgetPending(id string) {
+	wc.pendingMu.Lock()
+	defer wc.pendingMu.Unlock()
+	delete(wc.pending, id)
+}
+
+// failPending fails all pending requests with err.
+func (wc *WebSocketClient) failPending(err error) {
+	wc.pendingMu.Lock()
+	defer wc.pendingMu.Unlock()
+	for id, c := range wc.pending {
+		delete(wc.pending, id)
+		c <- &webSocketReply{err: err}
+	}
+}
+
+// Request sends v and waits for the frame replied with the same id, such as an ack.
+// An error message replied with the id fails the request.
+// If ctx has no deadline, the timeout of the client is applied.
+func (wc *WebSocketClient) Request(ctx context.Context, id string, v interface{}) (json.RawMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wc.timeout)
+		defer cancel()
+	}
+
+	reply := make(chan *webSocketReply, 1)
+	wc.pendingMu.Lock()
+	if _, ok := wc.pending[id]; ok {
+		wc.pendingMu.Unlock()
+		return nil, errors.Errorf("Duplicate message id %s", id)
+	}
+	wc.pending[id] = reply
+	wc.pendingMu.Unlock()
+
+	if err := wc.Send(ctx, v); err != nil {
+		wc.forgetPending(id)
+		return nil, err
+	}
+
+	select {
+	case r := <-reply:
+		return r.raw, r.err
+	case <-wc.done:
+		wc.forgetPending(id)
+		return nil, errors.New("WebSocket client has been stopped")
+	case <-ctx.Done():
+		wc.forgetPending(id)
+		return nil, errors.Errorf("Wait reply message failed, %s", ctx.Err())
+	}
+}
+
 // Subscribe subscribes the specified channel.
+// It is safe to call Subscribe from multiple goroutines, each ack is matched by the message id.
 func (wc *WebSocketClient) Subscribe(channels ...*WebSocketSubscribeMessage) error {
+	return wc.SubscribeContext(context.Background(), channels...)
+}
+
+// SubscribeContext subscribes the specified channel, ctx bounds the wait of every ack.
+func (wc *WebSocketClient) SubscribeContext(ctx context.Context, channels ...*WebSocketSubscribeMessage) error {
 	for _, c := range channels {
-		m := ToJsonString(c)
-		if DebugMode {
-			logrus.Debugf("Sent a WebSocket message: %s", m)
-		}
-		if err := wc.conn.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
-			return err
-		}
-		//log.Printf("Subscribing: %s, %s", c.Id, c.Topic)
-		select {
-		case id := <-wc.acks:
-			//log.Printf("ack: %s=>%s", id, c.Id)
-			if id != c.Id {
-				return errors.Errorf("Invalid ack id %s, expect %s", id, c.Id)
-			}
-		case err := <-wc.errors:
+		if _, err := wc.Request(ctx, c.Id, c); err != nil {
 			return errors.Errorf("Subscribe failed, %s", err.Error())
-		case <-time.After(wc.timeout):
-			return errors.Errorf("Wait ack message timeout in %v", wc.timeout)
 		}
+		wc.subscriptionsMu.Lock()
+		wc.subscriptions[subscriptionKey(c.TunnelId, c.Topic)] = c
+		wc.subscriptionsMu.Unlock()
 	}
 	return nil
 }
 
 // Unsubscribe unsubscribes the specified channel.
 func (wc *WebSocketClient) Unsubscribe(channels ...*WebSocketUnsubscribeMessage) error {
+	return wc.UnsubscribeContext(context.Background(), channels...)
+}
+
+// UnsubscribeContext unsubscribes the specified channel, ctx bounds the wait of every ack.
+func (wc *WebSocketClient) UnsubscribeContext(ctx context.Context, channels ...*WebSocketUnsubscribeMessage) error {
 	for _, c := range channels {
-		m := ToJsonString(c)
-		if DebugMode {
-			logrus.Debugf("Sent a WebSocket message: %s", m)
-		}
-		if err := wc.conn.WriteMessage(websocket.TextMessage, []byte(m)); err != nil {
-			return err
-		}
-		//log.Printf("Unsubscribing: %s, %s", c.Id, c.Topic)
-		select {
-		case id := <-wc.acks:
-			//log.Printf("ack: %s=>%s", id, c.Id)
-			if id != c.Id {
-				return errors.Errorf("Invalid ack id %s, expect %s", id, c.Id)
-			}
-		case <-time.After(wc.timeout):
-			return errors.Errorf("Wait ack message timeout in %v", wc.timeout)
+		if _, err := wc.Request(ctx, c.Id, c); err != nil {
+			return errors.Errorf("Unsubscribe failed, %s", err.Error())
 		}
+		wc.subscriptionsMu.Lock()
+		delete(wc.subscriptions, subscriptionKey(c.TunnelId, c.Topic))
+		wc.subscriptionsMu.Unlock()
 	}
 	return nil
 }
 
 // Stop stops subscribing the specified channel, all goroutines quit.
+// It is safe to call Stop more than once.
 func (wc *WebSocketClient) Stop() {
-	close(wc.done)
-	_ = wc.conn.Close()
-	wc.wg.Wait()
+	_ = wc.StopContext(context.Background())
+}
+
+// StopContext stops subscribing the specified channel, and waits for all goroutines to quit until ctx is done.
+// The message and error channels are closed once all goroutines quit.
+func (wc *WebSocketClient) StopContext(ctx context.Context) error {
+	wc.close(nil)
+
+	select {
+	case <-wc.stopped:
+		return nil
+	case <-ctx.Done():
+		return errors.Errorf("Wait goroutines to quit failed, %s", ctx.Err())
+	}
 }
@@ -0,0 +1,624 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// fakeWebSocketEndpoint is the endpoint of the tokens of a fakeWebSocketServer.
+const fakeWebSocketEndpoint = "fake://kucoin"
+
+// A fakeWebSocketRequest represents an upstream message received by a fakeWebSocketServer.
+type fakeWebSocketRequest struct {
+	Id             string          `json:"id"`
+	Type           string          `json:"type"`
+	Topic          string          `json:"topic"`
+	PrivateChannel bool            `json:"privateChannel"`
+	Response       bool            `json:"response"`
+	TunnelId       string          `json:"tunnelId"`
+	NewTunnelId    string          `json:"newTunnelId"`
+	Raw            json.RawMessage `json:"-"`
+}
+
+// A fakeWebSocketHandler handles an upstream message before the fake server,
+// it returns true if the message has been handled, or false to fall back to the default handling.
+type fakeWebSocketHandler func(c *fakeWebSocketConn, r *fakeWebSocketRequest) bool
+
+// A fakeWebSocketServer is an in-memory WebSocketDialer speaking the KuCoin protocol, for tests without network.
+// It sends the welcome message, replies pongs to pings, acks the subscriptions and tunnels,
+// and pushes the published messages to the connections subscribing their topics.
+type fakeWebSocketServer struct {
+	// PingInterval and PingTimeout are set in the token, 18s and 10s by default.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	mu         sync.Mutex
+	conns      []*fakeWebSocketConn
+	dials      int
+	dialErrors []error
+	welcome    bool
+	pong       bool
+	ack        bool
+	rejects    map[string]*fakeWebSocketReject
+	handler    fakeWebSocketHandler
+	dialed     chan struct{}
+	sequence   int64
+}
+
+// fakeWebSocketReject is the error replied to the subscriptions of a topic.
+type fakeWebSocketReject struct {
+	code    int
+	message string
+}
+
+// newFakeWebSocketServer creates an instance of fakeWebSocketServer.
+func newFakeWebSocketServer() *fakeWebSocketServer {
+	return &fakeWebSocketServer{
+		PingInterval: 18 * time.Second,
+		PingTimeout:  10 * time.Second,
+		welcome:      true,
+		pong:         true,
+		ack:          true,
+		rejects:      make(map[string]*fakeWebSocketReject),
+		dialed:       make(chan struct{}, 1),
+	}
+}
+
+// Token returns a token dialing the fake server.
+func (fs *fakeWebSocketServer) Token() *WebSocketTokenModel {
+	return &WebSocketTokenModel{
+		Token: "fake",
+		Servers: WebSocketServersModel{{
+			Endpoint:     fakeWebSocketEndpoint,
+			Protocol:     "websocket",
+			PingInterval: int64(fs.PingInterval / time.Millisecond),
+			PingTimeout:  int64(fs.PingTimeout / time.Millisecond),
+		}},
+	}
+}
+
+// ClientOpts returns the options of a client dialing the fake server.
+func (fs *fakeWebSocketServer) ClientOpts() WebSocketClientOpts {
+	return WebSocketClientOpts{Token: fs.Token(), Dialer: fs}
+}
+
+// SetWelcome sets whether the new connections receive the welcome message.
+func (fs *fakeWebSocketServer) SetWelcome(welcome bool) {
+	fs.mu.Lock()
+	fs.welcome = welcome
+	fs.mu.Unlock()
+}
+
+// SetPong sets whether the pings are replied.
+func (fs *fakeWebSocketServer) SetPong(pong bool) {
+	fs.mu.Lock()
+	fs.pong = pong
+	fs.mu.Unlock()
+}
+
+// SetAck sets whether the subscriptions and tunnels are acked.
+func (fs *fakeWebSocketServer) SetAck(ack bool) {
+	fs.mu.Lock()
+	fs.ack = ack
+	fs.mu.Unlock()
+}
+
+// Reject replies an error message with the code to the subscriptions of the topic.
+func (fs *fakeWebSocketServer) Reject(topic string, code int, message string) {
+	fs.mu.Lock()
+	fs.rejects[topic] = &fakeWebSocketReject{code: code, message: message}
+	fs.mu.Unlock()
+}
+
+// Handle sets the handler called for every upstream message before the default handling.
+func (fs *fakeWebSocketServer) Handle(h fakeWebSocketHandler) {
+	fs.mu.Lock()
+	fs.handler = h
+	fs.mu.Unlock()
+}
+
+// FailDials fails the next dials with the errors in order.
+func (fs *fakeWebSocketServer) FailDials(errs ...error) {
+	fs.mu.Lock()
+	fs.dialErrors = append(fs.dialErrors, errs...)
+	fs.mu.Unlock()
+}
+
+// DialContext connects the fake server, it implements WebSocketDialer.
+func (fs *fakeWebSocketServer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (WebSocketConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.dials++
+	if len(fs.dialErrors) > 0 {
+		err := fs.dialErrors[0]
+		fs.dialErrors = fs.dialErrors[1:]
+		return nil, err
+	}
+	if !strings.HasPrefix(urlStr, fakeWebSocketEndpoint) {
+		return nil, errors.Errorf("Unknown endpoint %s", urlStr)
+	}
+	c := &fakeWebSocketConn{
+		server:        fs,
+		url:           urlStr,
+		header:        requestHeader.Clone(),
+		wake:          make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		subscriptions: make(map[string]*fakeWebSocketRequest),
+	}
+	if fs.welcome {
+		c.frames = append(c.frames, []byte(ToJsonString(&WebSocketMessage{Id: "welcome", Type: WelcomeMessage})))
+	}
+	fs.conns = append(fs.conns, c)
+	signal(fs.dialed)
+	return c, nil
+}
+
+// Dials returns the number of dials including the failed ones.
+func (fs *fakeWebSocketServer) Dials() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.dials
+}
+
+// Conns returns the connections accepted so far.
+func (fs *fakeWebSocketServer) Conns() []*fakeWebSocketConn {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]*fakeWebSocketConn(nil), fs.conns...)
+}
+
+// Conn returns the i-th accepted connection, it waits for the connection until ctx is done.
+func (fs *fakeWebSocketServer) Conn(ctx context.Context, i int) (*fakeWebSocketConn, error) {
+	for {
+		fs.mu.Lock()
+		if i < len(fs.conns) {
+			c := fs.conns[i]
+			fs.mu.Unlock()
+			return c, nil
+		}
+		fs.mu.Unlock()
+		select {
+		case <-fs.dialed:
+		case <-ctx.Done():
+			return nil, errors.Errorf("Wait connection %d failed, %s", i, ctx.Err())
+		}
+	}
+}
+
+// Publish pushes a message of the topic to the open connections subscribing it,
+// and returns the number of the pushed messages.
+func (fs *fakeWebSocketServer) Publish(topic, subject string, data interface{}) int {
+	fs.mu.Lock()
+	fs.sequence++
+	sn := fs.sequence
+	conns := append([]*fakeWebSocketConn(nil), fs.conns...)
+	fs.mu.Unlock()
+
+	n := 0
+	for _, c := range conns {
+		for _, tunnelId := range c.subscribers(topic) {
+			m := map[string]interface{}{"type": Message, "topic": topic, "subject": subject, "sn": sn, "data": data}
+			if tunnelId != "" {
+				m["tunnelId"] = tunnelId
+			}
+			if c.Push(m) == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// handle applies the default handling to an upstream message.
+func (fs *fakeWebSocketServer) handle(c *fakeWebSocketConn, r *fakeWebSocketRequest) {
+	fs.mu.Lock()
+	h, pong, ack, reject := fs.handler, fs.pong, fs.ack, fs.rejects[r.Topic]
+	fs.mu.Unlock()
+	if h != nil && h(c, r) {
+		return
+	}
+
+	reply := r.Response && ack
+	switch r.Type {
+	case PingMessage:
+		if pong {
+			_ = c.Push(&WebSocketMessage{Id: r.Id, Type: PongMessage})
+		}
+		return
+	case SubscribeMessage:
+		if reject != nil {
+			_ = c.Push(map[string]interface{}{"id": r.Id, "type": ErrorMessage, "code": reject.code, "data": reject.message})
+			return
+		}
+		c.mu.Lock()
+		c.subscriptions[subscriptionKey(r.TunnelId, r.Topic)] = r
+		c.mu.Unlock()
+	case UnsubscribeMessage:
+		c.mu.Lock()
+		delete(c.subscriptions, subscriptionKey(r.TunnelId, r.Topic))
+		c.mu.Unlock()
+	case OpenTunnelMessage, CloseTunnelMessage:
+	default:
+		return
+	}
+	if reply {
+		_ = c.Push(&WebSocketMessage{Id: r.Id, Type: AckMessage})
+	}
+}
+
+// A fakeWebSocketConn is a connection of a fakeWebSocketServer, it implements WebSocketConn.
+type fakeWebSocketConn struct {
+	server *fakeWebSocketServer
+	url    string
+	header http.Header
+
+	mu            sync.Mutex
+	frames        [][]byte
+	readDeadline  time.Time
+	requests      []*fakeWebSocketRequest
+	subscriptions map[string]*fakeWebSocketRequest
+	wake          chan struct{}
+	closeOnce     sync.Once
+	closed        chan struct{}
+}
+
+// URL returns the url dialed by the client.
+func (c *fakeWebSocketConn) URL() string {
+	return c.url
+}
+
+// Header returns the HTTP header of the handshake.
+func (c *fakeWebSocketConn) Header() http.Header {
+	return c.header
+}
+
+// Requests returns the upstream messages received so far.
+func (c *fakeWebSocketConn) Requests() []*fakeWebSocketRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*fakeWebSocketRequest(nil), c.requests...)
+}
+
+// Topics returns the topics subscribed by the connection in all tunnels.
+func (c *fakeWebSocketConn) Topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.subscriptions))
+	for _, r := range c.subscriptions {
+		topics = append(topics, r.Topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// subscribers returns the tunnel ids of the subscriptions covering the topic,
+// a topic of several symbols like /market/ticker:A,B covers /market/ticker:A.
+func (c *fakeWebSocketConn) subscribers(topic string) []string {
+	prefix, symbol := topic, ""
+	if i := strings.Index(topic, ":"); i >= 0 {
+		prefix, symbol = topic[:i], topic[i+1:]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tunnels []string
+	for _, r := range c.subscriptions {
+		if r.Topic == topic {
+			tunnels = append(tunnels, r.TunnelId)
+			continue
+		}
+		if i := strings.Index(r.Topic, ":"); i >= 0 && r.Topic[:i] == prefix && symbol != "" {
+			for _, s := range strings.Split(r.Topic[i+1:], ",") {
+				if s == symbol {
+					tunnels = append(tunnels, r.TunnelId)
+					break
+				}
+			}
+		}
+	}
+	return tunnels
+}
+
+// Push queues v encoded as JSON to be read by the client, it never blocks.
+func (c *fakeWebSocketConn) Push(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.PushRaw(b)
+}
+
+// PushRaw queues the frame to be read by the client, it never blocks.
+func (c *fakeWebSocketConn) PushRaw(frame []byte) error {
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return errors.New("Fake connection has been closed")
+	default:
+	}
+	c.frames = append(c.frames, frame)
+	c.mu.Unlock()
+	signal(c.wake)
+	return nil
+}
+
+// Drop closes the connection from the server side, the unread frames are lost.
+func (c *fakeWebSocketConn) Drop() {
+	_ = c.Close()
+}
+
+// Closed reports whether the connection has been closed by either side.
+func (c *fakeWebSocketConn) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadMessage returns the next queued frame, it blocks until a frame is pushed,
+// the read deadline expires or the connection is closed.
+func (c *fakeWebSocketConn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		if c.Closed() {
+			c.mu.Unlock()
+			return 0, nil, errors.New("Fake connection has been closed")
+		}
+		if len(c.frames) > 0 {
+			f := c.frames[0]
+			c.frames = c.frames[1:]
+			c.mu.Unlock()
+			return websocket.TextMessage, f, nil
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, errors.New("Fake connection read timeout")
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-c.wake:
+		case <-c.closed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// WriteMessage handles the frame by the fake server synchronously.
+func (c *fakeWebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if c.Closed() {
+		return errors.New("Fake connection has been closed")
+	}
+	r := &fakeWebSocketRequest{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return err
+	}
+	r.Raw = append(json.RawMessage(nil), data...)
+	c.mu.Lock()
+	c.requests = append(c.requests, r)
+	c.mu.Unlock()
+	c.server.handle(c, r)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of the blocking and future reads.
+func (c *fakeWebSocketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	signal(c.wake)
+	return nil
+}
+
+// SetWriteDeadline is a no-op since the writes never block.
+func (c *fakeWebSocketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close closes the connection.
+func (c *fakeWebSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func TestFakeWebSocketServer_Reconnect(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	states := make(chan WebSocketState, 16)
+	opts := fs.ClientOpts()
+	opts.ReconnectAttempts = 3
+	opts.ReconnectDelay = time.Millisecond
+	opts.StateChange = func(from, to WebSocketState) { states <- to }
+	c := NewApiService().NewWebSocketClientOpts(opts)
+	mc, _, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	if err := c.Subscribe(NewSubscribeMessage("/market/ticker:KCS-BTC,ETH-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.Publish("/market/ticker:ETH-BTC", "trade.ticker", map[string]string{}); n != 1 {
+		t.Fatalf("Expected 1 pushed message, got %d", n)
+	}
+	if m := <-mc; m.Topic != "/market/ticker:ETH-BTC" || m.Sn != 1 {
+		t.Errorf("Unexpected message: %s", ToJsonString(m))
+	}
+
+	// The first attempt fails, the second one subscribes the channel again
+	fs.FailDials(errors.New("connection refused"))
+	fs.Conns()[0].Drop()
+	for _, want := range []WebSocketState{WebSocketConnecting, WebSocketConnected, WebSocketReconnecting, WebSocketConnected} {
+		if s := <-states; s != want {
+			t.Fatalf("Expected the state %s, got %s", want, s)
+		}
+	}
+	if fs.Dials() != 3 {
+		t.Errorf("Expected 3 dials, got %d", fs.Dials())
+	}
+	conn := fs.Conns()[1]
+	if topics := conn.Topics(); len(topics) != 1 || topics[0] != "/market/ticker:KCS-BTC,ETH-BTC" {
+		t.Errorf("Unexpected topics: %v", topics)
+	}
+	if !strings.Contains(conn.URL(), "token=fake") {
+		t.Errorf("Unexpected url %s", conn.URL())
+	}
+	fs.Publish("/market/ticker:KCS-BTC", "trade.ticker", map[string]string{})
+	if m := <-mc; m.Topic != "/market/ticker:KCS-BTC" || m.Sn != 2 {
+		t.Errorf("Unexpected message: %s", ToJsonString(m))
+	}
+}
+
+func TestFakeWebSocketServer_HeartbeatTimeout(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	fs.PingInterval = 210 * time.Millisecond
+	fs.PingTimeout = 20 * time.Millisecond
+	fs.SetPong(false)
+	c := NewApiService().NewWebSocketClientOpts(fs.ClientOpts())
+	_, ec, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ec:
+		if !strings.Contains(err.Error(), "Wait pong message timeout") {
+			t.Errorf("Unexpected error %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait the heartbeat timeout")
+	}
+	<-c.Done()
+	if !fs.Conns()[0].Closed() {
+		t.Error("Expected the connection closed")
+	}
+	if rs := fs.Conns()[0].Requests(); len(rs) != 1 || rs[0].Type != PingMessage {
+		t.Errorf("Unexpected requests: %s", ToJsonString(rs))
+	}
+}
+
+func TestFakeWebSocketServer_AckMismatch(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	fs.Handle(func(c *fakeWebSocketConn, r *fakeWebSocketRequest) bool {
+		if r.Type != SubscribeMessage {
+			return false
+		}
+		_ = c.Push(&WebSocketMessage{Id: "x" + r.Id, Type: AckMessage})
+		return true
+	})
+	fs.Reject("/invalid", 404, "topic /invalid is not found")
+	c := NewApiService().NewWebSocketClientOpts(fs.ClientOpts())
+	if _, _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.SubscribeContext(ctx, NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err == nil {
+		t.Error("Expected an error of the mismatched ack")
+	}
+
+	// The unexpected ack and the rejected subscription leave the connection open
+	fs.Handle(nil)
+	if err := c.Subscribe(NewSubscribeMessage("/invalid", false)); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected an error of the rejected topic, got %v", err)
+	}
+	if err := c.Subscribe(NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != WebSocketConnected || len(fs.Conns()) != 1 {
+		t.Errorf("Invalid state %s with %d connections", c.State(), len(fs.Conns()))
+	}
+}
+
+func TestFakeWebSocketServer_SlowConsumer(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	opts := fs.ClientOpts()
+	opts.MessageBufferSize = 2
+	opts.Backpressure = BackpressureDropOldest
+	c := NewApiService().NewWebSocketClientOpts(opts)
+	mc, _, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	if err := c.Subscribe(NewSubscribeMessage("/market/level2:KCS-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		fs.Publish("/market/level2:KCS-BTC", "trade.l2update", map[string]int{"i": i})
+	}
+
+	// The newest message is always kept, one more may be held by the delivering goroutine
+	delivered := 0
+	for m := range mc {
+		delivered++
+		if m.Sn == 5 {
+			break
+		}
+	}
+	st := c.MessageStats()
+	if st.Received != 5 || int(st.Dropped)+delivered != 5 || st.Dropped < 2 {
+		t.Errorf("Unexpected stats %s with %d delivered", ToJsonString(st), delivered)
+	}
+}
+
+func TestFakeWebSocketServer_WelcomeTimeout(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	fs.SetWelcome(false)
+	opts := fs.ClientOpts()
+	opts.Timeout = 20 * time.Millisecond
+	c := NewApiService().NewWebSocketClientOpts(opts)
+	if _, _, err := c.Connect(); err == nil || !strings.Contains(err.Error(), "Wait welcome message failed") {
+		t.Errorf("Expected the welcome timeout, got %v", err)
+	}
+	if !fs.Conns()[0].Closed() {
+		t.Error("Expected the connection closed")
+	}
+}
+
+func TestFakeWebSocketServer_ConnectTwice(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	c := NewApiService().NewWebSocketClientOpts(fs.ClientOpts())
+	mc, ec, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Connect(); err == nil {
+		t.Error("Expected an error of the connected client")
+	}
+	if c.State() != WebSocketConnected || fs.Dials() != 1 {
+		t.Errorf("Unexpected client %s after %d dials", c.State(), fs.Dials())
+	}
+	// The channels are closed once
+	c.Stop()
+	for range mc {
+	}
+	for range ec {
+	}
+}
@@ -0,0 +1,479 @@
+package kucoin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The default limits of a WebSocket connection.
+const (
+	defaultMaxTopicsPerConn   = 300
+	defaultMaxMessagesPerConn = 90
+	defaultMessageWindow      = 10 * time.Second
+	defaultWebSocketTokenTTL  = 12 * time.Hour
+	defaultReconnectDelay     = time.Second
+	maxReconnectDelay         = 30 * time.Second
+)
+
+// WebSocketManagerOpts defines the options for the WebSocketManager.
+type WebSocketManagerOpts struct {
+	// ClientOpts is the template of the options for every connection, the Token is ignored.
+	ClientOpts WebSocketClientOpts
+	// MaxTopicsPerConn is the maximum number of topics subscribed over a connection, 300 by default.
+	MaxTopicsPerConn int
+	// MaxMessagesPerConn is the maximum number of messages sent over a connection within MessageWindow, 90 by default.
+	// Heartbeats are not counted, so keep it below the server limit.
+	MaxMessagesPerConn int
+	// MessageWindow is the window of MaxMessagesPerConn, 10s by default.
+	MessageWindow time.Duration
+	// TokenTTL is the duration a token is reused for new connections, 12h by default.
+	TokenTTL time.Duration
+	// ReconnectDelay is the initial delay before reconnecting a broken connection, 1s by default.
+	// It doubles after each failure up to 30s.
+	ReconnectDelay time.Duration
+}
+
+// A WebSocketManager spreads topics across several WebSocket connections within the limits of each connection,
+// and merges the messages of all connections into one channel.
+// A broken connection is replaced by a new one, and its topics are rebalanced over the connections.
+// Public and private topics are served by separate connections with their own token.
+type WebSocketManager struct {
+	opts     WebSocketManagerOpts
+	as       *ApiService
+	public   *webSocketPool
+	private  *webSocketPool
+	wg       sync.WaitGroup
+	done     chan struct{}
+	stopOnce sync.Once
+	messages chan *WebSocketDownstreamMessage
+	errors   chan error
+}
+
+// NewWebSocketManager creates an instance of WebSocketManager.
+func (as *ApiService) NewWebSocketManager(opts WebSocketManagerOpts) *WebSocketManager {
+	if opts.MaxTopicsPerConn <= 0 {
+		opts.MaxTopicsPerConn = defaultMaxTopicsPerConn
+	}
+	if opts.MaxMessagesPerConn <= 0 {
+		opts.MaxMessagesPerConn = defaultMaxMessagesPerConn
+	}
+	if opts.MessageWindow <= 0 {
+		opts.MessageWindow = defaultMessageWindow
+	}
+	if opts.TokenTTL <= 0 {
+		opts.TokenTTL = defaultWebSocketTokenTTL
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = defaultReconnectDelay
+	}
+	m := &WebSocketManager{
+		opts:     opts,
+		as:       as,
+		done:     make(chan struct{}),
+		messages: make(chan *WebSocketDownstreamMessage, defaultMessageBufferSize),
+		errors:   make(chan error, 16),
+	}
+	m.public = &webSocketPool{
+		manager: m,
+		tokens:  &webSocketTokenSource{fetch: as.WebSocketPublicToken, ttl: opts.TokenTTL},
+	}
+	m.private = &webSocketPool{
+		manager: m,
+		tokens:  &webSocketTokenSource{fetch: as.WebSocketPrivateToken, ttl: opts.TokenTTL},
+	}
+	return m
+}
+
+// Messages returns the merged downstream messages of all connections.
+func (m *WebSocketManager) Messages() <-chan *WebSocketDownstreamMessage {
+	return m.messages
+}
+
+// Errors returns the errors of the connections.
+// They are informational as the broken connections are reconnected,
+// errors are discarded if the channel is not drained in time.
+func (m *WebSocketManager) Errors() <-chan error {
+	return m.errors
+}
+
+// Subscribe subscribes the public channels over the public connections.
+func (m *WebSocketManager) Subscribe(channels ...*WebSocketSubscribeMessage) error {
+	return m.public.subscribe(channels...)
+}
+
+// SubscribePrivate subscribes the channels over the private connections, which are authenticated by the private token.
+func (m *WebSocketManager) SubscribePrivate(channels ...*WebSocketSubscribeMessage) error {
+	return m.private.subscribe(channels...)
+}
+
+// Unsubscribe unsubscribes the channels from the connections they were subscribed over.
+func (m *WebSocketManager) Unsubscribe(channels ...*WebSocketUnsubscribeMessage) error {
+	for _, c := range channels {
+		p := m.public
+		if m.private.has(c.Topic) {
+			p = m.private
+		}
+		if err := p.unsubscribe(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnCount returns the number of the public and private connections.
+func (m *WebSocketManager) ConnCount() (public, private int) {
+	return m.public.size(), m.private.size()
+}
+
+// Stop closes all connections, then closes the message and error channels.
+func (m *WebSocketManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.done)
+		m.public.stop()
+		m.private.stop()
+		m.wg.Wait()
+		close(m.messages)
+		close(m.errors)
+	})
+}
+
+func (m *WebSocketManager) report(err error) {
+	select {
+	case m.errors <- err:
+	default:
+		if DebugMode {
+			logrus.Debugf("Discarded a WebSocket manager error: %s", err.Error())
+		}
+	}
+}
+
+// A webSocketTokenSource caches a token for new connections until it expires or is invalidated.
+type webSocketTokenSource struct {
+	mu      sync.Mutex
+	fetch   func(ctx context.Context) (*ApiResponse, error)
+	ttl     time.Duration
+	token   *WebSocketTokenModel
+	fetched time.Time
+}
+
+func (s *webSocketTokenSource) get(ctx context.Context) (*WebSocketTokenModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && time.Since(s.fetched) < s.ttl {
+		return s.token, nil
+	}
+	rsp, err := s.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tk := &WebSocketTokenModel{}
+	if err := rsp.ReadData(tk); err != nil {
+		return nil, err
+	}
+	s.token, s.fetched = tk, time.Now()
+	return tk, nil
+}
+
+// invalidate drops tk, so that the next connection fetches a new token.
+func (s *webSocketTokenSource) invalidate(tk *WebSocketTokenModel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == tk {
+		s.token = nil
+	}
+}
+
+// A webSocketShard is a connection of a pool with the topics subscribed or being subscribed over it.
+// The connection of a new shard is dialed outside the lock of the pool, ready is closed once it is done.
+type webSocketShard struct {
+	client  *WebSocketClient
+	errors  <-chan error
+	token   *WebSocketTokenModel
+	limiter *rateLimiter
+	topics  map[string]*WebSocketSubscribeMessage
+	ready   chan struct{}
+	err     error
+}
+
+// wait waits for the connection of the shard, it returns the error of the dial.
+func (s *webSocketShard) wait(done <-chan struct{}) error {
+	select {
+	case <-s.ready:
+		return s.err
+	case <-done:
+		return errors.New("WebSocket manager has been stopped")
+	}
+}
+
+// A webSocketPool is the set of connections sharing a kind of token.
+// The lock guards the shards and their topics only, the dials, the rate limits and the acks are waited outside it.
+type webSocketPool struct {
+	mu      sync.Mutex
+	manager *WebSocketManager
+	tokens  *webSocketTokenSource
+	shards  []*webSocketShard
+}
+
+func (p *webSocketPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.shards)
+}
+
+func (p *webSocketPool) has(topic string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.shards {
+		if _, ok := s.topics[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *webSocketPool) subscribe(channels ...*WebSocketSubscribeMessage) error {
+	for _, c := range channels {
+		if err := p.place(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserve reserves a slot for c on the least loaded connection, or on a new shard if all are full.
+// It returns nil if c is subscribed already, and whether the shard is new and must be dialed by the caller.
+func (p *webSocketPool) reserve(c *WebSocketSubscribeMessage) (*webSocketShard, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var target *webSocketShard
+	for _, s := range p.shards {
+		if _, ok := s.topics[c.Topic]; ok {
+			return nil, false
+		}
+		if len(s.topics) < p.manager.opts.MaxTopicsPerConn && (target == nil || len(s.topics) < len(target.topics)) {
+			target = s
+		}
+	}
+	dial := target == nil
+	if dial {
+		target = &webSocketShard{topics: make(map[string]*WebSocketSubscribeMessage), ready: make(chan struct{})}
+		p.shards = append(p.shards, target)
+	}
+	target.topics[c.Topic] = c
+	return target, dial
+}
+
+// release removes the reservation of the topic, and the shard if it failed to connect.
+func (p *webSocketPool) release(s *webSocketShard, topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(s.topics, topic)
+	if s.err != nil {
+		p.remove(s)
+	}
+}
+
+// remove removes the shard from the pool, the caller must hold the lock.
+func (p *webSocketPool) remove(shard *webSocketShard) {
+	for i, s := range p.shards {
+		if s == shard {
+			p.shards = append(p.shards[:i], p.shards[i+1:]...)
+			return
+		}
+	}
+}
+
+// place subscribes c over the least loaded connection, or a new one if all are full.
+func (p *webSocketPool) place(c *WebSocketSubscribeMessage) error {
+	target, dial := p.reserve(c)
+	if target == nil {
+		return nil
+	}
+	if dial {
+		p.dial(target)
+	}
+	if err := target.wait(p.manager.done); err != nil {
+		p.release(target, c.Topic)
+		return err
+	}
+
+	if !target.limiter.wait(p.manager.done) {
+		p.release(target, c.Topic)
+		return errors.New("WebSocket manager has been stopped")
+	}
+	// A new message id for every attempt, as the channel may be resubscribed after reconnecting
+	sc := NewSubscribeMessage(c.Topic, c.PrivateChannel)
+	sc.Response = c.Response
+	if err := target.client.Subscribe(sc); err != nil {
+		p.release(target, c.Topic)
+		return err
+	}
+	return nil
+}
+
+func (p *webSocketPool) unsubscribe(c *WebSocketUnsubscribeMessage) error {
+	p.mu.Lock()
+	var target *webSocketShard
+	for _, s := range p.shards {
+		if _, ok := s.topics[c.Topic]; ok {
+			target = s
+			break
+		}
+	}
+	p.mu.Unlock()
+	if target == nil {
+		return nil
+	}
+	if err := target.wait(p.manager.done); err != nil {
+		return err
+	}
+
+	if !target.limiter.wait(p.manager.done) {
+		return errors.New("WebSocket manager has been stopped")
+	}
+	if err := target.client.Unsubscribe(c); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(target.topics, c.Topic)
+	p.mu.Unlock()
+	return nil
+}
+
+// dial connects the new shard and starts forwarding its messages, then closes its ready channel.
+func (p *webSocketPool) dial(s *webSocketShard) {
+	defer close(s.ready)
+	fail := func(err error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		s.err = err
+		p.remove(s)
+	}
+	select {
+	case <-p.manager.done:
+		fail(errors.New("WebSocket manager has been stopped"))
+		return
+	default:
+	}
+
+	tk, err := p.tokens.get(context.Background())
+	if err != nil {
+		fail(err)
+		return
+	}
+	opts := p.manager.opts.ClientOpts
+	opts.Token = tk
+	c := p.manager.as.NewWebSocketClientOpts(opts)
+	mc, ec, err := c.Connect()
+	if err != nil {
+		// The token may be expired
+		p.tokens.invalidate(tk)
+		fail(err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The pool is stopped after the manager is done, the client would be left open
+	select {
+	case <-p.manager.done:
+		c.Stop()
+		s.err = errors.New("WebSocket manager has been stopped")
+		p.remove(s)
+		return
+	default:
+	}
+	s.client, s.errors, s.token = c, ec, tk
+	s.limiter = &rateLimiter{
+		limit:  p.manager.opts.MaxMessagesPerConn,
+		window: p.manager.opts.MessageWindow,
+	}
+	p.manager.wg.Add(2)
+	go p.forward(mc)
+	go p.supervise(s)
+}
+
+// forward merges the messages of a connection into the manager.
+func (p *webSocketPool) forward(mc <-chan *WebSocketDownstreamMessage) {
+	defer p.manager.wg.Done()
+	for msg := range mc {
+		select {
+		case p.manager.messages <- msg:
+		case <-p.manager.done:
+			return
+		}
+	}
+}
+
+// supervise waits for the failure of a connection, then replaces it.
+func (p *webSocketPool) supervise(s *webSocketShard) {
+	defer p.manager.wg.Done()
+	select {
+	case err, ok := <-s.errors:
+		if !ok {
+			return
+		}
+		p.manager.report(errors.Errorf("WebSocket connection failed, %s", err.Error()))
+		s.client.Stop()
+		p.reconnect(s)
+	case <-p.manager.done:
+	}
+}
+
+// reconnect removes the broken shard, then rebalances its topics over the pool with a fresh token.
+func (p *webSocketPool) reconnect(broken *webSocketShard) {
+	p.tokens.invalidate(broken.token)
+
+	p.mu.Lock()
+	p.remove(broken)
+	topics := make([]*WebSocketSubscribeMessage, 0, len(broken.topics))
+	for _, c := range broken.topics {
+		topics = append(topics, c)
+	}
+	p.mu.Unlock()
+
+	delay := p.manager.opts.ReconnectDelay
+	for _, c := range topics {
+		for {
+			err := p.place(c)
+			if err == nil {
+				break
+			}
+			select {
+			case <-p.manager.done:
+				return
+			default:
+			}
+			p.manager.report(errors.Errorf("Resubscribe %s failed, %s", c.Topic, err.Error()))
+
+			select {
+			case <-time.After(delay):
+			case <-p.manager.done:
+				return
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+func (p *webSocketPool) stop() {
+	p.mu.Lock()
+	var clients []*WebSocketClient
+	for _, s := range p.shards {
+		// The shards being dialed stop their clients themselves
+		if s.client != nil {
+			clients = append(clients, s.client)
+		}
+	}
+	p.shards = nil
+	p.mu.Unlock()
+	for _, c := range clients {
+		c.Stop()
+	}
+}
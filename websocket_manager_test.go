@@ -0,0 +1,128 @@
+package kucoin
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A tokenRequester replies the bullet-public and bullet-private endpoints with a token of the local server.
+type tokenRequester struct {
+	token *WebSocketTokenModel
+	calls int64
+}
+
+func (tr *tokenRequester) Request(ctx context.Context, request *Request, timeout time.Duration) (*Response, error) {
+	atomic.AddInt64(&tr.calls, 1)
+	b := []byte(ToJsonString(map[string]interface{}{"code": ApiSuccess, "data": tr.token}))
+	rsp := &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader(b))}
+	return NewResponse(request, rsp, nil), nil
+}
+
+func TestWebSocketManager_Sharding(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	tr := &tokenRequester{token: tk}
+	s := NewApiService(ApiRequesterOption(tr))
+	m := s.NewWebSocketManager(WebSocketManagerOpts{MaxTopicsPerConn: 2, ReconnectDelay: 10 * time.Millisecond})
+	defer m.Stop()
+
+	topics := []string{"/market/ticker:A-B", "/market/ticker:C-D", "/market/ticker:E-F", "/market/ticker:G-H", "/market/ticker:I-J"}
+	for _, topic := range topics {
+		if err := m.Subscribe(NewSubscribeMessage(topic, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SubscribePrivate(NewSubscribeMessage("/account/balance", false)); err != nil {
+		t.Fatal(err)
+	}
+	if pub, pri := m.ConnCount(); pub != 3 || pri != 1 {
+		t.Fatalf("Invalid connections %d/%d, expect 3/1", pub, pri)
+	}
+	// The token is fetched once per pool
+	if c := atomic.LoadInt64(&tr.calls); c != 2 {
+		t.Errorf("Invalid token requests %d, expect 2", c)
+	}
+
+	received := map[string]int{}
+	for len(received) < len(topics)+1 {
+		select {
+		case msg := <-m.Messages():
+			received[msg.Topic]++
+		case <-time.After(time.Second):
+			t.Fatalf("Wait messages timeout, received %v", received)
+		}
+	}
+
+	// The topics of the broken connection are resubscribed over a new connection
+	ls.drop(0)
+	received = map[string]int{}
+	for received["/market/ticker:A-B"] == 0 || received["/market/ticker:C-D"] == 0 {
+		select {
+		case msg := <-m.Messages():
+			received[msg.Topic]++
+		case <-time.After(time.Second):
+			t.Fatalf("Wait resubscribed messages timeout, received %v", received)
+		}
+	}
+	if c := ls.connCount(); c != 5 {
+		t.Fatalf("Invalid accepted connections %d, expect 5", c)
+	}
+	// The broken connection fetches a new token
+	if c := atomic.LoadInt64(&tr.calls); c != 3 {
+		t.Errorf("Invalid token requests %d, expect 3", c)
+	}
+	select {
+	case err := <-m.Errors():
+		t.Log(err)
+	case <-time.After(time.Second):
+		t.Error("Expect an error of the broken connection")
+	}
+
+	if err := m.Unsubscribe(NewUnsubscribeMessage("/market/ticker:A-B", false), NewUnsubscribeMessage("/account/balance", false)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSocketManager_SlowSubscribe(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	// The subscription of the slow topic is never acked
+	fs.Handle(func(c *fakeWebSocketConn, r *fakeWebSocketRequest) bool {
+		return r.Type == SubscribeMessage && r.Topic == "/market/ticker:A-B"
+	})
+	co := fs.ClientOpts()
+	co.Timeout = time.Second
+	m := NewApiService(ApiRequesterOption(&tokenRequester{token: fs.Token()})).NewWebSocketManager(WebSocketManagerOpts{MaxTopicsPerConn: 1, ClientOpts: co})
+	defer m.Stop()
+
+	slow := make(chan error, 1)
+	go func() { slow <- m.Subscribe(NewSubscribeMessage("/market/ticker:A-B", false)) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := fs.Conn(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other topics are subscribed and unsubscribed while the slow one waits for its ack
+	start := time.Now()
+	if err := m.Subscribe(NewSubscribeMessage("/market/ticker:C-D", false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unsubscribe(NewUnsubscribeMessage("/market/ticker:C-D", false)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Expected the subscription not blocked by the slow one, took %v", d)
+	}
+	if err := <-slow; err == nil {
+		t.Error("Expected the slow subscription timed out")
+	}
+	if m.public.has("/market/ticker:A-B") {
+		t.Error("Expected the slow topic released")
+	}
+}
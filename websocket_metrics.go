@@ -0,0 +1,215 @@
+package kucoin
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// All defaults of the WebSocket metrics.
+const (
+	// defaultLatencySamples is the number of latest samples kept for the rolling latency stats.
+	defaultLatencySamples = 128
+	// defaultRateWindow is the window of the message rates, in seconds.
+	defaultRateWindow = 10
+)
+
+// A WebSocketLatencyStats represents the rolling stats of the latest latency samples.
+type WebSocketLatencyStats struct {
+	// Count is the number of all samples, including the ones out of the window.
+	Count uint64        `json:"count"`
+	Last  time.Duration `json:"last"`
+	Min   time.Duration `json:"min"`
+	Max   time.Duration `json:"max"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P99   time.Duration `json:"p99"`
+}
+
+// A WebSocketTopicStats represents the metrics of the messages of a topic.
+type WebSocketTopicStats struct {
+	Messages uint64 `json:"messages"`
+	// Rate is the number of messages per second over the last 10 seconds.
+	Rate float64 `json:"rate"`
+	// Lag is the delay from the server timestamp in the payload to the receipt, against the server clock.
+	// It is empty unless WebSocketClientOpts.MessageLag is set, or if the payloads carry no timestamp.
+	Lag WebSocketLatencyStats `json:"lag"`
+	// LastMessageAt is the receive time of the last message.
+	LastMessageAt time.Time `json:"lastMessageAt"`
+	// Idle is the time elapsed since the last message, a growing value signals a stale feed.
+	Idle time.Duration `json:"idle"`
+}
+
+// A WebSocketMetrics represents the heartbeat and feed metrics of a WebSocketClient.
+type WebSocketMetrics struct {
+	// Heartbeat is the round trip time of ping/pong.
+	Heartbeat WebSocketLatencyStats          `json:"heartbeat"`
+	Topics    map[string]WebSocketTopicStats `json:"topics"`
+}
+
+// A webSocketSamples keeps the latest latency samples in a ring.
+type webSocketSamples struct {
+	count uint64
+	ring  []time.Duration
+}
+
+func (ss *webSocketSamples) add(d time.Duration) {
+	if len(ss.ring) < defaultLatencySamples {
+		ss.ring = append(ss.ring, d)
+	} else {
+		ss.ring[ss.count%defaultLatencySamples] = d
+	}
+	ss.count++
+}
+
+func (ss *webSocketSamples) stats() WebSocketLatencyStats {
+	s := WebSocketLatencyStats{Count: ss.count}
+	if ss.count == 0 {
+		return s
+	}
+	s.Last = ss.ring[(ss.count-1)%uint64(len(ss.ring))]
+	sorted := make([]time.Duration, len(ss.ring))
+	copy(sorted, ss.ring)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	n := len(sorted)
+	s.Min, s.Max, s.Mean = sorted[0], sorted[n-1], sum/time.Duration(n)
+	s.P50, s.P99 = sorted[(n-1)*50/100], sorted[(n-1)*99/100]
+	return s
+}
+
+// A webSocketTopicMetrics counts the messages of a topic in one second buckets.
+type webSocketTopicMetrics struct {
+	messages uint64
+	buckets  [defaultRateWindow]uint64
+	seconds  [defaultRateWindow]int64
+	lag      webSocketSamples
+	last     time.Time
+}
+
+func (tm *webSocketTopicMetrics) rate(now time.Time) float64 {
+	var n uint64
+	sec := now.Unix()
+	for i, s := range tm.seconds {
+		if sec-s < defaultRateWindow {
+			n += tm.buckets[i]
+		}
+	}
+	return float64(n) / defaultRateWindow
+}
+
+// A webSocketMetrics collects the metrics of a WebSocketClient.
+type webSocketMetrics struct {
+	mu     sync.Mutex
+	clock  *ServerClock
+	lag    bool
+	rtt    webSocketSamples
+	topics map[string]*webSocketTopicMetrics
+}
+
+func newWebSocketMetrics(clock *ServerClock, lag bool) *webSocketMetrics {
+	if clock == nil {
+		clock = &ServerClock{}
+	}
+	return &webSocketMetrics{clock: clock, lag: lag, topics: make(map[string]*webSocketTopicMetrics)}
+}
+
+// heartbeat records the round trip time of a ping/pong.
+func (wm *webSocketMetrics) heartbeat(rtt time.Duration) {
+	wm.mu.Lock()
+	wm.rtt.add(rtt)
+	wm.mu.Unlock()
+}
+
+// received records a message of a topic received at now, and its lag if enabled.
+func (wm *webSocketMetrics) received(m *WebSocketDownstreamMessage, now time.Time) {
+	var ts time.Time
+	var ok bool
+	if wm.lag {
+		ts, ok = messageTimestamp(m.RawData)
+	}
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	tm, found := wm.topics[m.Topic]
+	if !found {
+		tm = &webSocketTopicMetrics{}
+		wm.topics[m.Topic] = tm
+	}
+	tm.messages++
+	tm.last = now
+	sec := now.Unix()
+	i := sec % defaultRateWindow
+	if tm.seconds[i] != sec {
+		tm.seconds[i], tm.buckets[i] = sec, 0
+	}
+	tm.buckets[i]++
+	if ok {
+		tm.lag.add(now.Add(wm.clock.Offset()).Sub(ts))
+	}
+}
+
+// snapshot returns a copy of the metrics.
+func (wm *webSocketMetrics) snapshot() WebSocketMetrics {
+	now := time.Now()
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	s := WebSocketMetrics{
+		Heartbeat: wm.rtt.stats(),
+		Topics:    make(map[string]WebSocketTopicStats, len(wm.topics)),
+	}
+	for topic, tm := range wm.topics {
+		s.Topics[topic] = WebSocketTopicStats{
+			Messages:      tm.messages,
+			Rate:          tm.rate(now),
+			Lag:           tm.lag.stats(),
+			LastMessageAt: tm.last,
+			Idle:          now.Sub(tm.last),
+		}
+	}
+	return s
+}
+
+// messageTimestamp returns the server timestamp in the payload of a message,
+// i.e. `time` of ticker and match messages or `ts` of order messages.
+// The unit is inferred from the magnitude, KuCoin sends milliseconds or nanoseconds.
+func messageTimestamp(data json.RawMessage) (time.Time, bool) {
+	var p struct {
+		Time json.RawMessage `json:"time"`
+		Ts   json.RawMessage `json:"ts"`
+	}
+	// Most payloads carry no timestamp, they are not decoded
+	if len(data) == 0 || data[0] != '{' || !bytes.Contains(data, []byte(`"time"`)) && !bytes.Contains(data, []byte(`"ts"`)) {
+		return time.Time{}, false
+	}
+	if json.Unmarshal(data, &p) != nil {
+		return time.Time{}, false
+	}
+	raw := p.Time
+	if len(raw) == 0 {
+		raw = p.Ts
+	}
+	if len(raw) > 1 && raw[0] == '"' {
+		raw = raw[1 : len(raw)-1]
+	}
+	v, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, false
+	}
+	switch {
+	case v > 1e17:
+		return time.Unix(0, v), true
+	case v > 1e14:
+		return time.Unix(0, v*int64(time.Microsecond)), true
+	case v > 1e11:
+		return time.Unix(0, v*int64(time.Millisecond)), true
+	default:
+		return time.Unix(v, 0), true
+	}
+}
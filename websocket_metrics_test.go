@@ -0,0 +1,99 @@
+package kucoin
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMessageTimestamp(t *testing.T) {
+	want := time.Unix(1700000000, 123000000)
+	for _, data := range []string{
+		`{"time":1700000000123,"price":"1"}`,
+		`{"time":"1700000000123000000"}`,
+		`{"ts":1700000000123000000}`,
+		`{"ts":1700000000123000}`,
+	} {
+		ts, ok := messageTimestamp(json.RawMessage(data))
+		if !ok || !ts.Equal(want) {
+			t.Errorf("Unexpected timestamp of %s: %v", data, ts)
+		}
+	}
+	for _, data := range []string{``, `[]`, `{}`, `{"time":"x"}`, `"text"`} {
+		if _, ok := messageTimestamp(json.RawMessage(data)); ok {
+			t.Errorf("Unexpected timestamp of %s", data)
+		}
+	}
+}
+
+func TestWebSocketMetrics_Topics(t *testing.T) {
+	clock := &ServerClock{}
+	clock.SetOffset(time.Second)
+	wm := newWebSocketMetrics(clock, true)
+
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		m := newTestDownstreamMessage("/market/ticker:BTC-USDT", "trade.ticker", int64(i))
+		// Sent 100ms ago by the server, whose clock is 1s ahead
+		m.RawData = json.RawMessage(`{"time":` + IntToString(now.Add(900*time.Millisecond).UnixNano()/1e6) + `}`)
+		wm.received(m, now)
+	}
+	wm.received(newTestDownstreamMessage("/market/level2:BTC-USDT", "trade.l2update", 1), now)
+	for i := 1; i <= 200; i++ {
+		wm.heartbeat(time.Duration(i) * time.Millisecond)
+	}
+
+	s := wm.snapshot()
+	ts := s.Topics["/market/ticker:BTC-USDT"]
+	if ts.Messages != 20 || ts.Rate != 2 {
+		t.Errorf("Unexpected topic stats: %s", ToJsonString(ts))
+	}
+	if ts.Lag.Count != 20 || ts.Lag.Min < 99*time.Millisecond || ts.Lag.Max > 101*time.Millisecond {
+		t.Errorf("Unexpected lag: %s", ToJsonString(ts.Lag))
+	}
+	if l2 := s.Topics["/market/level2:BTC-USDT"]; l2.Messages != 1 || l2.Lag.Count != 0 {
+		t.Errorf("Unexpected topic stats: %s", ToJsonString(l2))
+	}
+	// The window keeps the latest samples only
+	h := s.Heartbeat
+	if h.Count != 200 || h.Last != 200*time.Millisecond || h.Min != 73*time.Millisecond || h.Max != 200*time.Millisecond {
+		t.Errorf("Unexpected heartbeat stats: %s", ToJsonString(h))
+	}
+
+	// The payloads are not decoded unless the lag is measured
+	wm = newWebSocketMetrics(clock, false)
+	m := newTestDownstreamMessage("/market/ticker:BTC-USDT", "trade.ticker", 1)
+	m.RawData = json.RawMessage(`{"time":` + IntToString(now.UnixNano()/1e6) + `}`)
+	wm.received(m, now)
+	if ts := wm.snapshot().Topics["/market/ticker:BTC-USDT"]; ts.Messages != 1 || ts.Lag.Count != 0 {
+		t.Errorf("Unexpected topic stats: %s", ToJsonString(ts))
+	}
+}
+
+func TestWebSocketClient_Metrics(t *testing.T) {
+	ts, tk := newLocalWebSocketServer(t)
+	defer ts.Close()
+
+	c := NewApiService().NewWebSocketClient(tk)
+	mc, _, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	if err := c.Subscribe(NewSubscribeMessage("/market/ticker:BTC-USDT", false)); err != nil {
+		t.Fatal(err)
+	}
+	<-mc
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Metrics().Heartbeat.Count == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m := c.Metrics()
+	if m.Heartbeat.Count == 0 || m.Heartbeat.Max <= 0 {
+		t.Errorf("Expected heartbeat samples: %s", ToJsonString(m.Heartbeat))
+	}
+	if m.Topics["/market/ticker:BTC-USDT"].Messages != 1 {
+		t.Errorf("Unexpected topics: %s", ToJsonString(m.Topics))
+	}
+}
@@ -0,0 +1,209 @@
+package kucoin
+
+import (
+	"strings"
+	"sync"
+)
+
+// A WebSocketBackpressure is the policy applied when the downstream messages are not consumed in time.
+type WebSocketBackpressure int
+
+// All backpressure policies of the downstream message channel.
+const (
+	// BackpressureBlock stops reading the connection until the consumer catches up.
+	// A long stall may cause the server to drop the connection as ping/pong is delayed.
+	BackpressureBlock WebSocketBackpressure = iota
+	// BackpressureDropOldest discards the oldest buffered message to make room for the new one.
+	BackpressureDropOldest
+	// BackpressureDropNewest discards the new message when the buffer is full.
+	BackpressureDropNewest
+	// BackpressureConflate replaces a buffered message with a newer one of the same conflation key,
+	// so only the latest one is delivered. When the buffer is full, a message without a key,
+	// or with a key not buffered yet, blocks as BackpressureBlock.
+	BackpressureConflate
+)
+
+// defaultMessageBufferSize is the capacity of the downstream message buffer.
+const defaultMessageBufferSize = 2048
+
+// TickerConflateKey is the default conflation key of BackpressureConflate.
+// It keys the ticker and snapshot messages by topic and subject, i.e. one message per symbol,
+// other messages are never conflated.
+func TickerConflateKey(m *WebSocketDownstreamMessage) string {
+	if strings.HasPrefix(m.Topic, "/market/ticker:") || strings.HasPrefix(m.Topic, "/market/snapshot:") {
+		return m.Topic + "@" + m.Subject
+	}
+	return ""
+}
+
+// A WebSocketMessageStats represents the counters of the downstream message buffer.
+type WebSocketMessageStats struct {
+	Received   uint64 `json:"received"`
+	Delivered  uint64 `json:"delivered"`
+	Dropped    uint64 `json:"dropped"`
+	Conflated  uint64 `json:"conflated"`
+	QueueDepth int    `json:"queueDepth"`
+}
+
+type webSocketQueueItem struct {
+	key string
+	m   *WebSocketDownstreamMessage
+}
+
+// A webSocketMessageQueue buffers the downstream messages between the read goroutine and the consumer.
+type webSocketMessageQueue struct {
+	mu       sync.Mutex
+	policy   WebSocketBackpressure
+	key      func(m *WebSocketDownstreamMessage) string
+	capacity int
+	items    []*webSocketQueueItem
+	keys     map[string]*webSocketQueueItem
+	closed   bool
+	stats    WebSocketMessageStats
+	// Signaled when an item is pushed or the queue is closed
+	readable chan struct{}
+	// Signaled when an item is popped
+	writable chan struct{}
+}
+
+func newWebSocketMessageQueue(capacity int, policy WebSocketBackpressure, key func(m *WebSocketDownstreamMessage) string) *webSocketMessageQueue {
+	if capacity <= 0 {
+		capacity = defaultMessageBufferSize
+	}
+	if key == nil {
+		key = TickerConflateKey
+	}
+	return &webSocketMessageQueue{
+		policy:   policy,
+		key:      key,
+		capacity: capacity,
+		keys:     make(map[string]*webSocketQueueItem),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// push buffers m according to the policy, it returns false if done is closed while blocking.
+// m is dropped if the queue is closed.
+func (q *webSocketMessageQueue) push(m *WebSocketDownstreamMessage, done <-chan struct{}) bool {
+	q.mu.Lock()
+	q.stats.Received++
+	if q.closed {
+		q.stats.Dropped++
+		q.mu.Unlock()
+		return true
+	}
+
+	var k string
+	if q.policy == BackpressureConflate {
+		k = q.key(m)
+		if it, ok := q.keys[k]; ok && k != "" {
+			it.m = m
+			q.stats.Conflated++
+			q.mu.Unlock()
+			return true
+		}
+	}
+
+	for len(q.items) >= q.capacity {
+		switch q.policy {
+		case BackpressureDropNewest:
+			q.stats.Dropped++
+			q.mu.Unlock()
+			return true
+		case BackpressureDropOldest:
+			q.shift()
+			q.stats.Dropped++
+		default:
+			q.mu.Unlock()
+			select {
+			case <-q.writable:
+			case <-done:
+				return false
+			}
+			q.mu.Lock()
+			if q.closed {
+				q.stats.Dropped++
+				q.mu.Unlock()
+				return true
+			}
+		}
+	}
+
+	it := &webSocketQueueItem{key: k, m: m}
+	q.items = append(q.items, it)
+	if k != "" {
+		q.keys[k] = it
+	}
+	q.mu.Unlock()
+	signal(q.readable)
+	return true
+}
+
+// shift removes the first item, the caller must hold the lock.
+func (q *webSocketMessageQueue) shift() *webSocketQueueItem {
+	it := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	if it.key != "" && q.keys[it.key] == it {
+		delete(q.keys, it.key)
+	}
+	return it
+}
+
+// pop waits for the next message, it returns false if the queue is closed and drained or done is closed.
+func (q *webSocketMessageQueue) pop(done <-chan struct{}) (*WebSocketDownstreamMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			it := q.shift()
+			q.mu.Unlock()
+			signal(q.writable)
+			return it.m, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-q.readable:
+		case <-done:
+			return nil, false
+		}
+	}
+}
+
+// delivered counts a message handed over to the consumer.
+func (q *webSocketMessageQueue) delivered() {
+	q.mu.Lock()
+	q.stats.Delivered++
+	q.mu.Unlock()
+}
+
+// close marks the end of the messages, pop drains the buffered ones first.
+// The blocked and later pushes drop their messages.
+func (q *webSocketMessageQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	signal(q.readable)
+	signal(q.writable)
+}
+
+// snapshot returns a copy of the counters.
+func (q *webSocketMessageQueue) snapshot() WebSocketMessageStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	s.QueueDepth = len(q.items)
+	return s
+}
@@ -0,0 +1,105 @@
+package kucoin
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestDownstreamMessage(topic, subject string, sn int64) *WebSocketDownstreamMessage {
+	return &WebSocketDownstreamMessage{
+		WebSocketMessage: &WebSocketMessage{Type: Message},
+		Sn:               sn,
+		Topic:            topic,
+		Subject:          subject,
+	}
+}
+
+func TestWebSocketMessageQueue_DropOldest(t *testing.T) {
+	q := newWebSocketMessageQueue(2, BackpressureDropOldest, nil)
+	for i := int64(1); i <= 3; i++ {
+		q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", i), nil)
+	}
+	s := q.snapshot()
+	if s.Dropped != 1 || s.QueueDepth != 2 {
+		t.Errorf("Invalid stats %s", ToJsonString(s))
+	}
+	if m, _ := q.pop(nil); m.Sn != 2 {
+		t.Errorf("Invalid sn %d, expect 2", m.Sn)
+	}
+}
+
+func TestWebSocketMessageQueue_DropNewest(t *testing.T) {
+	q := newWebSocketMessageQueue(2, BackpressureDropNewest, nil)
+	for i := int64(1); i <= 3; i++ {
+		q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", i), nil)
+	}
+	if s := q.snapshot(); s.Dropped != 1 || s.QueueDepth != 2 {
+		t.Errorf("Invalid stats %s", ToJsonString(s))
+	}
+	q.pop(nil)
+	if m, _ := q.pop(nil); m.Sn != 2 {
+		t.Errorf("Invalid sn %d, expect 2", m.Sn)
+	}
+}
+
+func TestWebSocketMessageQueue_Conflate(t *testing.T) {
+	q := newWebSocketMessageQueue(10, BackpressureConflate, nil)
+	q.push(newTestDownstreamMessage("/market/ticker:all", "KCS-BTC", 1), nil)
+	q.push(newTestDownstreamMessage("/market/ticker:all", "ETH-BTC", 2), nil)
+	q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", 3), nil)
+	q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", 4), nil)
+	q.push(newTestDownstreamMessage("/market/ticker:all", "KCS-BTC", 5), nil)
+
+	s := q.snapshot()
+	if s.Conflated != 1 || s.QueueDepth != 4 || s.Received != 5 {
+		t.Errorf("Invalid stats %s", ToJsonString(s))
+	}
+	// The conflated ticker keeps its position in the queue
+	for _, sn := range []int64{5, 2, 3, 4} {
+		if m, _ := q.pop(nil); m.Sn != sn {
+			t.Errorf("Invalid sn %d, expect %d", m.Sn, sn)
+		}
+	}
+	// A popped ticker is not conflated any more
+	q.push(newTestDownstreamMessage("/market/ticker:all", "KCS-BTC", 6), nil)
+	if m, _ := q.pop(nil); m.Sn != 6 {
+		t.Errorf("Invalid sn %d, expect 6", m.Sn)
+	}
+}
+
+func TestWebSocketMessageQueue_Block(t *testing.T) {
+	q := newWebSocketMessageQueue(1, BackpressureBlock, nil)
+	q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", 1), nil)
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", 2), nil)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Push should block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.pop(nil)
+	if !<-pushed {
+		t.Fatal("Push failed")
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", 3), done) {
+		t.Error("Push should give up when done is closed")
+	}
+}
+
+func TestWebSocketMessageQueue_Close(t *testing.T) {
+	q := newWebSocketMessageQueue(10, BackpressureBlock, nil)
+	q.push(newTestDownstreamMessage("/market/match:KCS-BTC", "trade.l3match", 1), nil)
+	q.close()
+	if _, ok := q.pop(nil); !ok {
+		t.Error("Buffered messages should be drained after close")
+	}
+	if _, ok := q.pop(nil); ok {
+		t.Error("Pop should return false after drained")
+	}
+}
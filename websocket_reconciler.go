@@ -0,0 +1,600 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The topics and subjects of the private order and balance events.
+const (
+	PrivateOrderTopic      = "/spotMarket/tradeOrdersV2"
+	PrivateBalanceTopic    = "/account/balance"
+	OrderChangeSubject     = "orderChange"
+	BalanceChangeSubject   = "account.balance"
+	ReconcileRelationEvent = "reconcile"
+)
+
+// A PrivateOrderChangeModel represents the data of an orderChange message of /spotMarket/tradeOrdersV2.
+type PrivateOrderChangeModel struct {
+	Symbol       string      `json:"symbol"`
+	OrderType    string      `json:"orderType"`
+	Side         string      `json:"side"`
+	OrderId      string      `json:"orderId"`
+	Type         string      `json:"type"`
+	OrderTime    json.Number `json:"orderTime,omitempty"`
+	Size         string      `json:"size,omitempty"`
+	FilledSize   string      `json:"filledSize,omitempty"`
+	Price        string      `json:"price,omitempty"`
+	ClientOid    string      `json:"clientOid"`
+	RemainSize   string      `json:"remainSize,omitempty"`
+	Status       string      `json:"status"`
+	Ts           json.Number `json:"ts,omitempty"`
+	Liquidity    string      `json:"liquidity,omitempty"`
+	MatchPrice   string      `json:"matchPrice,omitempty"`
+	MatchSize    string      `json:"matchSize,omitempty"`
+	TradeId      string      `json:"tradeId,omitempty"`
+	OriginSize   string      `json:"originSize,omitempty"`
+	CanceledSize string      `json:"canceledSize,omitempty"`
+	// Reconciled marks an event synthesized by a PrivateFeedReconciler.
+	Reconciled bool `json:"reconciled,omitempty"`
+}
+
+// A PrivateBalanceModel represents the data of an account.balance message of /account/balance.
+type PrivateBalanceModel struct {
+	AccountId       string          `json:"accountId"`
+	Total           string          `json:"total"`
+	Available       string          `json:"available"`
+	AvailableChange string          `json:"availableChange"`
+	Currency        string          `json:"currency"`
+	Hold            string          `json:"hold"`
+	HoldChange      string          `json:"holdChange"`
+	RelationEvent   string          `json:"relationEvent"`
+	RelationEventId string          `json:"relationEventId"`
+	RelationContext json.RawMessage `json:"relationContext,omitempty"`
+	Time            string          `json:"time"`
+	// Reconciled marks an event synthesized by a PrivateFeedReconciler.
+	Reconciled bool `json:"reconciled,omitempty"`
+}
+
+// All defaults of PrivateFeedReconcilerOpts.
+const (
+	defaultReconcileMargin   = 5 * time.Second
+	defaultReconcileRetained = time.Hour
+	reconcileFillsPageSize   = 100
+)
+
+// PrivateFeedReconcilerOpts contains the options of a PrivateFeedReconciler.
+type PrivateFeedReconcilerOpts struct {
+	// Symbols are the symbols whose HF orders and fills are reconciled.
+	Symbols []string
+	// AccountType is the type of the accounts whose balances are reconciled, "trade_hf" by default.
+	AccountType string
+	// Margin widens the window of the missed fills before the connection was lost, 5s by default.
+	Margin time.Duration
+}
+
+// A PrivateFeedReconciler recovers the private order, fill and balance events missed while the connection was down.
+// It observes the live events to know the state, and after reconnecting it queries the REST API
+// and synthesizes the missed events, which are marked as reconciled.
+type PrivateFeedReconciler struct {
+	as          *ApiService
+	symbols     []string
+	accountType string
+	margin      time.Duration
+
+	mu sync.Mutex
+	// The open orders by order id
+	orders map[string]*PrivateOrderChangeModel
+	// The finished orders and seen trades, with the time they are seen
+	finished map[string]time.Time
+	trades   map[string]time.Time
+	// The latest balances by currency
+	balances map[string]*PrivateBalanceModel
+	lostAt   time.Time
+	// Signaled when the connection is recovered
+	recovered chan struct{}
+}
+
+// NewPrivateFeedReconciler creates an instance of PrivateFeedReconciler.
+func (as *ApiService) NewPrivateFeedReconciler(opts PrivateFeedReconcilerOpts) *PrivateFeedReconciler {
+	if opts.AccountType == "" {
+		opts.AccountType = "trade_hf"
+	}
+	if opts.Margin <= 0 {
+		opts.Margin = defaultReconcileMargin
+	}
+	return &PrivateFeedReconciler{
+		as:          as,
+		symbols:     opts.Symbols,
+		accountType: opts.AccountType,
+		margin:      opts.Margin,
+		orders:      make(map[string]*PrivateOrderChangeModel),
+		finished:    make(map[string]time.Time),
+		trades:      make(map[string]time.Time),
+		balances:    make(map[string]*PrivateBalanceModel),
+		recovered:   make(chan struct{}, 1),
+	}
+}
+
+// StateChange tracks the connection of the private feed, it is meant for WebSocketClientOpts.StateChange.
+func (rc *PrivateFeedReconciler) StateChange(from, to WebSocketState) {
+	switch {
+	case to == WebSocketReconnecting:
+		rc.Lost(time.Now())
+	case from == WebSocketReconnecting && to == WebSocketConnected:
+		rc.Recovered()
+	}
+}
+
+// Lost records the time the connection was lost, the earliest one is kept until the next reconciliation.
+func (rc *PrivateFeedReconciler) Lost(at time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.lostAt.IsZero() || at.Before(rc.lostAt) {
+		rc.lostAt = at
+	}
+}
+
+// Recovered signals Pipe to reconcile.
+func (rc *PrivateFeedReconciler) Recovered() {
+	signal(rc.recovered)
+}
+
+// Observe updates the state with a live message, and reports whether it should be delivered.
+// The events already synthesized by a reconciliation are duplicates, which should be dropped.
+func (rc *PrivateFeedReconciler) Observe(m *WebSocketDownstreamMessage) bool {
+	switch {
+	case m.Topic == PrivateOrderTopic && m.Subject == OrderChangeSubject:
+		o := &PrivateOrderChangeModel{}
+		if err := m.ReadData(o); err != nil {
+			return true
+		}
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.observeOrder(o, time.Now())
+	case m.Topic == PrivateBalanceTopic && m.Subject == BalanceChangeSubject:
+		b := &PrivateBalanceModel{}
+		if err := m.ReadData(b); err != nil {
+			return true
+		}
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.balances[b.Currency] = b
+	}
+	return true
+}
+
+// observeOrder applies an order event, the caller must hold the lock.
+func (rc *PrivateFeedReconciler) observeOrder(o *PrivateOrderChangeModel, now time.Time) bool {
+	if _, ok := rc.finished[o.OrderId]; ok {
+		return false
+	}
+	if o.TradeId != "" {
+		if _, ok := rc.trades[o.TradeId]; ok {
+			return false
+		}
+		rc.trades[o.TradeId] = now
+	}
+	if o.Status == "done" {
+		delete(rc.orders, o.OrderId)
+		rc.finished[o.OrderId] = now
+		return true
+	}
+	known, ok := rc.orders[o.OrderId]
+	if !ok {
+		known = &PrivateOrderChangeModel{}
+		rc.orders[o.OrderId] = known
+	}
+	merged := *o
+	// Keep the fields missing in the event, e.g. the size of the order in a match event
+	for _, f := range [][2]*string{
+		{&merged.Symbol, &known.Symbol},
+		{&merged.OrderType, &known.OrderType},
+		{&merged.Side, &known.Side},
+		{&merged.ClientOid, &known.ClientOid},
+		{&merged.Size, &known.Size},
+		{&merged.Price, &known.Price},
+		{&merged.OriginSize, &known.OriginSize},
+	} {
+		if *f[0] == "" {
+			*f[0] = *f[1]
+		}
+	}
+	if merged.OrderTime == "" {
+		merged.OrderTime = known.OrderTime
+	}
+	// An event without a trade carrying the known state is a duplicate, e.g. a live open event after a synthesized one
+	dup := ok && o.TradeId == "" && merged.Status == known.Status &&
+		decimalCmp(merged.FilledSize, known.FilledSize) == 0 && decimalCmp(merged.Size, known.Size) == 0
+	*known = merged
+	return !dup
+}
+
+// Pipe passes the live messages through Observe, and after the connection is recovered,
+// inserts the events synthesized by Reconcile since the connection was lost.
+// The returned channels are closed once messages is closed or ctx is done,
+// the error channel receives the failed reconciliations without blocking.
+func (rc *PrivateFeedReconciler) Pipe(ctx context.Context, messages <-chan *WebSocketDownstreamMessage) (<-chan *WebSocketDownstreamMessage, <-chan error) {
+	out := make(chan *WebSocketDownstreamMessage)
+	errs := make(chan error, 16)
+	go func() {
+		defer func() {
+			close(out)
+			close(errs)
+		}()
+		send := func(m *WebSocketDownstreamMessage) bool {
+			select {
+			case out <- m:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+				if rc.Observe(m) && !send(m) {
+					return
+				}
+			case <-rc.recovered:
+				rc.mu.Lock()
+				since := rc.lostAt
+				rc.mu.Unlock()
+				if since.IsZero() {
+					since = time.Now()
+				}
+				ms, err := rc.Reconcile(ctx, since)
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+				for _, m := range ms {
+					if !send(m) {
+						return
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+// Reconcile queries the orders, fills and balances changed since the connection was lost at since,
+// and returns the synthesized events in order: opened orders, fills, finished orders and balances.
+// The events are applied to the state as if they were observed.
+// The lost time is reset once all symbols are reconciled.
+func (rc *PrivateFeedReconciler) Reconcile(ctx context.Context, since time.Time) ([]*WebSocketDownstreamMessage, error) {
+	var ms []*WebSocketDownstreamMessage
+	for _, symbol := range rc.symbols {
+		sms, err := rc.reconcileSymbol(ctx, symbol, since.Add(-rc.margin))
+		ms = append(ms, sms...)
+		if err != nil {
+			return ms, errors.Errorf("Reconcile %s failed, %s", symbol, err.Error())
+		}
+	}
+	bms, err := rc.reconcileBalances(ctx)
+	ms = append(ms, bms...)
+	if err != nil {
+		return ms, errors.Errorf("Reconcile balances failed, %s", err.Error())
+	}
+
+	rc.mu.Lock()
+	rc.lostAt = time.Time{}
+	rc.prune(time.Now().Add(-defaultReconcileRetained))
+	rc.mu.Unlock()
+	return ms, nil
+}
+
+// prune forgets the finished orders and trades seen before t, the caller must hold the lock.
+func (rc *PrivateFeedReconciler) prune(t time.Time) {
+	for id, at := range rc.finished {
+		if at.Before(t) {
+			delete(rc.finished, id)
+		}
+	}
+	for id, at := range rc.trades {
+		if at.Before(t) {
+			delete(rc.trades, id)
+		}
+	}
+}
+
+func (rc *PrivateFeedReconciler) reconcileSymbol(ctx context.Context, symbol string, since time.Time) ([]*WebSocketDownstreamMessage, error) {
+	rsp, err := rc.as.HfObtainActiveOrders(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+	active := HfOrdersModel{}
+	if err := rsp.ReadData(&active); err != nil {
+		return nil, err
+	}
+	fills, err := rc.fills(ctx, symbol, since)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []*WebSocketDownstreamMessage
+	emit := func(o *PrivateOrderChangeModel) {
+		o.Reconciled = true
+		rc.mu.Lock()
+		ok := rc.observeOrder(o, time.Now())
+		rc.mu.Unlock()
+		if ok {
+			ms = append(ms, newReconciledMessage(PrivateOrderTopic, OrderChangeSubject, o))
+		}
+	}
+
+	// The missed fills of every order, the filled size before them is the base of the open events
+	unseen := make(map[string][]*HfTransactionDetailModel)
+	rc.mu.Lock()
+	for _, f := range fills {
+		if _, ok := rc.trades[f.TradeId.String()]; !ok {
+			unseen[f.OrderId] = append(unseen[f.OrderId], f)
+		}
+	}
+	rc.mu.Unlock()
+	// The orders created before the gap and not observed yet, e.g. on the first reconciliation,
+	// are added to the state without an open event
+	opened := func(o *HfOrderModel) {
+		if rc.known(o.Id) {
+			return
+		}
+		filled := o.DealSize
+		for _, f := range unseen[o.Id] {
+			filled = decimalSub(filled, f.Size)
+		}
+		e := &PrivateOrderChangeModel{
+			Symbol:     o.Symbol,
+			OrderType:  o.Type,
+			Side:       o.Side,
+			OrderId:    o.Id,
+			Type:       "open",
+			OrderTime:  nanoseconds(o.CreatedAt),
+			Size:       o.Size,
+			FilledSize: filled,
+			Price:      o.Price,
+			ClientOid:  o.ClientOid,
+			RemainSize: decimalSub(o.Size, filled),
+			Status:     "open",
+			Ts:         nanoseconds(o.CreatedAt),
+			OriginSize: o.Size,
+		}
+		if createdAt, _ := o.CreatedAt.Int64(); createdAt < since.UnixNano()/int64(time.Millisecond) {
+			rc.mu.Lock()
+			rc.observeOrder(e, time.Now())
+			rc.mu.Unlock()
+			return
+		}
+		emit(e)
+	}
+
+	// The orders opened during the gap
+	activeIds := make(map[string]bool, len(active))
+	for _, o := range active {
+		activeIds[o.Id] = true
+		opened(o)
+	}
+
+	// The missed fills, including the ones of the orders opened and finished during the gap
+	for _, f := range fills {
+		if _, ok := unseen[f.OrderId]; !ok || rc.finishedOrder(f.OrderId) {
+			continue
+		}
+		if !rc.known(f.OrderId) {
+			o, err := rc.order(ctx, f.OrderId, "", symbol)
+			if err != nil {
+				return ms, err
+			}
+			opened(o)
+		}
+		rc.mu.Lock()
+		known := *rc.orders[f.OrderId]
+		rc.mu.Unlock()
+		filled := decimalAdd(known.FilledSize, f.Size)
+		emit(&PrivateOrderChangeModel{
+			Symbol:     symbol,
+			OrderType:  known.OrderType,
+			Side:       known.Side,
+			OrderId:    f.OrderId,
+			Type:       "match",
+			OrderTime:  known.OrderTime,
+			Size:       known.Size,
+			FilledSize: filled,
+			Price:      known.Price,
+			ClientOid:  known.ClientOid,
+			RemainSize: decimalSub(known.Size, filled),
+			Status:     "match",
+			Ts:         nanoseconds(f.CreatedAt),
+			Liquidity:  f.Liquidity,
+			MatchPrice: f.Price,
+			MatchSize:  f.Size,
+			TradeId:    f.TradeId.String(),
+			OriginSize: known.OriginSize,
+		})
+	}
+
+	// The known orders which are no longer active
+	rc.mu.Lock()
+	var gone []*PrivateOrderChangeModel
+	for id, o := range rc.orders {
+		if o.Symbol == symbol && !activeIds[id] {
+			c := *o
+			gone = append(gone, &c)
+		}
+	}
+	rc.mu.Unlock()
+	sort.Slice(gone, func(i, j int) bool { return gone[i].OrderId < gone[j].OrderId })
+	for _, known := range gone {
+		o, err := rc.order(ctx, known.OrderId, known.ClientOid, symbol)
+		if err != nil {
+			return ms, err
+		}
+		if o.Active {
+			continue
+		}
+		typo := "filled"
+		if decimalCmp(o.CancelledSize, "0") > 0 {
+			typo = "canceled"
+		}
+		emit(&PrivateOrderChangeModel{
+			Symbol:       symbol,
+			OrderType:    o.Type,
+			Side:         o.Side,
+			OrderId:      o.Id,
+			Type:         typo,
+			OrderTime:    nanoseconds(o.CreatedAt),
+			Size:         o.Size,
+			FilledSize:   o.DealSize,
+			Price:        o.Price,
+			ClientOid:    o.ClientOid,
+			RemainSize:   "0",
+			Status:       "done",
+			Ts:           nanoseconds(o.LastUpdatedAt),
+			OriginSize:   known.OriginSize,
+			CanceledSize: o.CancelledSize,
+		})
+	}
+	return ms, nil
+}
+
+// known reports whether the order is open in the state.
+func (rc *PrivateFeedReconciler) known(orderId string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	_, ok := rc.orders[orderId]
+	return ok
+}
+
+// finishedOrder reports whether the order has finished in the state.
+func (rc *PrivateFeedReconciler) finishedOrder(orderId string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	_, ok := rc.finished[orderId]
+	return ok
+}
+
+// order queries an order by the client oid if it is known, or by the order id.
+func (rc *PrivateFeedReconciler) order(ctx context.Context, orderId, clientOid, symbol string) (*HfOrderModel, error) {
+	var rsp *ApiResponse
+	var err error
+	if clientOid != "" {
+		rsp, err = rc.as.HfOrderDetailByClientOid(ctx, clientOid, symbol)
+	} else {
+		rsp, err = rc.as.HfOrderDetail(ctx, orderId, symbol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o := &HfOrderModel{}
+	if err := rsp.ReadData(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// fills queries the fills of the symbol since the time, in ascending order.
+func (rc *PrivateFeedReconciler) fills(ctx context.Context, symbol string, since time.Time) ([]*HfTransactionDetailModel, error) {
+	var fills []*HfTransactionDetailModel
+	p := map[string]string{
+		"symbol":  symbol,
+		"startAt": IntToString(since.UnixNano() / int64(time.Millisecond)),
+		"limit":   IntToString(reconcileFillsPageSize),
+	}
+	for {
+		rsp, err := rc.as.HfTransactionDetails(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		v := &HfTransactionDetailsModel{}
+		if err := rsp.ReadData(v); err != nil {
+			return nil, err
+		}
+		fills = append(fills, v.Items...)
+		if len(v.Items) < reconcileFillsPageSize || v.LastId.String() == "" {
+			break
+		}
+		p["lastId"] = v.LastId.String()
+	}
+	// The fills are sorted in descending order
+	sort.SliceStable(fills, func(i, j int) bool {
+		a, _ := fills[i].CreatedAt.Int64()
+		b, _ := fills[j].CreatedAt.Int64()
+		if a != b {
+			return a < b
+		}
+		return fills[i].TradeId.String() < fills[j].TradeId.String()
+	})
+	return fills, nil
+}
+
+func (rc *PrivateFeedReconciler) reconcileBalances(ctx context.Context) ([]*WebSocketDownstreamMessage, error) {
+	rsp, err := rc.as.HfAccounts(ctx, "", rc.accountType)
+	if err != nil {
+		return nil, err
+	}
+	accounts := HfAccountsModel{}
+	if err := rsp.ReadData(&accounts); err != nil {
+		return nil, err
+	}
+
+	var ms []*WebSocketDownstreamMessage
+	now := IntToString(time.Now().UnixNano() / int64(time.Millisecond))
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, a := range accounts {
+		known, ok := rc.balances[a.Currency]
+		if ok && decimalCmp(known.Total, a.Balance) == 0 && decimalCmp(known.Available, a.Available) == 0 && decimalCmp(known.Hold, a.Holds) == 0 {
+			continue
+		}
+		if !ok {
+			known = &PrivateBalanceModel{Total: "0", Available: "0", Hold: "0"}
+		}
+		b := &PrivateBalanceModel{
+			AccountId:       a.Id,
+			Total:           a.Balance,
+			Available:       a.Available,
+			AvailableChange: decimalSub(a.Available, known.Available),
+			Currency:        a.Currency,
+			Hold:            a.Holds,
+			HoldChange:      decimalSub(a.Holds, known.Hold),
+			RelationEvent:   ReconcileRelationEvent,
+			Time:            now,
+			Reconciled:      true,
+		}
+		rc.balances[a.Currency] = b
+		ms = append(ms, newReconciledMessage(PrivateBalanceTopic, BalanceChangeSubject, b))
+	}
+	return ms, nil
+}
+
+// newReconciledMessage creates a message of a synthesized event.
+func newReconciledMessage(topic, subject string, data interface{}) *WebSocketDownstreamMessage {
+	b, _ := json.Marshal(data)
+	return &WebSocketDownstreamMessage{
+		WebSocketMessage: &WebSocketMessage{Type: Message},
+		Topic:            topic,
+		Subject:          subject,
+		RawData:          b,
+	}
+}
+
+// nanoseconds converts a timestamp in milliseconds to nanoseconds as the order events.
+func nanoseconds(ms json.Number) json.Number {
+	v, err := ms.Int64()
+	if err != nil {
+		return ""
+	}
+	return json.Number(IntToString(v * int64(time.Millisecond)))
+}
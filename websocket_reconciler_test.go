@@ -0,0 +1,167 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestOrderChange(o *PrivateOrderChangeModel) *WebSocketDownstreamMessage {
+	return newReconciledMessage(PrivateOrderTopic, OrderChangeSubject, o)
+}
+
+// newReconcileRequester replies the orders, fills and accounts changed while the connection was down.
+func newReconcileRequester() *routeRequester {
+	rr := newRouteRequester()
+	order := func(id, clientOid, size, dealSize, cancelled string, active bool) *HfOrderModel {
+		return &HfOrderModel{Id: id, ClientOid: clientOid, Symbol: "BTC-USDT", Type: "limit", Side: "buy", Price: "10",
+			Size: size, DealSize: dealSize, CancelledSize: cancelled, Active: active, CreatedAt: "1700000000000", LastUpdatedAt: "1700000001000"}
+	}
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/active", func(r *Request) interface{} {
+		// E was opened before the connection was lost, but not observed
+		e := order("E", "ce", "1", "0", "0", true)
+		e.CreatedAt = "1690000000000"
+		return HfOrdersModel{order("A", "ca", "2", "1", "0", true), order("C", "cc", "1", "0", "0", true), e}
+	})
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/B", func(r *Request) interface{} {
+		return order("B", "cb", "3", "3", "0", false)
+	})
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/client-order/cb", func(r *Request) interface{} {
+		return order("B", "cb", "3", "3", "0", false)
+	})
+	rr.handle(http.MethodGet, "/api/v1/hf/orders/client-order/cd", func(r *Request) interface{} {
+		return order("D", "cd", "1", "0", "1", false)
+	})
+	rr.handle(http.MethodGet, "/api/v1/hf/fills", func(r *Request) interface{} {
+		fill := func(tradeId, orderId, size, createdAt string) *HfTransactionDetailModel {
+			return &HfTransactionDetailModel{TradeId: json.Number(tradeId), OrderId: orderId, Symbol: "BTC-USDT", Price: "10", Size: size, Liquidity: "taker", CreatedAt: json.Number(createdAt)}
+		}
+		return &HfTransactionDetailsModel{Items: []*HfTransactionDetailModel{
+			fill("2", "B", "3", "1700000000300"),
+			fill("1", "A", "1", "1700000000200"),
+			fill("0", "A", "0", "1700000000100"),
+		}}
+	})
+	rr.handle(http.MethodGet, "/api/v1/accounts", func(r *Request) interface{} {
+		return HfAccountsModel{
+			{Currency: "BTC", Balance: "1", Available: "1", Holds: "0", Id: "btc"},
+			{Currency: "USDT", Balance: "95", Available: "95", Holds: "0", Id: "usdt"},
+			{Currency: "ETH", Balance: "2", Available: "2", Holds: "0", Id: "eth"},
+		}
+	})
+	return rr
+}
+
+// The time the connection was lost in the tests
+var testReconcileLostAt = time.Unix(1700000000, 0)
+
+func newTestReconciler(rr *routeRequester) *PrivateFeedReconciler {
+	rc := NewApiService(ApiRequesterOption(rr)).NewPrivateFeedReconciler(PrivateFeedReconcilerOpts{Symbols: []string{"BTC-USDT"}})
+	// The state before the connection was lost
+	rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "A", ClientOid: "ca", Type: "open", Status: "open", Size: "2", FilledSize: "0"}))
+	rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "D", ClientOid: "cd", Type: "open", Status: "open", Size: "1", FilledSize: "0"}))
+	rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "A", Type: "match", Status: "match", TradeId: "0", MatchSize: "0", FilledSize: "0"}))
+	rc.Observe(newReconciledMessage(PrivateBalanceTopic, BalanceChangeSubject, &PrivateBalanceModel{Currency: "USDT", Total: "100", Available: "90", Hold: "10"}))
+	rc.Observe(newReconciledMessage(PrivateBalanceTopic, BalanceChangeSubject, &PrivateBalanceModel{Currency: "ETH", Total: "2", Available: "2", Hold: "0"}))
+	return rc
+}
+
+func TestPrivateFeedReconciler_Reconcile(t *testing.T) {
+	rr := newReconcileRequester()
+	rc := newTestReconciler(rr)
+
+	ms, err := rc.Reconcile(context.Background(), testReconcileLostAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, m := range ms {
+		switch m.Topic {
+		case PrivateOrderTopic:
+			o := &PrivateOrderChangeModel{}
+			if err := m.ReadData(o); err != nil {
+				t.Fatal(err)
+			}
+			if !o.Reconciled {
+				t.Errorf("Expected a reconciled event: %s", m.RawData)
+			}
+			events = append(events, o.OrderId+":"+o.Type+":"+o.FilledSize)
+		case PrivateBalanceTopic:
+			b := &PrivateBalanceModel{}
+			if err := m.ReadData(b); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, b.Currency+":"+b.Total+":"+b.AvailableChange+":"+b.HoldChange)
+		}
+	}
+	want := "C:open:0,A:match:1,B:open:0,B:match:3,B:filled:3,D:canceled:0,BTC:1:1:0,USDT:95:5:-10"
+	if s := strings.Join(events, ","); s != want {
+		t.Errorf("Unexpected events\n got %s\nwant %s", s, want)
+	}
+
+	// The live events already synthesized are dropped
+	if rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "A", Type: "match", Status: "match", TradeId: "1"})) {
+		t.Error("Expected the duplicated fill dropped")
+	}
+	if rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "B", Type: "filled", Status: "done"})) {
+		t.Error("Expected the event of the finished order dropped")
+	}
+	if !rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "A", Type: "match", Status: "match", TradeId: "3"})) {
+		t.Error("Expected the new fill delivered")
+	}
+	if rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "C", Type: "open", Status: "open", Size: "1", FilledSize: "0"})) {
+		t.Error("Expected the open event of the synthesized order dropped")
+	}
+	if !rc.Observe(newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "E", Type: "update", Status: "open", Size: "0.5", FilledSize: "0"})) {
+		t.Error("Expected the update of the order delivered")
+	}
+
+	// Nothing missed at all
+	ms, err = rc.Reconcile(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 0 {
+		t.Errorf("Unexpected events: %d", len(ms))
+	}
+	if n := rr.count(http.MethodGet, "/api/v1/hf/orders/client-order/cb"); n != 1 {
+		t.Errorf("Expected the finished order queried once, got %d", n)
+	}
+}
+
+func TestPrivateFeedReconciler_Pipe(t *testing.T) {
+	rc := newTestReconciler(newReconcileRequester())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *WebSocketDownstreamMessage)
+	out, errs := rc.Pipe(ctx, in)
+
+	rc.Lost(testReconcileLostAt)
+	rc.StateChange(WebSocketConnected, WebSocketReconnecting)
+	rc.StateChange(WebSocketReconnecting, WebSocketConnected)
+	for i := 0; i < 8; i++ {
+		m := <-out
+		if !strings.Contains(string(m.RawData), `"reconciled":true`) {
+			t.Errorf("Expected a reconciled event: %s", m.RawData)
+		}
+	}
+
+	go func() {
+		in <- newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "A", Type: "match", Status: "match", TradeId: "1"})
+		in <- newTestOrderChange(&PrivateOrderChangeModel{Symbol: "BTC-USDT", OrderId: "A", Type: "match", Status: "match", TradeId: "3"})
+		close(in)
+	}()
+	m := <-out
+	if !strings.Contains(string(m.RawData), `"tradeId":"3"`) {
+		t.Errorf("Unexpected event: %s", m.RawData)
+	}
+	if _, ok := <-out; ok {
+		t.Error("Expected the channel closed")
+	}
+	if err, ok := <-errs; ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package kucoin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A WebSocketRecord represents a downstream message recorded with its receive timestamp.
+// A recording is a sequence of records in JSON lines.
+type WebSocketRecord struct {
+	// ReceivedAt is the receive timestamp in nanoseconds.
+	ReceivedAt int64                       `json:"receivedAt"`
+	Message    *WebSocketDownstreamMessage `json:"message"`
+}
+
+// A WebSocketRecorder writes the downstream messages to a recording.
+type WebSocketRecorder struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewWebSocketRecorder creates an instance of WebSocketRecorder writing to w.
+// The records are buffered, call Flush to write them out.
+func NewWebSocketRecorder(w io.Writer) *WebSocketRecorder {
+	bw := bufio.NewWriter(w)
+	return &WebSocketRecorder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Record records m received now.
+func (wr *WebSocketRecorder) Record(m *WebSocketDownstreamMessage) error {
+	return wr.RecordAt(m, time.Now())
+}
+
+// RecordAt records m received at t.
+func (wr *WebSocketRecorder) RecordAt(m *WebSocketDownstreamMessage, t time.Time) error {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.enc.Encode(&WebSocketRecord{ReceivedAt: t.UnixNano(), Message: m})
+}
+
+// Flush writes the buffered records out.
+func (wr *WebSocketRecorder) Flush() error {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.w.Flush()
+}
+
+// Tee records the messages and passes them through to the returned channel,
+// which is closed after the records are flushed once messages is closed or ctx is done.
+// The errors of recording are sent to errs if it is not nil, without blocking.
+func (wr *WebSocketRecorder) Tee(ctx context.Context, messages <-chan *WebSocketDownstreamMessage, errs chan<- error) <-chan *WebSocketDownstreamMessage {
+	out := make(chan *WebSocketDownstreamMessage)
+	report := func(err error) {
+		if err == nil || errs == nil {
+			return
+		}
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	go func() {
+		defer close(out)
+		defer func() { report(wr.Flush()) }()
+		for {
+			select {
+			case m, ok := <-messages:
+				if !ok {
+					return
+				}
+				report(wr.Record(m))
+				select {
+				case out <- m:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// WebSocketReplayOpts contains the options of a WebSocketReplay.
+type WebSocketReplayOpts struct {
+	// Speed is the playback rate relative to the recording, 1 (real speed) by default.
+	// e.g. 10 plays a recording of 10 minutes in 1 minute.
+	Speed float64
+	// NoDelay plays the records back as fast as they are consumed.
+	NoDelay bool
+}
+
+// A WebSocketReplay plays a recording back with the same channel contract as WebSocketClient.Connect.
+type WebSocketReplay struct {
+	r        io.Reader
+	speed    float64
+	noDelay  bool
+	started  int32
+	done     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+	messages chan *WebSocketDownstreamMessage
+	errors   chan error
+}
+
+// NewWebSocketReplay creates an instance of WebSocketReplay reading the recording from r.
+func NewWebSocketReplay(r io.Reader, opts WebSocketReplayOpts) *WebSocketReplay {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	return &WebSocketReplay{
+		r:        r,
+		speed:    opts.Speed,
+		noDelay:  opts.NoDelay,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		messages: make(chan *WebSocketDownstreamMessage),
+		errors:   make(chan error, 1),
+	}
+}
+
+// Connect starts playing the recording back.
+func (rp *WebSocketReplay) Connect() (<-chan *WebSocketDownstreamMessage, <-chan error, error) {
+	return rp.ConnectContext(context.Background())
+}
+
+// ConnectContext starts playing the recording back until ctx is done, Stop is called or the recording ends.
+// Both channels are closed then, the error channel receives the error reading a broken recording.
+func (rp *WebSocketReplay) ConnectContext(ctx context.Context) (<-chan *WebSocketDownstreamMessage, <-chan error, error) {
+	if !atomic.CompareAndSwapInt32(&rp.started, 0, 1) {
+		return rp.messages, rp.errors, errors.New("WebSocket replay has been started or stopped")
+	}
+	go rp.play(ctx)
+	return rp.messages, rp.errors, nil
+}
+
+func (rp *WebSocketReplay) play(ctx context.Context) {
+	defer rp.closeChannels()
+
+	dec := json.NewDecoder(rp.r)
+	var first int64
+	var start time.Time
+	for {
+		rec := &WebSocketRecord{}
+		if err := dec.Decode(rec); err != nil {
+			if err != io.EOF {
+				rp.errors <- errors.Errorf("Read the recording failed, %s", err.Error())
+			}
+			return
+		}
+		if rec.Message == nil {
+			continue
+		}
+
+		if start.IsZero() {
+			first, start = rec.ReceivedAt, time.Now()
+		} else if !rp.noDelay {
+			at := start.Add(time.Duration(float64(rec.ReceivedAt-first) / rp.speed))
+			if d := time.Until(at); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-rp.done:
+					t.Stop()
+					return
+				case <-ctx.Done():
+					t.Stop()
+					return
+				}
+			}
+		}
+
+		select {
+		case rp.messages <- rec.Message:
+		case <-rp.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (rp *WebSocketReplay) closeChannels() {
+	close(rp.messages)
+	close(rp.errors)
+	close(rp.stopped)
+}
+
+// Done returns a channel closed when the playback ends.
+func (rp *WebSocketReplay) Done() <-chan struct{} {
+	return rp.stopped
+}
+
+// Stop stops playing back, the channels are closed.
+// It is safe to call Stop more than once.
+func (rp *WebSocketReplay) Stop() {
+	rp.stopOnce.Do(func() {
+		close(rp.done)
+		// Nothing plays back to close the channels
+		if atomic.CompareAndSwapInt32(&rp.started, 0, 1) {
+			rp.closeChannels()
+		}
+	})
+}
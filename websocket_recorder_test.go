@@ -0,0 +1,117 @@
+package kucoin
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketRecorder_Replay(t *testing.T) {
+	buf := &bytes.Buffer{}
+	wr := NewWebSocketRecorder(buf)
+	at := time.Unix(1700000000, 0)
+	for i := 0; i < 5; i++ {
+		m := newTestDownstreamMessage("/market/match:BTC-USDT", "trade.l3match", int64(i))
+		if err := wr.RecordAt(m, at.Add(time.Duration(i)*100*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 5 {
+		t.Fatalf("Expected 5 lines, got %d", n)
+	}
+
+	// 400ms recorded, played back 4 times faster
+	rp := NewWebSocketReplay(bytes.NewReader(buf.Bytes()), WebSocketReplayOpts{Speed: 4})
+	mc, ec, err := rp.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rp.Connect(); err == nil {
+		t.Error("Expected an error connecting twice")
+	}
+	start := time.Now()
+	var sn int64
+	for m := range mc {
+		if m.Sn != sn || m.Topic != "/market/match:BTC-USDT" || m.Type != Message {
+			t.Errorf("Unexpected message: %s", ToJsonString(m))
+		}
+		sn++
+	}
+	if el := time.Since(start); el < 90*time.Millisecond || el > 300*time.Millisecond {
+		t.Errorf("Unexpected playback duration: %v", el)
+	}
+	if sn != 5 {
+		t.Errorf("Expected 5 messages, got %d", sn)
+	}
+	if err, ok := <-ec; ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// A broken recording
+	rp = NewWebSocketReplay(strings.NewReader(buf.String()+"{broken"), WebSocketReplayOpts{NoDelay: true})
+	mc, ec, _ = rp.Connect()
+	n := 0
+	for range mc {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("Expected 5 messages, got %d", n)
+	}
+	if err := <-ec; err == nil {
+		t.Error("Expected an error of the broken recording")
+	}
+
+	// Stop while playing back
+	rp = NewWebSocketReplay(bytes.NewReader(buf.Bytes()), WebSocketReplayOpts{})
+	mc, _, _ = rp.Connect()
+	<-mc
+	rp.Stop()
+	<-rp.Done()
+}
+
+func TestWebSocketRecorder_Tee(t *testing.T) {
+	buf := &bytes.Buffer{}
+	wr := NewWebSocketRecorder(buf)
+	in := make(chan *WebSocketDownstreamMessage)
+	out := wr.Tee(context.Background(), in, nil)
+	go func() {
+		for i := 0; i < 3; i++ {
+			in <- newTestDownstreamMessage("/market/ticker:BTC-USDT", "trade.ticker", int64(i))
+		}
+		close(in)
+	}()
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 3 || strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("Expected 3 messages recorded, got %d: %s", n, buf.String())
+	}
+}
+
+func TestWebSocketRecorder_TeeStop(t *testing.T) {
+	buf := &bytes.Buffer{}
+	wr := NewWebSocketRecorder(buf)
+	in := make(chan *WebSocketDownstreamMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := wr.Tee(ctx, in, nil)
+	// The consumer stops reading before the message is passed through
+	in <- newTestDownstreamMessage("/market/ticker:BTC-USDT", "trade.ticker", 1)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the channel closed")
+	}
+	for range out {
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("Expected the message recorded: %s", buf.String())
+	}
+}
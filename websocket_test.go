@@ -2,7 +2,15 @@ package kucoin
 
 import (
 	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestApiService_WebSocketPublicToken(t *testing.T) {
@@ -140,3 +148,392 @@ func TestWebSocketClient_Subscribe(t *testing.T) {
 		}
 	}
 }
+
+// A localWebSocketServer speaks the basic KuCoin protocol:
+// welcome on connect, pong for ping, ack for subscribe and unsubscribe.
+// Acks are replied out of order, topics prefixed with "/invalid" are replied with an error,
+// and every subscribed topic receives one message right after the ack.
+type localWebSocketServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	conns   []*websocket.Conn
+	headers []http.Header
+}
+
+func newLocalWebSocketServer(t *testing.T) (*localWebSocketServer, *WebSocketTokenModel) {
+	up := websocket.Upgrader{}
+	ls := &localWebSocketServer{}
+	ls.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ls.mu.Lock()
+		ls.conns = append(ls.conns, conn)
+		ls.headers = append(ls.headers, r.Header)
+		ls.mu.Unlock()
+
+		var mu sync.Mutex
+		reply := func(v interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return conn.WriteJSON(v)
+		}
+		if err := reply(&WebSocketMessage{Id: "welcome", Type: WelcomeMessage}); err != nil {
+			return
+		}
+		for {
+			m := &WebSocketSubscribeMessage{}
+			if err := conn.ReadJSON(m); err != nil {
+				return
+			}
+			switch m.Type {
+			case PingMessage:
+				if err := reply(&WebSocketMessage{Id: m.Id, Type: PongMessage}); err != nil {
+					return
+				}
+			case OpenTunnelMessage, CloseTunnelMessage:
+				if err := reply(&WebSocketMessage{Id: m.Id, Type: AckMessage}); err != nil {
+					return
+				}
+			case SubscribeMessage, UnsubscribeMessage:
+				go func(m *WebSocketSubscribeMessage) {
+					time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+					if strings.HasPrefix(m.Topic, "/invalid") {
+						_ = reply(map[string]interface{}{"id": m.Id, "type": ErrorMessage, "code": 404, "data": "topic " + m.Topic + " is not found"})
+						return
+					}
+					_ = reply(&WebSocketMessage{Id: m.Id, Type: AckMessage})
+					if m.Type == SubscribeMessage {
+						_ = reply(map[string]interface{}{"type": Message, "topic": m.Topic, "subject": "trade.ticker", "tunnelId": m.TunnelId, "data": map[string]string{}})
+					}
+				}(m)
+			}
+		}
+	}))
+	tk := &WebSocketTokenModel{
+		Token: "token",
+		Servers: WebSocketServersModel{{
+			Endpoint:     "ws" + strings.TrimPrefix(ls.URL, "http"),
+			Protocol:     "websocket",
+			PingInterval: 210,
+			PingTimeout:  1000,
+		}},
+	}
+	return ls, tk
+}
+
+// connCount returns the number of connections accepted so far.
+func (ls *localWebSocketServer) connCount() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return len(ls.conns)
+}
+
+// drop closes the i-th accepted connection.
+func (ls *localWebSocketServer) drop(i int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	_ = ls.conns[i].Close()
+}
+
+func TestWebSocketClient_ConcurrentWrites(t *testing.T) {
+	ts, tk := newLocalWebSocketServer(t)
+	defer ts.Close()
+
+	c := NewApiService().NewWebSocketClient(tk)
+	if _, _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	// Subscribe sequentially while the heartbeat pings every 10ms
+	for i := 0; i < 50; i++ {
+		if err := c.Subscribe(NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Send(context.Background(), NewSubscribeMessage("/market/ticker:ETH-BTC", false)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWebSocketClient_SendContext(t *testing.T) {
+	ts, tk := newLocalWebSocketServer(t)
+	defer ts.Close()
+
+	c := NewApiService().NewWebSocketClient(tk)
+	if _, _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Send(ctx, NewPingMessage()); err == nil {
+		t.Error("Expect an error with the cancelled context")
+	}
+
+	c.Stop()
+	if err := c.Send(context.Background(), NewPingMessage()); err == nil {
+		t.Error("Expect an error after the client stopped")
+	}
+}
+
+func TestWebSocketClient_ConcurrentSubscribe(t *testing.T) {
+	ts, tk := newLocalWebSocketServer(t)
+	defer ts.Close()
+
+	c := NewApiService().NewWebSocketClient(tk)
+	_, ec, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := "/market/ticker:KCS-BTC"
+			if i%5 == 0 {
+				topic = "/invalid/ticker:KCS-BTC"
+			}
+			err := c.Subscribe(NewSubscribeMessage(topic, false))
+			switch {
+			case i%5 == 0 && err == nil:
+				t.Errorf("Expect an error for %s", topic)
+			case i%5 != 0 && err != nil:
+				t.Error(err)
+			}
+			if err := c.Unsubscribe(NewUnsubscribeMessage(topic, false)); i%5 != 0 && err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-ec:
+		t.Fatalf("Unexpected connection error: %s", err)
+	default:
+	}
+}
+
+func TestWebSocketClient_Dialer(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	s := NewApiService()
+	c1 := s.NewWebSocketClientOpts(WebSocketClientOpts{
+		Token:             tk,
+		TLSSkipVerify:     true,
+		Header:            http.Header{"X-Client": []string{"c1"}},
+		EnableCompression: true,
+	})
+	c2 := s.NewWebSocketClientOpts(WebSocketClientOpts{
+		Token:  tk,
+		Header: http.Header{"X-Client": []string{"c2"}},
+	})
+	for _, c := range []*WebSocketClient{c1, c2} {
+		if _, _, err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Stop()
+	}
+
+	if !c1.dialer.TLSClientConfig.InsecureSkipVerify || c2.dialer.TLSClientConfig.InsecureSkipVerify {
+		t.Error("Invalid TLS config of the dialers")
+	}
+	if c1.dialer.ReadBufferSize != defaultReadBufferSize {
+		t.Errorf("Invalid read buffer size %d", c1.dialer.ReadBufferSize)
+	}
+	if websocket.DefaultDialer.TLSClientConfig != nil || websocket.DefaultDialer.ReadBufferSize != 0 {
+		t.Error("The default dialer should not be changed")
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.headers[0].Get("X-Client") != "c1" || ls.headers[1].Get("X-Client") != "c2" {
+		t.Error("Invalid handshake headers")
+	}
+	if !strings.Contains(ls.headers[0].Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Error("Expect the compression to be negotiated")
+	}
+}
+
+func TestWebSocketClient_ConnectContext(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewApiService().NewWebSocketClient(tk)
+	mc, ec, err := c.ConnectContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SubscribeContext(ctx, NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	<-mc
+
+	// Cancelling the parent context stops the client and closes the channels
+	cancel()
+	for range mc {
+	}
+	for range ec {
+	}
+	if err := c.StopContext(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := c.SubscribeContext(context.Background(), NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err == nil {
+		t.Error("Expect an error after the client stopped")
+	}
+}
+
+func TestWebSocketClient_WelcomeTimeout(t *testing.T) {
+	up := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never send the welcome message
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer ts.Close()
+
+	tk := &WebSocketTokenModel{
+		Token:   "token",
+		Servers: WebSocketServersModel{{Endpoint: "ws" + strings.TrimPrefix(ts.URL, "http"), PingInterval: 210, PingTimeout: 1000}},
+	}
+	c := NewApiService().NewWebSocketClient(tk)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := c.ConnectContext(ctx); err == nil {
+		t.Fatal("Expect an error without the welcome message")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Connect should give up in time, took %v", d)
+	}
+	// Stop a client which is not connected
+	c.Stop()
+	c.Stop()
+}
+
+// stateRecorder records the state transitions of a client.
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []WebSocketState
+}
+
+func (sr *stateRecorder) record(from, to WebSocketState) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.states = append(sr.states, to)
+}
+
+func (sr *stateRecorder) String() string {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	var ss []string
+	for _, s := range sr.states {
+		ss = append(ss, s.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+func TestWebSocketClient_TerminalError(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	sr := &stateRecorder{}
+	c := NewApiService().NewWebSocketClientOpts(WebSocketClientOpts{Token: tk, StateChange: sr.record})
+	mc, ec, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != WebSocketConnected {
+		t.Fatalf("Invalid state %s", c.State())
+	}
+
+	ls.drop(0)
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Wait the client to be closed timeout")
+	}
+	if err := <-ec; err == nil || err != c.Err() {
+		t.Errorf("Invalid terminal error %v", err)
+	}
+	if _, ok := <-ec; ok {
+		t.Error("The error channel should be closed")
+	}
+	if _, ok := <-mc; ok {
+		t.Error("The message channel should be closed")
+	}
+	if s := sr.String(); s != "connecting,connected,closed" {
+		t.Errorf("Invalid state transitions %s", s)
+	}
+	c.Stop()
+}
+
+func TestWebSocketClient_Reconnect(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	sr := &stateRecorder{}
+	c := NewApiService().NewWebSocketClientOpts(WebSocketClientOpts{
+		Token:             tk,
+		ReconnectAttempts: 3,
+		ReconnectDelay:    10 * time.Millisecond,
+		StateChange:       sr.record,
+	})
+	mc, _, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	<-mc
+
+	// The channel is subscribed again over the new connection
+	ls.drop(0)
+	select {
+	case m := <-mc:
+		if m.Topic != "/market/ticker:KCS-BTC" {
+			t.Errorf("Invalid topic %s", m.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait the resubscribed message timeout")
+	}
+	// The message may arrive before the state changes
+	deadline := time.Now().Add(time.Second)
+	for c.State() != WebSocketConnected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c.State() != WebSocketConnected || ls.connCount() != 2 {
+		t.Errorf("Invalid state %s with %d connections", c.State(), ls.connCount())
+	}
+
+	c.Stop()
+	if c.Err() != nil {
+		t.Errorf("Invalid terminal error %s", c.Err())
+	}
+	if s := sr.String(); s != "connecting,connected,reconnecting,connected,closed" {
+		t.Errorf("Invalid state transitions %s", s)
+	}
+}
@@ -0,0 +1,196 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// All operations of the WebSocket trade session.
+const (
+	TradeOrderOp  = "spot.order"
+	TradeCancelOp = "spot.cancel"
+	TradeModifyOp = "spot.modify"
+)
+
+// A WebSocketTradeRequest represents an operation sent over the WebSocket trade session.
+type WebSocketTradeRequest struct {
+	Id   string      `json:"id"`
+	Op   string      `json:"op"`
+	Args interface{} `json:"args"`
+}
+
+// NewWebSocketTradeRequest creates a request of the operation with a new id.
+func NewWebSocketTradeRequest(op string, args interface{}) *WebSocketTradeRequest {
+	return &WebSocketTradeRequest{
+		Id:   newMessageId(),
+		Op:   op,
+		Args: args,
+	}
+}
+
+// A WebSocketTradeResponse represents the response of an operation, correlated to the request by id.
+type WebSocketTradeResponse struct {
+	Id      string          `json:"id"`
+	Op      string          `json:"op"`
+	Code    string          `json:"code"`
+	Message string          `json:"msg"`
+	RawData json.RawMessage `json:"data"`
+	InTime  int64           `json:"inTime"`
+	OutTime int64           `json:"outTime"`
+}
+
+// ApiSuccessful judges the success of the operation.
+func (tr *WebSocketTradeResponse) ApiSuccessful() bool {
+	return tr.Code == ApiSuccess
+}
+
+// ReadData read the response `data` as JSON into v.
+func (tr *WebSocketTradeResponse) ReadData(v interface{}) error {
+	if !tr.ApiSuccessful() {
+		m := fmt.Sprintf("[API]Failure: api code is NOT %s, op %s with id=%s, respond code=%s message=\"%s\" data=%s",
+			ApiSuccess,
+			tr.Op,
+			tr.Id,
+			tr.Code,
+			tr.Message,
+			string(tr.RawData),
+		)
+		return errors.New(m)
+	}
+	// when input parameter v is nil, read nothing and return nil
+	if v == nil {
+		return nil
+	}
+	if len(tr.RawData) == 0 {
+		return errors.New("[API]Failure: try to read empty data")
+	}
+	return json.Unmarshal(tr.RawData, v)
+}
+
+// A WebSocketTradeClient places, cancels and modifies HF orders over a private WebSocket session.
+// The session is authenticated by the private token only. The operations are not verified against the real API,
+// they may be rejected by the server.
+type WebSocketTradeClient struct {
+	client *WebSocketClient
+}
+
+// WebSocketTradeClientOpts contains the options of a WebSocketTradeClient.
+type WebSocketTradeClientOpts struct {
+	// ClientOpts are the options of the underlying WebSocketClient.
+	// The private token is requested if ClientOpts.Token is nil.
+	ClientOpts WebSocketClientOpts
+}
+
+// NewWebSocketTradeClient connects a private WebSocket session.
+func (as *ApiService) NewWebSocketTradeClient(ctx context.Context) (*WebSocketTradeClient, error) {
+	return as.NewWebSocketTradeClientOpts(ctx, WebSocketTradeClientOpts{
+		ClientOpts: WebSocketClientOpts{
+			TLSSkipVerify: as.apiSkipVerifyTls,
+			Timeout:       defaultTimeout,
+		},
+	})
+}
+
+// NewWebSocketTradeClientOpts connects a private WebSocket session with the parsed options.
+// ctx bounds the token request, the session lives until Stop is called.
+func (as *ApiService) NewWebSocketTradeClientOpts(ctx context.Context, opts WebSocketTradeClientOpts) (*WebSocketTradeClient, error) {
+	if signer, ok := as.signer.(*KcSigner); !ok || signer.apiKey == "" {
+		return nil, errors.New("The WebSocket trade session requires an API key")
+	}
+
+	co := opts.ClientOpts
+	if co.Token == nil {
+		rsp, err := as.WebSocketPrivateToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		co.Token = &WebSocketTokenModel{}
+		if err := rsp.ReadData(co.Token); err != nil {
+			return nil, err
+		}
+	}
+	// No channel is subscribed, the pushed messages are dropped
+	if co.Backpressure == BackpressureBlock {
+		co.Backpressure = BackpressureDropNewest
+	}
+
+	// The session outlives ctx, the dial is bounded by the timeout of the client
+	tc := &WebSocketTradeClient{client: as.NewWebSocketClientOpts(co)}
+	if _, _, err := tc.client.Connect(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// Request sends the operation and waits for the response with the same id.
+// If ctx has no deadline, the timeout of the client is applied.
+func (tc *WebSocketTradeClient) Request(ctx context.Context, op string, args interface{}) (*WebSocketTradeResponse, error) {
+	r := NewWebSocketTradeRequest(op, args)
+	raw, err := tc.client.Request(ctx, r.Id, r)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &WebSocketTradeResponse{}
+	if err := json.Unmarshal(raw, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// call requests the operation and reads the response data into v.
+func (tc *WebSocketTradeClient) call(ctx context.Context, op string, args interface{}, v interface{}) error {
+	rsp, err := tc.Request(ctx, op, args)
+	if err != nil {
+		return err
+	}
+	return rsp.ReadData(v)
+}
+
+// HfPlaceOrder places a HF order over the WebSocket, the params are the same as HfPlaceOrder of ApiService.
+func (tc *WebSocketTradeClient) HfPlaceOrder(ctx context.Context, params map[string]string) (*HfPlaceOrderRes, error) {
+	v := &HfPlaceOrderRes{}
+	if err := tc.call(ctx, TradeOrderOp, params, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// HfCancelOrder cancels a HF order by orderId over the WebSocket.
+func (tc *WebSocketTradeClient) HfCancelOrder(ctx context.Context, orderId, symbol string) (*HfOrderIdModel, error) {
+	p := map[string]string{
+		"orderId": orderId,
+		"symbol":  symbol,
+	}
+	v := &HfOrderIdModel{}
+	if err := tc.call(ctx, TradeCancelOp, p, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// HfModifyOrder modifies a HF order over the WebSocket, the params are the same as HfModifyOrder of ApiService.
+func (tc *WebSocketTradeClient) HfModifyOrder(ctx context.Context, params map[string]string) (*HfModifyOrderRes, error) {
+	v := &HfModifyOrderRes{}
+	if err := tc.call(ctx, TradeModifyOp, params, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Done returns a channel closed when the session is closed.
+func (tc *WebSocketTradeClient) Done() <-chan struct{} {
+	return tc.client.Done()
+}
+
+// Err returns the error which broke the session after Done is closed.
+func (tc *WebSocketTradeClient) Err() error {
+	return tc.client.Err()
+}
+
+// Stop closes the session, the pending operations fail.
+func (tc *WebSocketTradeClient) Stop() {
+	tc.client.Stop()
+}
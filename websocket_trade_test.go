@@ -0,0 +1,194 @@
+package kucoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newLocalTradeServer starts a WebSocket server replying the trade operations out of order.
+func newLocalTradeServer(t *testing.T) (*httptest.Server, *WebSocketTokenModel) {
+	up := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var mu sync.Mutex
+		reply := func(v interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			_ = conn.WriteJSON(v)
+		}
+		reply(&WebSocketMessage{Id: "welcome", Type: WelcomeMessage})
+		for {
+			m := struct {
+				Id   string            `json:"id"`
+				Type string            `json:"type"`
+				Op   string            `json:"op"`
+				Args map[string]string `json:"args"`
+			}{}
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+			if m.Type == PingMessage {
+				reply(&WebSocketMessage{Id: m.Id, Type: PongMessage})
+				continue
+			}
+			rsp := map[string]interface{}{"id": m.Id, "op": m.Op, "code": ApiSuccess, "inTime": 1, "outTime": 2}
+			switch {
+			case m.Args["symbol"] == "INVALID":
+				rsp["code"], rsp["msg"] = "400100", "symbol is invalid"
+			case m.Op == TradeOrderOp:
+				rsp["data"] = map[string]interface{}{"orderId": "o-" + m.Args["clientOid"], "clientOid": m.Args["clientOid"], "success": true}
+			case m.Op == TradeCancelOp:
+				rsp["data"] = map[string]string{"orderId": m.Args["orderId"]}
+			case m.Op == TradeModifyOp:
+				rsp["data"] = map[string]string{"newOrderId": "n-" + m.Args["orderId"], "clientOid": m.Args["clientOid"]}
+			}
+			go func() {
+				time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+				reply(rsp)
+			}()
+		}
+	}))
+	tk := &WebSocketTokenModel{
+		Token: "token",
+		Servers: WebSocketServersModel{{
+			Endpoint:     "ws" + strings.TrimPrefix(ts.URL, "http"),
+			Protocol:     "websocket",
+			PingInterval: 210,
+			PingTimeout:  1000,
+		}},
+	}
+	return ts, tk
+}
+
+func TestWebSocketTradeClient_Orders(t *testing.T) {
+	ts, tk := newLocalTradeServer(t)
+	defer ts.Close()
+
+	s := NewApiService(ApiKeyOption("key"), ApiSecretOption("secret"), ApiPassPhraseOption("passphrase"))
+	tc, err := s.NewWebSocketTradeClientOpts(context.Background(), WebSocketTradeClientOpts{ClientOpts: WebSocketClientOpts{Token: tk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Stop()
+
+	// The responses arrive out of order
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			oid := fmt.Sprintf("c%d", i)
+			o, err := tc.HfPlaceOrder(context.Background(), map[string]string{"clientOid": oid, "symbol": "BTC-USDT"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if o.OrderId != "o-"+oid || o.ClientOid != oid || !o.Success {
+				t.Errorf("Unexpected response of %s: %s", oid, ToJsonString(o))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c, err := tc.HfCancelOrder(context.Background(), "o-c1", "BTC-USDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OrderId != "o-c1" {
+		t.Errorf("Unexpected cancelled order: %s", c.OrderId)
+	}
+
+	m, err := tc.HfModifyOrder(context.Background(), map[string]string{"orderId": "o-c2", "clientOid": "c2", "symbol": "BTC-USDT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.NewOrderId != "n-o-c2" || m.ClientOid != "c2" {
+		t.Errorf("Unexpected modified order: %s", ToJsonString(m))
+	}
+
+	if _, err := tc.HfPlaceOrder(context.Background(), map[string]string{"clientOid": "c", "symbol": "INVALID"}); err == nil || !strings.Contains(err.Error(), "400100") {
+		t.Errorf("Expected an api failure, got %v", err)
+	}
+
+	tc.Stop()
+	if _, err := tc.HfCancelOrder(context.Background(), "o-c1", "BTC-USDT"); err == nil {
+		t.Error("Expected an error after Stop")
+	}
+}
+
+func TestWebSocketTradeClient_ApiKey(t *testing.T) {
+	ts, tk := newLocalTradeServer(t)
+	defer ts.Close()
+
+	if _, err := NewApiService().NewWebSocketTradeClientOpts(context.Background(), WebSocketTradeClientOpts{ClientOpts: WebSocketClientOpts{Token: tk}}); err == nil {
+		t.Error("Expected an error without API key")
+	}
+}
+
+func TestWebSocketTradeClient_Reconnect(t *testing.T) {
+	fs := newFakeWebSocketServer()
+	fs.Handle(func(c *fakeWebSocketConn, r *fakeWebSocketRequest) bool {
+		m := &struct {
+			Id   string            `json:"id"`
+			Op   string            `json:"op"`
+			Args map[string]string `json:"args"`
+		}{}
+		if err := json.Unmarshal(r.Raw, m); err != nil || m.Op == "" {
+			return false
+		}
+		_ = c.Push(map[string]interface{}{"id": m.Id, "op": m.Op, "code": ApiSuccess,
+			"data": map[string]interface{}{"orderId": "o1", "clientOid": m.Args["clientOid"], "success": true}})
+		return true
+	})
+
+	co := fs.ClientOpts()
+	co.ReconnectAttempts, co.ReconnectDelay = 1, 10*time.Millisecond
+	s := NewApiService(ApiKeyOption("key"), ApiSecretOption("secret"), ApiPassPhraseOption("passphrase"))
+	tc, err := s.NewWebSocketTradeClientOpts(context.Background(), WebSocketTradeClientOpts{ClientOpts: co})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := fs.Conn(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Drop()
+	if _, err := fs.Conn(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	for tc.client.State() != WebSocketConnected {
+		select {
+		case <-ctx.Done():
+			t.Fatal("Expected the session to be reconnected")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	// The operations go on over the reconnected session
+	o, err := tc.HfPlaceOrder(ctx, map[string]string{"clientOid": "c1", "symbol": "BTC-USDT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.OrderId != "o1" || o.ClientOid != "c1" {
+		t.Errorf("Unexpected response: %s", ToJsonString(o))
+	}
+}
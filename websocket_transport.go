@@ -0,0 +1,39 @@
+package kucoin
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A WebSocketConn is the connection the WebSocketClient reads and writes the frames through.
+// *websocket.Conn implements it.
+// ReadMessage is called by a single goroutine, the other methods may be called concurrently with it.
+type WebSocketConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// A WebSocketDialer dials the connections of the WebSocketClient.
+type WebSocketDialer interface {
+	DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (WebSocketConn, error)
+}
+
+// webSocketDialer is the WebSocketDialer over a gorilla dialer.
+type webSocketDialer struct {
+	dialer *websocket.Dialer
+}
+
+// DialContext dials the url with the gorilla dialer.
+func (d *webSocketDialer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (WebSocketConn, error) {
+	conn, _, err := d.dialer.DialContext(ctx, urlStr, requestHeader)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,172 @@
+package kucoin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A WebSocketTunnelMessage represents a message to open or close a tunnel.
+type WebSocketTunnelMessage struct {
+	*WebSocketMessage
+	NewTunnelId string `json:"newTunnelId,omitempty"`
+	TunnelId    string `json:"tunnelId,omitempty"`
+	Response    bool   `json:"response"`
+}
+
+// NewOpenTunnelMessage creates a message to open the tunnel.
+func NewOpenTunnelMessage(tunnelId string) *WebSocketTunnelMessage {
+	return &WebSocketTunnelMessage{
+		WebSocketMessage: &WebSocketMessage{
+			Id:   newMessageId(),
+			Type: OpenTunnelMessage,
+		},
+		NewTunnelId: tunnelId,
+		Response:    true,
+	}
+}
+
+// NewCloseTunnelMessage creates a message to close the tunnel.
+func NewCloseTunnelMessage(tunnelId string) *WebSocketTunnelMessage {
+	return &WebSocketTunnelMessage{
+		WebSocketMessage: &WebSocketMessage{
+			Id:   newMessageId(),
+			Type: CloseTunnelMessage,
+		},
+		TunnelId: tunnelId,
+		Response: true,
+	}
+}
+
+// subscriptionKey returns the key of a subscription, a topic may be subscribed in several tunnels.
+func subscriptionKey(tunnelId, topic string) string {
+	if tunnelId == "" {
+		return topic
+	}
+	return tunnelId + "@" + topic
+}
+
+// A WebSocketTunnel is a logical stream multiplexed over the connection of a WebSocketClient.
+// It receives the messages of the channels subscribed in it only.
+type WebSocketTunnel struct {
+	client    *WebSocketClient
+	id        string
+	queue     *webSocketMessageQueue
+	messages  chan *WebSocketDownstreamMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenTunnel opens a tunnel with the id, ctx bounds the wait of the ack.
+// The tunnel buffers its messages with the same backpressure policy as the client,
+// it is opened again after reconnecting.
+func (wc *WebSocketClient) OpenTunnel(ctx context.Context, id string) (*WebSocketTunnel, error) {
+	if id == "" {
+		return nil, errors.New("Empty tunnel id")
+	}
+	t := &WebSocketTunnel{
+		client:   wc,
+		id:       id,
+		queue:    newWebSocketMessageQueue(wc.queue.capacity, wc.queue.policy, wc.queue.key),
+		messages: make(chan *WebSocketDownstreamMessage),
+		closed:   make(chan struct{}),
+	}
+
+	// Register the tunnel first to route the messages pushed right after the ack
+	wc.tunnelsMu.Lock()
+	select {
+	case <-wc.done:
+		wc.tunnelsMu.Unlock()
+		return nil, errors.New("WebSocket client has been stopped")
+	default:
+	}
+	if _, ok := wc.tunnels[id]; ok {
+		wc.tunnelsMu.Unlock()
+		return nil, errors.Errorf("Duplicate tunnel id %s", id)
+	}
+	wc.tunnels[id] = t
+	wc.wg.Add(1)
+	go wc.deliver(t.queue, t.messages, t.closed)
+	wc.tunnelsMu.Unlock()
+
+	m := NewOpenTunnelMessage(id)
+	if _, err := wc.Request(ctx, m.Id, m); err != nil {
+		t.release()
+		return nil, errors.Errorf("Open tunnel failed, %s", err.Error())
+	}
+	return t, nil
+}
+
+// Id returns the id of the tunnel.
+func (t *WebSocketTunnel) Id() string {
+	return t.id
+}
+
+// Messages returns the channel of the messages of the tunnel,
+// it is closed when the tunnel or the client is closed.
+func (t *WebSocketTunnel) Messages() <-chan *WebSocketDownstreamMessage {
+	return t.messages
+}
+
+// MessageStats returns the counters of the message buffer of the tunnel.
+func (t *WebSocketTunnel) MessageStats() WebSocketMessageStats {
+	return t.queue.snapshot()
+}
+
+// Subscribe subscribes the channels in the tunnel, ctx bounds the wait of every ack.
+func (t *WebSocketTunnel) Subscribe(ctx context.Context, channels ...*WebSocketSubscribeMessage) error {
+	for _, c := range channels {
+		c.TunnelId = t.id
+	}
+	return t.client.SubscribeContext(ctx, channels...)
+}
+
+// Unsubscribe unsubscribes the channels in the tunnel, ctx bounds the wait of every ack.
+func (t *WebSocketTunnel) Unsubscribe(ctx context.Context, channels ...*WebSocketUnsubscribeMessage) error {
+	for _, c := range channels {
+		c.TunnelId = t.id
+	}
+	return t.client.UnsubscribeContext(ctx, channels...)
+}
+
+// Close closes the tunnel and forgets its subscriptions, ctx bounds the wait of the ack.
+// The message channel is closed even if the server fails to close the tunnel.
+func (t *WebSocketTunnel) Close(ctx context.Context) error {
+	if !t.release() {
+		return nil
+	}
+	wc := t.client
+	wc.subscriptionsMu.Lock()
+	for k, c := range wc.subscriptions {
+		if c.TunnelId == t.id {
+			delete(wc.subscriptions, k)
+		}
+	}
+	wc.subscriptionsMu.Unlock()
+
+	select {
+	case <-wc.done:
+		return nil
+	default:
+	}
+	m := NewCloseTunnelMessage(t.id)
+	if _, err := wc.Request(ctx, m.Id, m); err != nil {
+		return errors.Errorf("Close tunnel failed, %s", err.Error())
+	}
+	return nil
+}
+
+// release unregisters the tunnel and stops delivering its messages once, and reports whether it did.
+func (t *WebSocketTunnel) release() bool {
+	released := false
+	t.closeOnce.Do(func() {
+		t.client.tunnelsMu.Lock()
+		delete(t.client.tunnels, t.id)
+		t.client.tunnelsMu.Unlock()
+		close(t.closed)
+		t.queue.close()
+		released = true
+	})
+	return released
+}
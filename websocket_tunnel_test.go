@@ -0,0 +1,121 @@
+package kucoin
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitTunnelMessage returns the next message of c or fails after a second.
+func waitTunnelMessage(t *testing.T, c <-chan *WebSocketDownstreamMessage) *WebSocketDownstreamMessage {
+	t.Helper()
+	select {
+	case m := <-c:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("Wait the message timeout")
+	}
+	return nil
+}
+
+func TestWebSocketTunnel_Route(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	c := NewApiService().NewWebSocketClient(tk)
+	mc, _, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	ctx := context.Background()
+	t1, err := c.OpenTunnel(ctx, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := c.OpenTunnel(ctx, "t2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.OpenTunnel(ctx, "t1"); err == nil {
+		t.Error("Expected an error of the duplicate tunnel")
+	}
+
+	if err := t1.Subscribe(ctx, NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Subscribe(ctx, NewSubscribeMessage("/market/ticker:ETH-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(NewSubscribeMessage("/market/ticker:BTC-USDT", false)); err != nil {
+		t.Fatal(err)
+	}
+	if m := waitTunnelMessage(t, t1.Messages()); m.Topic != "/market/ticker:KCS-BTC" || m.TunnelId != "t1" {
+		t.Errorf("Unexpected message of t1: %s", ToJsonString(m))
+	}
+	if m := waitTunnelMessage(t, t2.Messages()); m.Topic != "/market/ticker:ETH-BTC" || m.TunnelId != "t2" {
+		t.Errorf("Unexpected message of t2: %s", ToJsonString(m))
+	}
+	if m := waitTunnelMessage(t, mc); m.Topic != "/market/ticker:BTC-USDT" || m.TunnelId != "" {
+		t.Errorf("Unexpected message of the client: %s", ToJsonString(m))
+	}
+
+	if err := t1.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-t1.Messages(); ok {
+		t.Error("Expected the channel of t1 closed")
+	}
+	if err := t1.Close(ctx); err != nil {
+		t.Error(err)
+	}
+	c.subscriptionsMu.Lock()
+	n := len(c.subscriptions)
+	c.subscriptionsMu.Unlock()
+	if n != 2 {
+		t.Errorf("Expected 2 subscriptions, got %d", n)
+	}
+
+	c.Stop()
+	if _, ok := <-t2.Messages(); ok {
+		t.Error("Expected the channel of t2 closed")
+	}
+	if _, err := c.OpenTunnel(ctx, "t3"); err == nil {
+		t.Error("Expected an error after the client stopped")
+	}
+}
+
+func TestWebSocketTunnel_Reconnect(t *testing.T) {
+	ls, tk := newLocalWebSocketServer(t)
+	defer ls.Close()
+
+	c := NewApiService().NewWebSocketClientOpts(WebSocketClientOpts{
+		Token:             tk,
+		ReconnectAttempts: 3,
+		ReconnectDelay:    10 * time.Millisecond,
+	})
+	if _, _, err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	ctx := context.Background()
+	tn, err := c.OpenTunnel(ctx, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.Subscribe(ctx, NewSubscribeMessage("/market/ticker:KCS-BTC", false)); err != nil {
+		t.Fatal(err)
+	}
+	waitTunnelMessage(t, tn.Messages())
+
+	// The tunnel is opened and its channel is subscribed again over the new connection
+	ls.drop(0)
+	if m := waitTunnelMessage(t, tn.Messages()); m.Topic != "/market/ticker:KCS-BTC" || m.TunnelId != "t1" {
+		t.Errorf("Unexpected message: %s", ToJsonString(m))
+	}
+	if ls.connCount() != 2 {
+		t.Errorf("Expected 2 connections, got %d", ls.connCount())
+	}
+}